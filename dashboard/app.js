@@ -0,0 +1,391 @@
+// Dashboard of wifi_probe_server, reads everything through the query API
+// and the live stream with the token entered, kept in localStorage.
+"use strict";
+
+var LIVE_BUCKET = 10;     // seconds per bar of the live chart
+var LIVE_BUCKETS = 60;    // bars of the live chart
+var LIVE_EVENTS = 50;     // rows of the event list
+var REFRESH = 10000;      // ms between reads of nodes and present devices
+
+var state = {
+  token: localStorage.getItem("token") || "",
+  node: "",               // selected node, empty for every node
+  live: null,             // EventSource
+  buckets: [],            // {start, joins, leaves}
+  events: [],
+};
+
+function $(id) {
+  return document.getElementById(id);
+}
+
+function setStatus(text, error) {
+  $("status").textContent = text;
+  $("status").className = error ? "error" : "";
+}
+
+function api(path, params) {
+  var query = new URLSearchParams(params || {});
+  var url = path + (query.toString() ? "?" + query : "");
+  return fetch(url, {headers: {"Authorization": "Bearer " + state.token}}).then(function (resp) {
+    return resp.json().then(function (body) {
+      if (!resp.ok) {
+        var err = new Error(body.error || resp.statusText);
+        err.status = resp.status;
+        throw err;
+      }
+      return body;
+    });
+  });
+}
+
+// apiAll follows next_cursor and resolves to the items of every page.
+function apiAll(path, params) {
+  var items = [];
+  function page(cursor) {
+    var query = Object.assign({}, params);
+    if (cursor) {
+      query.cursor = cursor;
+    }
+    return api(path, query).then(function (body) {
+      items = items.concat(body.items);
+      return body.next_cursor ? page(body.next_cursor) : items;
+    });
+  }
+  return page("");
+}
+
+function formatTime(unix) {
+  if (!unix) {
+    return "";
+  }
+  return new Date(unix * 1000).toLocaleString();
+}
+
+function formatAge(seconds) {
+  if (seconds < 60) {
+    return seconds + "s";
+  }
+  if (seconds < 3600) {
+    return Math.floor(seconds / 60) + "m";
+  }
+  if (seconds < 86400) {
+    return Math.floor(seconds / 3600) + "h " + Math.floor(seconds % 3600 / 60) + "m";
+  }
+  return Math.floor(seconds / 86400) + "d " + Math.floor(seconds % 86400 / 3600) + "h";
+}
+
+function now() {
+  return Math.floor(Date.now() / 1000);
+}
+
+function cell(row, text, className) {
+  var td = row.insertCell();
+  td.textContent = text === undefined || text === null ? "" : text;
+  if (className) {
+    td.className = className;
+  }
+  return td;
+}
+
+// nodes
+
+function refreshNodes() {
+  return api("/api/v1/nodes").then(function (page) {
+    setStatus("updated " + new Date().toLocaleTimeString());
+    renderNodes(page.items);
+  }).catch(function (err) {
+    setStatus(err.message, true);
+  });
+}
+
+function renderNodes(nodes) {
+  var body = $("nodes").tBodies[0];
+  body.innerHTML = "";
+  nodes.forEach(function (node) {
+    var row = body.insertRow();
+    if (node.nodeid === state.node) {
+      row.className = "selected";
+    }
+    cell(row, node.nodeid);
+    var status = cell(row, "");
+    var badge = document.createElement("span");
+    badge.className = node.online ? "online" : "offline";
+    badge.textContent = node.online ? "online" : "offline";
+    status.appendChild(badge);
+    cell(row, node.connected_since ? formatAge(now() - node.connected_since) : "");
+    cell(row, node.firmware);
+    cell(row, node.last_seen ? formatAge(Math.max(0, now() - node.last_seen)) + " ago" : "");
+    cell(row, node.events_last_minute);
+    cell(row, node.events_last_hour);
+    cell(row, node.present);
+    row.addEventListener("click", function () {
+      selectNode(node.nodeid === state.node ? "" : node.nodeid);
+    });
+  });
+}
+
+function selectNode(node) {
+  state.node = node;
+  var label = node ? "at " + node : "";
+  $("live-node").textContent = label;
+  $("present-node").textContent = label;
+  refreshNodes();
+  refreshPresent();
+  refreshHistory();
+  startLive();
+}
+
+// present devices
+
+function refreshPresent() {
+  var body = $("present").tBodies[0];
+  if (!state.node) {
+    body.innerHTML = "<tr><td colspan=5>Select a node</td></tr>";
+    return Promise.resolve();
+  }
+  return api("/api/v1/nodes/" + encodeURIComponent(state.node) + "/present").then(function (page) {
+    body.innerHTML = "";
+    page.items.forEach(function (device) {
+      var row = body.insertRow();
+      cell(row, device.addr);
+      cell(row, device.source);
+      cell(row, formatTime(device.start));
+      cell(row, formatAge(device.duration));
+      cell(row, device.peak_rssi);
+    });
+    if (!page.items.length) {
+      body.innerHTML = "<tr><td colspan=5>No devices present</td></tr>";
+    }
+  }).catch(function (err) {
+    body.innerHTML = "";
+    cell(body.insertRow(), err.message).colSpan = 5;
+  });
+}
+
+// live chart
+
+function liveBucket(unix) {
+  var start = unix - unix % LIVE_BUCKET;
+  var buckets = state.buckets;
+  while (!buckets.length || buckets[buckets.length - 1].start < start) {
+    var next = buckets.length ? buckets[buckets.length - 1].start + LIVE_BUCKET : start;
+    buckets.push({start: next, joins: 0, leaves: 0});
+  }
+  while (buckets.length > LIVE_BUCKETS) {
+    buckets.shift();
+  }
+  for (var idx = buckets.length - 1; idx >= 0; idx--) {
+    if (buckets[idx].start === start) {
+      return buckets[idx];
+    }
+  }
+  return null;
+}
+
+function startLive() {
+  if (state.live) {
+    state.live.close();
+  }
+  state.buckets = [];
+  state.events = [];
+  renderEvents();
+
+  var params = new URLSearchParams({token: state.token});
+  if (state.node) {
+    params.set("node", state.node);
+  }
+  var live = new EventSource("/api/v1/live?" + params);
+  live.addEventListener("event", function (msg) {
+    var event = JSON.parse(msg.data);
+    var bucket = liveBucket(event.timestamp);
+    if (bucket) {
+      if (event.action === 1) {
+        bucket.joins++;
+      } else if (event.action === 2) {
+        bucket.leaves++;
+      }
+    }
+    state.events.unshift(event);
+    state.events.length = Math.min(state.events.length, LIVE_EVENTS);
+    renderEvents();
+  });
+  live.addEventListener("dropped", function () {
+    // too slow for the server, start over
+    live.close();
+    setTimeout(startLive, 1000);
+  });
+  live.onerror = function () {
+    setStatus("live stream disconnected, retrying", true);
+  };
+  state.live = live;
+}
+
+function renderEvents() {
+  var body = $("events").tBodies[0];
+  body.innerHTML = "";
+  state.events.forEach(function (event) {
+    var row = body.insertRow();
+    cell(row, new Date(event.timestamp * 1000).toLocaleTimeString());
+    cell(row, event.node_id);
+    cell(row, event.addr);
+    cell(row, event.from);
+    cell(row, event.rssi);
+    if (event.from_node) {
+      cell(row, "zone from " + event.from_node);
+    } else {
+      cell(row, event.action === 1 ? "join" : event.action === 2 ? "leave" : event.action);
+    }
+  });
+}
+
+function drawLive() {
+  liveBucket(now());
+  var labels = [], first = [], second = [];
+  state.buckets.forEach(function (bucket) {
+    labels.push(new Date(bucket.start * 1000).toLocaleTimeString());
+    first.push(bucket.joins);
+    second.push(bucket.leaves);
+  });
+  drawBars($("live-chart"), labels, first, second);
+}
+
+// historical chart
+
+function refreshHistory() {
+  var period = $("period").value;
+  var span = period === "hour" ? 48 * 3600 : 30 * 86400;
+  var params = {period: period, from: now() - span, limit: 1000};
+  if (state.node) {
+    params.node = state.node;
+  }
+  return apiAll("/api/v1/rollups", params).then(function (rollups) {
+    // rollups of every node are summed per period
+    var by_start = {};
+    rollups.forEach(function (rollup) {
+      var sum = by_start[rollup.start] || (by_start[rollup.start] = {visitors: 0, new_visitors: 0});
+      sum.visitors += rollup.visitors;
+      sum.new_visitors += rollup.new_visitors;
+    });
+    var starts = Object.keys(by_start).map(Number).sort(function (a, b) { return a - b; });
+    var labels = starts.map(function (start) {
+      var date = new Date(start * 1000);
+      return period === "hour" ? date.toLocaleString([], {weekday: "short", hour: "2-digit"}) : date.toLocaleDateString();
+    });
+    drawBars($("history-chart"), labels,
+      starts.map(function (start) { return by_start[start].visitors; }),
+      starts.map(function (start) { return by_start[start].new_visitors; }));
+  }).catch(function (err) {
+    drawMessage($("history-chart"), err.message);
+  });
+}
+
+// canvas drawing
+
+function setupCanvas(canvas) {
+  var ratio = window.devicePixelRatio || 1;
+  var width = canvas.clientWidth, height = canvas.clientHeight;
+  canvas.width = width * ratio;
+  canvas.height = height * ratio;
+  var ctx = canvas.getContext("2d");
+  ctx.scale(ratio, ratio);
+  ctx.clearRect(0, 0, width, height);
+  ctx.font = "11px sans-serif";
+  return {ctx: ctx, width: width, height: height};
+}
+
+function drawMessage(canvas, text) {
+  var c = setupCanvas(canvas);
+  c.ctx.fillStyle = "#666";
+  c.ctx.fillText(text, 10, 20);
+}
+
+// drawBars draws two series of bars side by side with a scale on the left.
+function drawBars(canvas, labels, first, second) {
+  var c = setupCanvas(canvas), ctx = c.ctx;
+  var left = 36, bottom = 18, top = 8;
+  var plot_width = c.width - left - 4, plot_height = c.height - top - bottom;
+  if (!labels.length) {
+    drawMessage(canvas, "no data");
+    return;
+  }
+
+  var max = Math.max(1, Math.max.apply(null, first.concat(second)));
+  var step = Math.pow(10, Math.floor(Math.log10(max)));
+  if (max / step < 2) {
+    step /= 5;
+  } else if (max / step < 5) {
+    step /= 2;
+  }
+  step = Math.max(1, step);
+  max = Math.ceil(max / step) * step;
+
+  ctx.strokeStyle = "#e3e5e8";
+  ctx.fillStyle = "#666";
+  ctx.textAlign = "right";
+  ctx.textBaseline = "middle";
+  for (var value = 0; value <= max; value += step) {
+    var y = top + plot_height - value / max * plot_height;
+    ctx.beginPath();
+    ctx.moveTo(left, y);
+    ctx.lineTo(c.width, y);
+    ctx.stroke();
+    ctx.fillText(String(value), left - 4, y);
+  }
+
+  var slot = plot_width / labels.length;
+  var bar = Math.max(1, slot / 2 - 1);
+  [[first, "#3a78b5", 0], [second, "#e08a2c", bar]].forEach(function (series) {
+    ctx.fillStyle = series[1];
+    series[0].forEach(function (value, idx) {
+      var height = value / max * plot_height;
+      ctx.fillRect(left + idx * slot + series[2], top + plot_height - height, bar, height);
+    });
+  });
+
+  // as many labels as fit
+  ctx.fillStyle = "#666";
+  ctx.textAlign = "center";
+  ctx.textBaseline = "top";
+  var every = Math.ceil(labels.length / Math.max(1, Math.floor(plot_width / 90)));
+  for (var idx = 0; idx < labels.length; idx += every) {
+    ctx.fillText(labels[idx], left + idx * slot + slot / 2, top + plot_height + 4);
+  }
+}
+
+// start
+
+function connect() {
+  if (!state.token) {
+    setStatus("enter an API token", true);
+    return;
+  }
+  selectNode(state.node);
+}
+
+$("token").value = state.token;
+$("login").addEventListener("submit", function (ev) {
+  ev.preventDefault();
+  state.token = $("token").value.trim();
+  localStorage.setItem("token", state.token);
+  connect();
+});
+$("period").addEventListener("change", refreshHistory);
+
+setInterval(function () {
+  if (state.token) {
+    refreshNodes();
+    refreshPresent();
+  }
+}, REFRESH);
+setInterval(function () {
+  if (state.token) {
+    refreshHistory();
+  }
+}, 60 * REFRESH);
+setInterval(function () {
+  if (state.token) {
+    drawLive();
+  }
+}, 1000);
+connect();
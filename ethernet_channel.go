@@ -38,6 +38,8 @@ func init() {
 
 	flag.StringVar(&content, "c", "", "string content to send")
 	flag.StringVar(&content, "-content", "", "string content to send")
+
+	AddLogFlags()
 }
 
 // Ethertype is a type used represent the ethertype of an ethernet frame.
@@ -321,6 +323,11 @@ func CheckFlags() {
 		goto EXIT
 	}
 
+	if err := SetupLog(); err != nil {
+		fmt.Println(err)
+		goto EXIT
+	}
+
 	return
 
 EXIT:
@@ -332,20 +339,20 @@ func main() {
 
 	iface, err := net.InterfaceByName(nic_interface)
 	if err != nil {
-		fmt.Println(err)
+		Log.Error("can not find interface", "interface", nic_interface, "err", err)
 		return
 	}
 
 	dev, err := newDev(iface, nil, MAX_PAYLOAD_SIZE)
 	if err != nil {
-		fmt.Println(err)
+		Log.Error("can not open raw socket", "interface", nic_interface, "err", err)
 		return
 	}
 
 	if is_sender == true {
 		err = dev.SendFrame(dest_mac_address, []byte(content))
 		if err != nil {
-			fmt.Println(err)
+			Log.Error("send frame failed", "to", dest_mac_address, "err", err)
 		}
 	}
 
@@ -353,7 +360,7 @@ func main() {
 		for {
 			payload, err := dev.RecvFrame()
 			if err != nil {
-				fmt.Println(err)
+				Log.Warn("receive frame failed", "err", err)
 			}
 			fmt.Println(string(payload))
 		}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
 	"syscall"
 	"unsafe"
 )
@@ -24,12 +26,23 @@ func ReadFileConntent(filename string) (content string) {
 }
 
 func main() {
-	l, _ := ListenNetlink()
+	AddLogFlags()
+	flag.Parse()
+	if err := SetupLog(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	l, err := ListenNetlink()
+	if err != nil {
+		Log.Error("can not listen netlink", "err", err)
+		os.Exit(1)
+	}
 
 	for {
 		msgs, err := l.ReadMsgs()
 		if err != nil {
-			fmt.Println("Could not read netlink: %s", err)
+			Log.Warn("could not read netlink", "err", err)
 		}
 
 		for _, m := range msgs {
@@ -38,32 +51,33 @@ func main() {
 
 				ifim := (*syscall.IfInfomsg)(unsafe.Pointer(&m.Data[0]))
 
+				state := "UP"
 				if (ifim.Flags & 0x10000) == 0 {
-					fmt.Printf("DOWN ")
-				} else {
-					fmt.Printf("UP ")
+					state = "DOWN"
 				}
 
 				route_attrs, err := syscall.ParseNetlinkRouteAttr(&m)
 				if err != nil {
-					fmt.Println("failed:", err)
+					Log.Error("parse route attributes failed", "err", err)
 					os.Exit(1)
 				}
 
+				ifname := ""
 				for _, attr := range route_attrs {
 					if attr.Attr.Type == syscall.IFLA_IFNAME {
-						fmt.Printf("%s\n", string(attr.Value))
+						ifname = strings.TrimRight(string(attr.Value), "\x00")
 						break
 					}
 				}
+				Log.Info("link changed", "state", state, "interface", ifname)
 			}
 
 			if IsNewAddr(&m) {
-				fmt.Println("New Addr")
+				Log.Info("new addr")
 			}
 
 			if IsDelAddr(&m) {
-				fmt.Println("Del Addr")
+				Log.Info("del addr")
 			}
 		}
 	}
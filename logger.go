@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log/syslog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Logger shared by all daemons in this directory. Messages carry key-value
+// fields and are written as one line each:
+//
+//	2015-06-01 12:00:00 INFO  wifi_probe_client: device joined mac=0:1b:63:84:45:e6 rssi=-61
+//
+// Output goes to stdout, stderr, a size rotated file or the local syslog.
+// SIGUSR1 toggles debug level at runtime.
+
+type Level int32
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var level_names = []string{"DEBUG", "INFO", "WARN", "ERROR"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("LEVEL%d", int(l))
+	}
+	return level_names[l]
+}
+
+func ParseLevel(s string) (Level, error) {
+	for idx, name := range level_names {
+		if strings.EqualFold(s, name) {
+			return Level(idx), nil
+		}
+	}
+	if strings.EqualFold(s, "warning") {
+		return LevelWarn, nil
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q", s)
+}
+
+type logSink struct {
+	lock   sync.Mutex
+	level  int32
+	base   Level // level configured, SIGUSR1 toggles between this and debug
+	prefix string
+	out    io.Writer
+	syslog *syslog.Writer
+	closer io.Closer
+}
+
+type Logger struct {
+	sink   *logSink
+	fields []interface{}
+}
+
+var Log = NewLogger(filepath.Base(os.Args[0]))
+
+func NewLogger(prefix string) *Logger {
+	sink := &logSink{
+		level:  int32(LevelInfo),
+		base:   LevelInfo,
+		prefix: prefix,
+		out:    os.Stdout,
+	}
+	return &Logger{sink: sink}
+}
+
+// With returns a logger adding kv to every message, sharing level and output.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	return &Logger{sink: l.sink, fields: fields}
+}
+
+func (l *Logger) Level() Level {
+	return Level(atomic.LoadInt32(&l.sink.level))
+}
+
+func (l *Logger) SetLevel(level Level) {
+	l.sink.lock.Lock()
+	l.sink.base = level
+	l.sink.lock.Unlock()
+	atomic.StoreInt32(&l.sink.level, int32(level))
+}
+
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.Level()
+}
+
+// SetOutput switches to "stdout", "stderr", "syslog" or a file path. Files
+// are rotated once they grow beyond max_size bytes, keeping backups old files.
+func (l *Logger) SetOutput(output string, max_size int64, backups int) error {
+	var out io.Writer
+	var closer io.Closer
+	var syslog_writer *syslog.Writer
+
+	switch output {
+	case "", "stdout":
+		out = os.Stdout
+	case "stderr":
+		out = os.Stderr
+	case "syslog":
+		w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, l.sink.prefix)
+		if err != nil {
+			return err
+		}
+		syslog_writer = w
+		closer = w
+	default:
+		f, err := OpenRotateFile(output, max_size, backups)
+		if err != nil {
+			return err
+		}
+		out = f
+		closer = f
+	}
+
+	l.sink.lock.Lock()
+	old := l.sink.closer
+	l.sink.out = out
+	l.sink.syslog = syslog_writer
+	l.sink.closer = closer
+	l.sink.lock.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// Configure applies level and output given as strings, e.g. from flags.
+func (l *Logger) Configure(level, output string, max_size int64, backups int) error {
+	lvl, err := ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	if err := l.SetOutput(output, max_size, backups); err != nil {
+		return err
+	}
+	l.SetLevel(lvl)
+	return nil
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.log(LevelDebug, msg, kv) }
+func (l *Logger) Info(msg string, kv ...interface{})  { l.log(LevelInfo, msg, kv) }
+func (l *Logger) Warn(msg string, kv ...interface{})  { l.log(LevelWarn, msg, kv) }
+func (l *Logger) Error(msg string, kv ...interface{}) { l.log(LevelError, msg, kv) }
+
+func (l *Logger) log(level Level, msg string, kv []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(msg)
+	appendFields(&buf, l.fields)
+	appendFields(&buf, kv)
+	line := buf.String()
+
+	sink := l.sink
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+
+	if sink.syslog != nil {
+		switch level {
+		case LevelDebug:
+			sink.syslog.Debug(line)
+		case LevelInfo:
+			sink.syslog.Info(line)
+		case LevelWarn:
+			sink.syslog.Warning(line)
+		default:
+			sink.syslog.Err(line)
+		}
+		return
+	}
+
+	fmt.Fprintf(sink.out, "%s %-5s %s: %s\n", time.Now().Format("2006-01-02 15:04:05"), level, sink.prefix, line)
+}
+
+func appendFields(buf *bytes.Buffer, kv []interface{}) {
+	for i := 0; i < len(kv); i += 2 {
+		buf.WriteByte(' ')
+		buf.WriteString(fmt.Sprint(kv[i]))
+		buf.WriteByte('=')
+		if i+1 >= len(kv) {
+			buf.WriteString("(missing)")
+			break
+		}
+
+		var value string
+		switch v := kv[i+1].(type) {
+		case error:
+			value = v.Error()
+		case fmt.Stringer:
+			value = v.String()
+		default:
+			value = fmt.Sprint(v)
+		}
+		if value == "" || strings.ContainsAny(value, " =\"\t\n") {
+			value = fmt.Sprintf("%q", value)
+		}
+		buf.WriteString(value)
+	}
+}
+
+// RotateFile is an append only log file renamed to name.1, name.2 ... once
+// it reaches max_size bytes.
+type RotateFile struct {
+	name     string
+	max_size int64
+	backups  int
+	size     int64
+	fp       *os.File
+}
+
+func OpenRotateFile(name string, max_size int64, backups int) (*RotateFile, error) {
+	f := &RotateFile{name: name, max_size: max_size, backups: backups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RotateFile) open() error {
+	fp, err := os.OpenFile(f.name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := fp.Stat()
+	if err != nil {
+		fp.Close()
+		return err
+	}
+	f.fp = fp
+	f.size = info.Size()
+	return nil
+}
+
+func (f *RotateFile) rotate() error {
+	f.fp.Close()
+	for i := f.backups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", f.name, i), fmt.Sprintf("%s.%d", f.name, i+1))
+	}
+	if f.backups > 0 {
+		os.Rename(f.name, f.name+".1")
+	} else {
+		os.Remove(f.name)
+	}
+	return f.open()
+}
+
+func (f *RotateFile) Write(p []byte) (int, error) {
+	if f.max_size > 0 && f.size+int64(len(p)) > f.max_size {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.fp.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *RotateFile) Close() error {
+	return f.fp.Close()
+}
+
+var (
+	log_level_flag    string
+	log_output_flag   string
+	log_max_size_flag int64
+	log_backups_flag  int
+)
+
+// AddLogFlags registers -log_level, -log_output, -log_max_size and
+// -log_backups for daemons without a config file.
+func AddLogFlags() {
+	flag.StringVar(&log_level_flag, "log_level", "info", "log level: debug, info, warn or error")
+	flag.StringVar(&log_output_flag, "log_output", "stdout", "log to stdout, stderr, syslog or a file path")
+	flag.Int64Var(&log_max_size_flag, "log_max_size", 1024*1024, "rotate log file at this many bytes")
+	flag.IntVar(&log_backups_flag, "log_backups", 3, "rotated log files to keep")
+}
+
+// SetupLog applies the flags of AddLogFlags, call it after flag.Parse.
+func SetupLog() error {
+	err := Log.Configure(log_level_flag, log_output_flag, log_max_size_flag, log_backups_flag)
+	if err != nil {
+		return err
+	}
+	go WatchLogSignal()
+	return nil
+}
+
+// WatchLogSignal toggles between debug and the configured level on SIGUSR1.
+func WatchLogSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	for range signals {
+		sink := Log.sink
+		sink.lock.Lock()
+		level := sink.base
+		if Log.Level() == sink.base {
+			level = LevelDebug
+		}
+		sink.lock.Unlock()
+
+		atomic.StoreInt32(&sink.level, int32(level))
+		Log.Info("log level changed", "level", level)
+	}
+}
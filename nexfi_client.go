@@ -2,8 +2,9 @@ package main
 
 import (
 	"encoding/gob"
+	"flag"
+	"fmt"
 	"io/ioutil"
-	"log"
 	"net"
 	"os"
 	"time"
@@ -29,15 +30,22 @@ func ReadFileContent(filename string) (content string) {
 }
 
 func main() {
-	if len(os.Args) <= 1 {
-		log.Println("need server address argument.")
+	AddLogFlags()
+	flag.Parse()
+	if err := SetupLog(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if flag.NArg() < 1 {
+		Log.Error("need server address argument")
 		return
 	}
 
 	timeout := time.Duration(time.Second * 3)
-	conn, err := net.DialTimeout("tcp", os.Args[1], timeout)
+	conn, err := net.DialTimeout("tcp", flag.Arg(0), timeout)
 	if err != nil {
-		log.Println("can not connect to server:", err)
+		Log.Error("can not connect to server", "server", flag.Arg(0), "err", err)
 		return
 	}
 
@@ -46,6 +54,9 @@ func main() {
 	uptime := ReadFileContent(UPTIME_PATH)
 	//mac := "123123132"
 	//uptime := "12731792387"
-	encoder.Encode(&Client{mac, uptime})
+	err = encoder.Encode(&Client{mac, uptime})
+	if err != nil {
+		Log.Error("send report failed", "err", err)
+	}
 	conn.Close()
 }
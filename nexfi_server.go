@@ -2,9 +2,9 @@ package main
 
 import (
 	"encoding/gob"
+	"flag"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"os"
 )
@@ -15,35 +15,43 @@ type Client struct {
 }
 
 func HandleConnection(conn net.Conn) {
+	log := Log.With("remote", conn.RemoteAddr())
 	decoder := gob.NewDecoder(conn)
 	for {
 		client := new(Client)
 		err := decoder.Decode(client)
 		if err == io.EOF {
-			log.Println("connection close")
+			log.Info("connection close")
 			conn.Close()
 			break
 		}
 		if err != nil {
-			log.Println("decode network data failed:", err)
+			log.Warn("decode network data failed", "err", err)
 			break
 		}
-		log.Println("got client data:", client)
+		log.Info("got client data", "mac", client.MACID, "uptime", client.Uptime)
 	}
 }
 
 func main() {
-	if len(os.Args) <= 1 {
-		log.Println("need listen address argument.")
+	AddLogFlags()
+	flag.Parse()
+	if err := SetupLog(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if flag.NArg() < 1 {
+		Log.Error("need listen port argument")
 		return
 	}
 
-	log.Println("Start server")
+	Log.Info("start server")
 
-	listen_addr := fmt.Sprintf("0.0.0.0:%s", os.Args[1])
+	listen_addr := fmt.Sprintf("0.0.0.0:%s", flag.Arg(0))
 	listen_sock, err := net.Listen("tcp", listen_addr)
 	if err != nil {
-		log.Println("can not listen for tcp:", err)
+		Log.Error("can not listen for tcp", "addr", listen_addr, "err", err)
 		return
 	}
 	for {
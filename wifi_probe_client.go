@@ -4,11 +4,9 @@ package main
 
 import (
 	"encoding/binary"
-	"encoding/gob"
 	"flag"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net"
 	"os"
 	"runtime/debug"
@@ -19,44 +17,28 @@ import (
 	"unsafe"
 )
 
-const (
-	MAC_ADDR_EXPIRE      = 30
-	DEBUG                = true
-	ENABLE_HTTP_SNIFF    = true
-	ENABLE_BEACON_FRAME  = false
-	ENABLE_PROBE_REQUEST = true
-	MAC_ADDRESS_PATH     = "/sys/devices/platform/ar933x_wmac/net/wlan0/phy80211/macaddress"
-)
-
 var (
 	NODE_ID string
-	Log     = log.New(os.Stdout, "Prober: ", log.Ldate|log.Ltime|log.Lshortfile)
-)
 
-type Client struct {
-	NodeID string
-	Addr   string
-	From   string
-	Model  string
-	RSSI   int
-	SSID   string
-	Action int
-}
+	// set at build time with -ldflags "-X main.firmware_version=..."
+	firmware_version = "dev"
+)
 
-func NewClient(addr string, from string, rssi int, ssid string, action int) *Client {
+func NewClient(mac_client *macaddr, from string, rssi int, ssid string, action int) *Client {
 	client_model_map_lock.RLock()
 	defer client_model_map_lock.RUnlock()
 
 	client := client_pool.Get().(*Client)
 
 	client.NodeID = NODE_ID
-	client.Addr = addr
+	client.Addr = mac_client.Alias
 	client.From = from
 	client.RSSI = rssi
 	client.SSID = ssid
 	client.Action = action
+	client.Time = time.Now().Unix()
 
-	if model, ok := client_model_map[addr]; ok {
+	if model, ok := client_model_map[mac_client.Addr]; ok {
 		client.Model = model
 	} else {
 		client.Model = ""
@@ -66,17 +48,28 @@ func NewClient(addr string, from string, rssi int, ssid string, action int) *Cli
 
 type macaddr struct {
 	Addr       string
+	Alias      string // what the server sees, see Pseudonymize
 	Lastupdate int64
 }
 
+// NewMacaddr fails if the device has no pseudonym, it is then not tracked
+// and not reported.
+func NewMacaddr(mac_str string) (*macaddr, error) {
+	alias, err := Pseudonymize(mac_str)
+	if err != nil {
+		return nil, err
+	}
+	mac_client := new(macaddr)
+	mac_client.Addr = mac_str
+	mac_client.Alias = alias
+	mac_client.Lastupdate = time.Now().Unix()
+	return mac_client, nil
+}
+
 var (
-	monitor_interface     string
-	server_address        string
 	mac_map               map[string]*macaddr
 	map_lock              *sync.Mutex
-	encoder               *gob.Encoder
 	client_channel        chan *Client
-	server_conn           net.Conn
 	client_model_map      map[string]string
 	client_model_map_lock *sync.RWMutex
 	client_pool           *sync.Pool
@@ -89,9 +82,6 @@ type afpacket struct {
 }
 
 func init() {
-	flag.StringVar(&monitor_interface, "i", "", "Network interface name to monitor")
-	flag.StringVar(&server_address, "s", "", "http server address")
-
 	mac_map = make(map[string]*macaddr, 128)
 	map_lock = new(sync.Mutex)
 	client_channel = make(chan *Client, 1024)
@@ -104,48 +94,60 @@ func init() {
 
 	client_model_map = make(map[string]string, 128)
 	client_model_map_lock = new(sync.RWMutex)
-
-	NODE_ID = ReadNodeID()
 }
 
 func ReadNodeID() (ret string) {
-	data, err := ioutil.ReadFile(MAC_ADDRESS_PATH)
+	data, err := ioutil.ReadFile(Conf().MACAddressPath)
 	if err != nil {
-		Log.Println("read mac address failed:", err)
+		Log.Error("read mac address failed", "err", err)
 		return
 	}
 
 	return strings.Trim(string(data), "\n")
 }
 
-func ConnectServer() {
-	var err error
-
-	if server_conn != nil {
-		server_conn.Close()
+func NewHello() *Hello {
+	hello := &Hello{
+		Version:    PROTOCOL_VERSION,
+		MinVersion: PROTOCOL_MIN_VERSION,
+		NodeID:     NODE_ID,
+		Firmware:   firmware_version,
 	}
-
-	server_conn, err = net.DialTimeout("tcp", server_address, 3*time.Second)
-	if err != nil {
-		Log.Println("failed connect to server:", err)
-		return
+	if Conf().Report == REPORT_SUMMARY {
+		hello.Capabilities = append(hello.Capabilities, CAP_SUMMARY, CAP_ACK)
+	} else {
+		hello.Capabilities = append(hello.Capabilities, CAP_EVENTS, CAP_BATCH, CAP_GZIP, CAP_ZSTD, CAP_ACK)
+	}
+	// the server may drop a node announcing pings once it goes silent, it
+	// waits for a few intervals; a changed interval applies on reconnect
+	if Conf().HeartbeatInterval > 0 {
+		hello.Capabilities = append(hello.Capabilities, CAP_PING)
+		hello.Heartbeat = int64(Conf().HeartbeatInterval / time.Second)
 	}
-	encoder = gob.NewEncoder(server_conn)
+	return hello
 }
 
 func CheckFlags() {
 	flag.Parse()
 
-	if monitor_interface == "" {
-		fmt.Println("need network interface name")
+	config, err := BuildConfig()
+	if err != nil {
+		fmt.Println(err)
 		goto EXIT
 	}
+	current_config.Store(config)
 
-	if server_address == "" {
-		fmt.Println("need server address")
+	if err = ApplyLogConfig(config); err != nil {
+		fmt.Println(err)
 		goto EXIT
 	}
+	go WatchLogSignal()
 
+	if !CheckPseudoFlags() {
+		goto EXIT
+	}
+
+	NODE_ID = ReadNodeID()
 	return
 
 EXIT:
@@ -179,6 +181,9 @@ func newDev(ifce *net.Interface) (*afpacket, error) {
 	d.sockaddrLL.Protocol = uint16(htons(0x0003))
 	syscall.Bind(d.fd, d.sockaddrLL)
 
+	// wake up Read once a second so the capture loop can notice a stop
+	err = syscall.SetsockoptTimeval(d.fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &syscall.Timeval{Sec: 1})
+
 	return d, err
 }
 
@@ -193,8 +198,7 @@ func (d *afpacket) Close() error {
 func (d *afpacket) Read(to []byte) error {
 	defer func() {
 		if err := recover(); err != nil {
-			Log.Println(err)
-			debug.PrintStack()
+			Log.Error("recovered", "err", err, "stack", string(debug.Stack()))
 		}
 	}()
 
@@ -205,37 +209,17 @@ func (d *afpacket) Read(to []byte) error {
 	return nil
 }
 
-func ClientSender() {
-	ConnectServer()
-
-	for {
-		if encoder != nil {
-			client := <-client_channel
-			err := encoder.Encode(client)
-			if err != nil {
-				Log.Println("send data to server failed:", err)
-				ConnectServer()
-			}
-			client_pool.Put(client)
-		} else {
-			time.Sleep(1 * time.Second)
-			ConnectServer()
-		}
-	}
-}
-
 func CheckExipreMAC() {
 	for {
+		conf := Conf()
 
 		map_lock.Lock()
 		for mac_str, mac_client := range mac_map {
 			now := time.Now().Unix()
-			if now-mac_client.Lastupdate > MAC_ADDR_EXPIRE {
+			if now-mac_client.Lastupdate > conf.MACAddrExpire {
 				delete(mac_map, mac_str)
-				if DEBUG {
-					Log.Printf("MAC: %s has left\n", mac_str)
-				}
-				client_channel <- NewClient(mac_client.Addr, "leave", 0, "", 2)
+				Log.Debug("device left", "mac", mac_str)
+				ReportEvent(NewClient(mac_client, "leave", 0, "", 2))
 			}
 		}
 		map_lock.Unlock()
@@ -250,40 +234,44 @@ func UpdateClientBrower(mac_str, browser_agent string) {
 
 	if strings.Contains(browser_agent, "iPhone") {
 		client_model_map[mac_str] = "iPhone"
-		if DEBUG {
-			Log.Printf("%s is iPhone\n", mac_str)
-		}
+		Log.Debug("device model", "mac", mac_str, "model", "iPhone")
 	}
 }
 
 func HandleFrame(frame []byte) {
 	lens := int(frame[2])
+	conf := Conf()
 	defer func() {
 		if err := recover(); err != nil {
-			Log.Println(err)
-			debug.PrintStack()
+			Log.Error("recovered", "err", err, "stack", string(debug.Stack()))
 		}
 	}()
 
 	// beacon frame
-	if frame[lens] == 0x80 && ENABLE_BEACON_FRAME {
+	if frame[lens] == 0x80 && conf.EnableBeaconFrame {
 		mac := frame[lens+10 : lens+16]
+		if !MACAllowed(mac) {
+			return
+		}
 		ssid := frame[lens+38 : (lens + 38 + int(frame[lens+37]))]
 		mac_str := fmt.Sprintf("%x:%x:%x:%x:%x:%x", int(mac[0]), int(mac[1]), int(mac[2]), int(mac[3]), int(mac[4]), int(mac[5]))
 		ssid_str := string(ssid)
-		fmt.Printf("MAC: %s, SSID: %s\n", mac_str, ssid_str)
+		Log.Debug("beacon", "mac", mac_str, "ssid", ssid_str)
 	}
 
 	// probe request frame
-	if frame[lens] == 0x40 && ENABLE_PROBE_REQUEST {
+	if frame[lens] == 0x40 && conf.EnableProbeRequest {
 		mac := frame[lens+10 : lens+16]
+		if !MACAllowed(mac) {
+			return
+		}
 		ssid := frame[lens+26 : (lens + 26 + int(frame[lens+25]))]
 		ssi_signal := 256 - int(frame[30])
 		mac_str := fmt.Sprintf("%x:%x:%x:%x:%x:%x", int(mac[0]), int(mac[1]), int(mac[2]), int(mac[3]), int(mac[4]), int(mac[5]))
 		ssid_str := string(ssid)
-		if DEBUG {
-			fmt.Printf("MAC: %s, SSID: %s SSI: -%d\n", mac_str, ssid_str, ssi_signal)
-		}
+		Log.Debug("probe request", "mac", mac_str, "ssid", ssid_str, "rssi", -ssi_signal)
+
+		ObserveDevice(mac_str, ssi_signal, ssid_str)
 
 		now := time.Now().Unix()
 
@@ -294,20 +282,23 @@ func HandleFrame(frame []byte) {
 		if ok == true {
 			mac_client.Lastupdate = now
 		} else {
-			mac_client := new(macaddr)
-			mac_client.Addr = mac_str
-			mac_client.Lastupdate = time.Now().Unix()
-			mac_map[mac_str] = mac_client
-			if DEBUG {
-				Log.Printf("MAC: %s has join\n", mac_str)
+			mac_client, err := NewMacaddr(mac_str)
+			if err != nil {
+				Log.Warn("skip device without pseudonym", "err", err)
+				return
 			}
-			client_channel <- NewClient(mac_str, "probe", ssi_signal, ssid_str, 1)
+			mac_map[mac_str] = mac_client
+			Log.Debug("device joined", "mac", mac_str)
+			ReportEvent(NewClient(mac_client, "probe", ssi_signal, ssid_str, 1))
 		}
 	}
 
 	// plain http request
-	if frame[lens] == 0x88 && ENABLE_HTTP_SNIFF {
+	if frame[lens] == 0x88 && conf.EnableHTTPSniff {
 		mac := frame[lens+10 : lens+16]
+		if !MACAllowed(mac) {
+			return
+		}
 		mac_str := fmt.Sprintf("%x:%x:%x:%x:%x:%x", int(mac[0]), int(mac[1]), int(mac[2]), int(mac[3]), int(mac[4]), int(mac[5]))
 		ssi_signal := 256 - int(frame[30])
 
@@ -356,6 +347,7 @@ func HandleFrame(frame []byte) {
 								http_head_item := http_head[idx]
 								if strings.HasPrefix(http_head_item, "User-Agent") {
 									UpdateClientBrower(mac_str, http_head_item)
+									ObserveDevice(mac_str, ssi_signal, "")
 
 									map_lock.Lock()
 									defer map_lock.Unlock()
@@ -365,11 +357,13 @@ func HandleFrame(frame []byte) {
 									if ok == true {
 										mac_client.Lastupdate = now
 									} else {
-										client_channel <- NewClient(mac_str, "sta", ssi_signal, "", 1)
-										mac_client := new(macaddr)
-										mac_client.Addr = mac_str
-										mac_client.Lastupdate = time.Now().Unix()
+										mac_client, err := NewMacaddr(mac_str)
+										if err != nil {
+											Log.Warn("skip device without pseudonym", "err", err)
+											return
+										}
 										mac_map[mac_str] = mac_client
+										ReportEvent(NewClient(mac_client, "sta", ssi_signal, "", 1))
 									}
 								}
 							}
@@ -384,28 +378,45 @@ func HandleFrame(frame []byte) {
 func main() {
 	CheckFlags()
 
-	iface, err := net.InterfaceByName(monitor_interface)
+	iface, err := net.InterfaceByName(Conf().Interface)
 	if err != nil {
-		Log.Println(err)
+		Log.Error("can not find interface", "interface", Conf().Interface, "err", err)
 		return
 	}
 
 	dev, err := newDev(iface)
 	if err != nil {
-		Log.Println(err)
+		Log.Error("can not open raw socket", "interface", iface.Name, "err", err)
 		return
 	}
 
+	ReloadMacFilter()
+	LoadSeq()
+
 	go CheckExipreMAC()
-	go ClientSender()
+	go WatchMacFilter()
+	go WatchConfigSignal()
+	go WatchStopSignal()
+	if Conf().Output == OUTPUT_MQTT {
+		go MQTTSender()
+	} else {
+		StartUpstreams()
+	}
+	go WatchStatus()
 
 	frame := make([]byte, 1500)
-	for {
+	for !IsStopping() {
 		err := dev.Read(frame)
+		if err == syscall.EAGAIN || err == syscall.EINTR {
+			continue
+		}
 		if err != nil {
-			Log.Println(err)
+			Log.Warn("read frame failed", "err", err)
 			continue
 		}
 		HandleFrame(frame)
 	}
+	dev.Close()
+
+	Shutdown()
 }
@@ -0,0 +1,269 @@
+// +build linux
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Every event and summary gets a sequence number, increasing per node across
+// restarts. Servers announcing the ack capability answer with cumulative
+// acks, the seq of the last message they stored. Messages written but not
+// yet acked are kept in a window of the upstream and written again after a
+// reconnect; the server drops what it already has by (node, seq). On
+// shutdown the window goes to the spool, except for messages read from the
+// spool, whose segment stays until they are acked.
+//
+// The next free seq is persisted in seq_file in blocks of SEQ_BLOCK, so a
+// restart skips at most one block instead of reusing numbers.
+const (
+	SEQ_BLOCK   = 10000
+	MAX_UNACKED = 4096
+	ACK_TIMEOUT = 30 * time.Second
+)
+
+type sentFrame struct {
+	seq     uint64
+	frame   SpoolFrame
+	spooled bool // still in a spool segment
+}
+
+var (
+	seq_lock     *sync.Mutex
+	seq_file     string
+	next_seq     uint64
+	seq_reserved uint64
+)
+
+func init() {
+	seq_lock = new(sync.Mutex)
+}
+
+// LoadSeq reads the sequence state, call it once before events are reported.
+func LoadSeq() {
+	conf := Conf()
+	seq_file = conf.SeqFile
+	if seq_file == "" && conf.SpoolDir != "" {
+		seq_file = filepath.Join(conf.SpoolDir, "sequence")
+	}
+	if seq_file == "" {
+		// without state the clock is the best guess for a fresh start
+		next_seq = uint64(time.Now().UnixNano() / 1000)
+		Log.Warn("no seq_file or spool_dir, sequence numbers start from the clock", "seq", next_seq)
+		return
+	}
+
+	data, err := ioutil.ReadFile(seq_file)
+	if os.IsNotExist(err) {
+		next_seq = 1
+		return
+	}
+	if err == nil {
+		next_seq, err = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	}
+	if err != nil {
+		next_seq = uint64(time.Now().UnixNano() / 1000)
+		Log.Error("read sequence state failed, start from the clock", "file", seq_file, "seq", next_seq, "err", err)
+	}
+}
+
+func saveSeq(seq uint64) error {
+	tmp := seq_file + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strconv.FormatUint(seq, 10)+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, seq_file)
+}
+
+func NextSeq() uint64 {
+	seq_lock.Lock()
+	defer seq_lock.Unlock()
+
+	if seq_file != "" && next_seq >= seq_reserved {
+		if err := saveSeq(next_seq + SEQ_BLOCK); err != nil {
+			Log.Error("save sequence state failed", "file", seq_file, "err", err)
+		}
+		seq_reserved = next_seq + SEQ_BLOCK
+	}
+	seq := next_seq
+	next_seq++
+	return seq
+}
+
+// frameSeq returns the seq of an encoded event or summary.
+func frameSeq(msg_type MsgType, payload []byte) uint64 {
+	if msg_type != MsgEvent && msg_type != MsgSummary {
+		return 0
+	}
+	var msg struct{ Seq uint64 }
+	if err := DecodePayload(payload, &msg); err != nil {
+		return 0
+	}
+	return msg.Seq
+}
+
+// WriteTracked writes a message carrying seq, keeping it for retransmission
+// until the server acks it.
+func (u *Upstream) WriteTracked(msg_type MsgType, payload []byte, seq uint64) error {
+	return u.writeTracked(sentFrame{seq: seq, frame: SpoolFrame{msg_type, payload}})
+}
+
+func (u *Upstream) writeTracked(sent sentFrame) error {
+	if err := u.conn.WriteRaw(sent.frame.Type, sent.frame.Payload); err != nil {
+		return err
+	}
+	if sent.seq != 0 && HasCapability(u.caps, CAP_ACK) {
+		if len(u.unacked) == 0 {
+			u.ack_progress = time.Now()
+		}
+		u.unacked = append(u.unacked, sent)
+	}
+	return nil
+}
+
+// Acked reports whether the message with seq is no longer waiting for an
+// ack, a server without acks never has it waiting.
+func (u *Upstream) Acked(seq uint64) bool {
+	for _, sent := range u.unacked {
+		if sent.seq == seq {
+			return false
+		}
+	}
+	return true
+}
+
+// HandleAck drops the window up to and including the message with seq.
+// Retransmitted and spooled messages may be out of seq order, so the window
+// is cut by position rather than by comparing numbers.
+func (u *Upstream) HandleAck(seq uint64) {
+	for idx, sent := range u.unacked {
+		if sent.seq == seq {
+			for i := 0; i <= idx; i++ {
+				u.unacked[i] = sentFrame{}
+			}
+			u.unacked = u.unacked[idx+1:]
+			u.ack_progress = time.Now()
+			return
+		}
+	}
+	u.log.Debug("ack for unknown seq", "seq", seq)
+}
+
+// ReceiveAck handles a value read from acks, a closed channel means the
+// connection is gone.
+func (u *Upstream) ReceiveAck(seq uint64, ok bool) {
+	if !ok {
+		u.log.Warn("server connection lost", "server", u.server, "unacked", len(u.unacked))
+		u.Close()
+		return
+	}
+	u.HandleAck(seq)
+	if u.spool != nil {
+		u.spool.Release(u.Acked)
+	}
+}
+
+func (u *Upstream) WindowFull() bool {
+	return len(u.unacked) >= MAX_UNACKED
+}
+
+// ackTimer returns the channel firing when the server failed to ack for
+// ACK_TIMEOUT, see CheckAckTimeout.
+func (u *Upstream) ackTimer(timer <-chan time.Time) <-chan time.Time {
+	if timer == nil && len(u.unacked) > 0 {
+		return time.After(u.ack_progress.Add(ACK_TIMEOUT).Sub(time.Now()))
+	}
+	return timer
+}
+
+// CheckAckTimeout drops a connection on which nothing was acked for
+// ACK_TIMEOUT while messages are outstanding.
+func (u *Upstream) CheckAckTimeout() {
+	if len(u.unacked) > 0 && time.Since(u.ack_progress) >= ACK_TIMEOUT {
+		u.log.Warn("server does not ack, reconnect", "server", u.server, "unacked", len(u.unacked))
+		u.Close()
+	}
+}
+
+// Retransmit writes the unacked window again after a reconnect. It returns
+// false if the connection broke.
+func (u *Upstream) Retransmit() bool {
+	if !u.resend || u.conn == nil {
+		return true
+	}
+	u.resend = false
+
+	frames := u.unacked
+	u.unacked = nil
+	if len(frames) > 0 {
+		u.log.Info("retransmitting unacked messages", "messages", len(frames))
+	}
+	for idx, sent := range frames {
+		if err := u.writeTracked(sent); err != nil {
+			u.log.Warn("retransmit failed", "err", err)
+			u.unacked = append(u.unacked, frames[idx:]...)
+			return false
+		}
+	}
+	return true
+}
+
+// WaitAcks reads acks until the window is empty or deadline has passed.
+func (u *Upstream) WaitAcks(deadline time.Time) {
+	for len(u.unacked) > 0 && u.acks != nil {
+		select {
+		case seq, ok := <-u.acks:
+			u.ReceiveAck(seq, ok)
+		case <-time.After(deadline.Sub(time.Now())):
+			return
+		}
+	}
+}
+
+// SpoolUnacked moves the window to the spool so it survives a restart.
+// Messages read from the spool are still in their segment.
+func (u *Upstream) SpoolUnacked() {
+	if len(u.unacked) == 0 {
+		return
+	}
+	if u.spool == nil {
+		u.log.Warn("no spool, unacked messages may be lost", "messages", len(u.unacked))
+		return
+	}
+	spooled := 0
+	for _, sent := range u.unacked {
+		if sent.spooled {
+			continue
+		}
+		spooled++
+		if sent.frame.Type != MsgBatch {
+			if err := u.spool.Append(sent.frame.Type, sent.frame.Payload); err != nil {
+				u.log.Error("spool message failed", "type", sent.frame.Type, "err", err)
+			}
+			continue
+		}
+
+		// the spool holds single events, the next server may not batch
+		batch := new(Batch)
+		err := DecodePayload(sent.frame.Payload, batch)
+		var clients []Client
+		if err == nil {
+			clients, err = batch.Clients()
+		}
+		if err != nil {
+			u.log.Error("unpack sent batch failed", "err", err)
+			continue
+		}
+		for idx := range clients {
+			u.SpoolMessage(MsgEvent, &clients[idx])
+		}
+	}
+	u.log.Info("unacked messages spooled for next start", "messages", spooled, "unacked", len(u.unacked))
+	u.unacked = nil
+}
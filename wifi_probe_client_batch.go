@@ -0,0 +1,139 @@
+// +build linux
+
+package main
+
+import (
+	"time"
+)
+
+// Events are collected into batches of up to batch_size, a batch is sent at
+// the latest batch_latency after its first event. Batching and compression
+// are only used if the server announced them in its HelloAck, otherwise
+// events go out one by one as before.
+
+func (u *Upstream) BatchSize() int {
+	size := int(Conf().BatchSize)
+	if size < 1 || !HasCapability(u.caps, CAP_BATCH) {
+		return 1
+	}
+	return size
+}
+
+func (u *Upstream) BatchEncoding() string {
+	encoding := Conf().Compression
+	if encoding == ENCODING_NONE || !HasCapability(u.caps, encoding) {
+		return ENCODING_NONE
+	}
+	return encoding
+}
+
+// SendEvents writes clients as one batch, or one by one if the server does
+// not take batches.
+func (u *Upstream) SendEvents(clients []*Client) error {
+	if len(clients) == 1 || u.BatchSize() == 1 {
+		for _, client := range clients {
+			payload, err := EncodePayload(client)
+			if err != nil {
+				return err
+			}
+			if err := u.WriteTracked(MsgEvent, payload, client.Seq); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	batch, err := NewBatch(clients, u.BatchEncoding())
+	if err != nil {
+		return err
+	}
+	payload, err := EncodePayload(batch)
+	if err != nil {
+		return err
+	}
+	// the server acks a batch with the seq of its last event
+	return u.WriteTracked(MsgBatch, payload, clients[len(clients)-1].Seq)
+}
+
+// FlushPending sends the events collected so far. On failure they are
+// spooled and the connection is closed.
+func (u *Upstream) FlushPending() {
+	if len(u.pending) == 0 {
+		return
+	}
+
+	if u.conn == nil {
+		for _, client := range u.pending {
+			u.SpoolMessage(MsgEvent, client)
+		}
+	} else if err := u.SendEvents(u.pending); err != nil {
+		u.log.Warn("send data to server failed", "server", u.server, "events", len(u.pending), "err", err)
+		u.Close()
+		for _, client := range u.pending {
+			u.SpoolMessage(MsgEvent, client)
+		}
+	}
+
+	for idx, client := range u.pending {
+		client_pool.Put(client)
+		u.pending[idx] = nil
+	}
+	u.pending = u.pending[:0]
+}
+
+// QueueClient adds client to the pending batch and reports whether the batch
+// is full and must be flushed now.
+func (u *Upstream) QueueClient(client *Client) bool {
+	u.pending = append(u.pending, client)
+	return len(u.pending) >= u.BatchSize()
+}
+
+// SendSpoolFrames sends frames read back from the spool, batching runs of
+// events when the server supports it. The messages are marked as spooled in
+// the unacked window.
+func (u *Upstream) SendSpoolFrames(frames []SpoolFrame) error {
+	start := len(u.unacked)
+	defer func() {
+		for idx := start; idx < len(u.unacked); idx++ {
+			u.unacked[idx].spooled = true
+		}
+	}()
+
+	var clients []*Client
+	flush := func() error {
+		if len(clients) == 0 {
+			return nil
+		}
+		err := u.SendEvents(clients)
+		clients = clients[:0]
+		return err
+	}
+
+	for _, frame := range frames {
+		if frame.Type == MsgEvent && u.BatchSize() > 1 {
+			client := new(Client)
+			if err := DecodePayload(frame.Payload, client); err != nil {
+				u.log.Warn("drop undecodable spooled event", "err", err)
+				continue
+			}
+			clients = append(clients, client)
+			continue
+		}
+
+		if err := flush(); err != nil {
+			return err
+		}
+		if err := u.WriteTracked(frame.Type, frame.Payload, frameSeq(frame.Type, frame.Payload)); err != nil {
+			return err
+		}
+	}
+	return flush()
+}
+
+// batchTimer returns the channel firing when the pending batch is due.
+func (u *Upstream) batchTimer(timer <-chan time.Time) <-chan time.Time {
+	if timer == nil && len(u.pending) > 0 {
+		return time.After(Conf().BatchLatency)
+	}
+	return timer
+}
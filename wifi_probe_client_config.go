@@ -0,0 +1,546 @@
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Config file format, one "key = value" per line, '#' starts a comment:
+//
+//	interface = mon0
+//	server = 10.0.0.1:15076
+//	mac_addr_expire = 30
+//	debug = false
+//
+// Every key can also be given as a command line flag (-mac_addr_expire 60),
+// flags override the file. SIGHUP reloads the file; interface,
+// mac_address_path, report, output, upstream_mode, the mqtt broker settings,
+// seq_file and the spool options keep their old value until a restart, as
+// does server with upstream_mode fanout.
+type Config struct {
+	Interface          string
+	Server             string
+	UpstreamMode       string
+	Debug              bool
+	LogLevel           string
+	LogOutput          string
+	LogMaxSize         int64
+	LogBackups         int64
+	EnableHTTPSniff    bool
+	EnableBeaconFrame  bool
+	EnableProbeRequest bool
+	MACAddrExpire      int64
+	MACAddressPath     string
+
+	FilterFile string
+
+	Pseudo        bool
+	PseudoKeyFile string
+	PseudoRotate  time.Duration
+	PseudoKeepOUI bool
+
+	Report          string
+	SummaryInterval time.Duration
+
+	ShutdownTimeout time.Duration
+
+	DialTimeout       time.Duration
+	ReconnectMin      time.Duration
+	ReconnectMax      time.Duration
+	WriteTimeout      time.Duration
+	HeartbeatInterval time.Duration
+	StatusFile        string
+
+	Output          string
+	MQTTBroker      string
+	MQTTClientID    string
+	MQTTUsername    string
+	MQTTPassword    string
+	MQTTTopic       string
+	MQTTStatusTopic string
+	MQTTQoS         int64
+
+	TLSCert       string
+	TLSKey        string
+	TLSCA         string
+	TLSServerName string
+
+	BatchSize    int64
+	BatchLatency time.Duration
+	Compression  string
+
+	SpoolDir         string
+	SpoolMaxSize     int64
+	SpoolSegmentSize int64
+
+	SeqFile string
+}
+
+type configOption struct {
+	name  string
+	def   string
+	usage string
+	set   func(c *Config, value string) error
+}
+
+func setString(p func(c *Config) *string) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		*p(c) = value
+		return nil
+	}
+}
+
+func setBool(p func(c *Config) *bool) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean", value)
+		}
+		*p(c) = b
+		return nil
+	}
+}
+
+func setInt(p func(c *Config) *int64) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", value)
+		}
+		*p(c) = n
+		return nil
+	}
+}
+
+func setDuration(p func(c *Config) *time.Duration) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a duration", value)
+		}
+		*p(c) = d
+		return nil
+	}
+}
+
+var config_options = []*configOption{
+	{"interface", "", "network interface name to monitor",
+		setString(func(c *Config) *string { return &c.Interface })},
+	{"server", "", "probe server address host:port, or a comma separated list",
+		setString(func(c *Config) *string { return &c.Server })},
+	{"upstream_mode", UPSTREAM_FAILOVER, "with several servers use the first reachable (\"failover\") or send to all (\"fanout\")",
+		setString(func(c *Config) *string { return &c.UpstreamMode })},
+	{"debug", "false", "log every probe and join/leave, same as log_level debug",
+		setBool(func(c *Config) *bool { return &c.Debug })},
+	{"log_level", "info", "log level: debug, info, warn or error",
+		setString(func(c *Config) *string { return &c.LogLevel })},
+	{"log_output", "stdout", "log to stdout, stderr, syslog or a file path",
+		setString(func(c *Config) *string { return &c.LogOutput })},
+	{"log_max_size", "262144", "rotate log file at this many bytes",
+		setInt(func(c *Config) *int64 { return &c.LogMaxSize })},
+	{"log_backups", "2", "rotated log files to keep",
+		setInt(func(c *Config) *int64 { return &c.LogBackups })},
+	{"enable_http_sniff", "true", "detect device models from plain HTTP User-Agents",
+		setBool(func(c *Config) *bool { return &c.EnableHTTPSniff })},
+	{"enable_beacon_frame", "false", "print beacon frames",
+		setBool(func(c *Config) *bool { return &c.EnableBeaconFrame })},
+	{"enable_probe_request", "true", "track devices sending probe requests",
+		setBool(func(c *Config) *bool { return &c.EnableProbeRequest })},
+	{"mac_addr_expire", "30", "seconds without frames before a device has left",
+		setInt(func(c *Config) *int64 { return &c.MACAddrExpire })},
+	{"mac_address_path", "/sys/devices/platform/ar933x_wmac/net/wlan0/phy80211/macaddress",
+		"file holding the MAC used as node id",
+		setString(func(c *Config) *string { return &c.MACAddressPath })},
+	{"filter_file", "", "MAC ignore/watch list file, reloaded on change",
+		setString(func(c *Config) *string { return &c.FilterFile })},
+	{"pseudo", "false", "replace station MACs with rotating keyed hashes",
+		setBool(func(c *Config) *bool { return &c.Pseudo })},
+	{"pseudo_key", "", "pseudonym key file, implies pseudo",
+		setString(func(c *Config) *string { return &c.PseudoKeyFile })},
+	{"pseudo_rotate", "24h", "pseudonym salt rotation period",
+		setDuration(func(c *Config) *time.Duration { return &c.PseudoRotate })},
+	{"pseudo_keep_oui", "false", "keep the vendor OUI of pseudonymized MACs in clear",
+		setBool(func(c *Config) *bool { return &c.PseudoKeepOUI })},
+	{"report", REPORT_EVENTS, "report \"events\" or periodic \"summary\" aggregates",
+		setString(func(c *Config) *string { return &c.Report })},
+	{"summary_interval", "1m", "aggregation interval of report summary",
+		setDuration(func(c *Config) *time.Duration { return &c.SummaryInterval })},
+	{"shutdown_timeout", "5s", "time to flush queued events on SIGTERM",
+		setDuration(func(c *Config) *time.Duration { return &c.ShutdownTimeout })},
+	{"dial_timeout", "3s", "time to wait for the server to accept a connection",
+		setDuration(func(c *Config) *time.Duration { return &c.DialTimeout })},
+	{"reconnect_min", "1s", "first delay before reconnecting to the server",
+		setDuration(func(c *Config) *time.Duration { return &c.ReconnectMin })},
+	{"reconnect_max", "1m", "longest delay between reconnects, the delay doubles up to it",
+		setDuration(func(c *Config) *time.Duration { return &c.ReconnectMax })},
+	{"write_timeout", "10s", "drop the connection if a write blocks this long",
+		setDuration(func(c *Config) *time.Duration { return &c.WriteTimeout })},
+	{"heartbeat_interval", "15s", "ping the server this often, 0 disables",
+		setDuration(func(c *Config) *time.Duration { return &c.HeartbeatInterval })},
+	{"status_file", "", "write connection state and uptime here as JSON, disabled if empty",
+		setString(func(c *Config) *string { return &c.StatusFile })},
+	{"output", OUTPUT_TCP, "send to wifi_probe_server (\"tcp\") or an MQTT broker (\"mqtt\")",
+		setString(func(c *Config) *string { return &c.Output })},
+	{"mqtt_broker", "tcp://127.0.0.1:1883", "MQTT broker URL, tcp:// or ssl://",
+		setString(func(c *Config) *string { return &c.MQTTBroker })},
+	{"mqtt_client_id", "", "MQTT client id, derived from the node id if empty",
+		setString(func(c *Config) *string { return &c.MQTTClientID })},
+	{"mqtt_username", "", "MQTT user name",
+		setString(func(c *Config) *string { return &c.MQTTUsername })},
+	{"mqtt_password", "", "MQTT password",
+		setString(func(c *Config) *string { return &c.MQTTPassword })},
+	{"mqtt_topic", "wifi_probe/{node}/{event}", "MQTT topic template of events, {node} and {event} are replaced",
+		setString(func(c *Config) *string { return &c.MQTTTopic })},
+	{"mqtt_status_topic", "wifi_probe/{node}/status", "retained MQTT topic of the online/offline status",
+		setString(func(c *Config) *string { return &c.MQTTStatusTopic })},
+	{"mqtt_qos", "1", "MQTT QoS of published messages, 0, 1 or 2",
+		setInt(func(c *Config) *int64 { return &c.MQTTQoS })},
+	{"tls_cert", "", "node certificate file (PEM), enables TLS",
+		setString(func(c *Config) *string { return &c.TLSCert })},
+	{"tls_key", "", "private key file of tls_cert (PEM)",
+		setString(func(c *Config) *string { return &c.TLSKey })},
+	{"tls_ca", "", "CA bundle to verify the server with, system roots if empty",
+		setString(func(c *Config) *string { return &c.TLSCA })},
+	{"tls_server_name", "", "expected server certificate name, host of server if empty",
+		setString(func(c *Config) *string { return &c.TLSServerName })},
+	{"batch_size", "1", "send up to this many events in one message",
+		setInt(func(c *Config) *int64 { return &c.BatchSize })},
+	{"batch_latency", "2s", "send a batch at the latest this long after its first event",
+		setDuration(func(c *Config) *time.Duration { return &c.BatchLatency })},
+	{"compression", ENCODING_NONE, "batch compression: none, gzip or zstd",
+		setString(func(c *Config) *string { return &c.Compression })},
+	{"spool_dir", "", "keep events here while the server is unreachable",
+		setString(func(c *Config) *string { return &c.SpoolDir })},
+	{"spool_max_size", "1048576", "spool size limit in bytes, oldest events are dropped beyond",
+		setInt(func(c *Config) *int64 { return &c.SpoolMaxSize })},
+	{"spool_segment_size", "65536", "spool file size in bytes",
+		setInt(func(c *Config) *int64 { return &c.SpoolSegmentSize })},
+	{"seq_file", "", "sequence number state file, <spool_dir>/sequence if empty",
+		setString(func(c *Config) *string { return &c.SeqFile })},
+}
+
+var config_aliases = map[string]string{
+	"i": "interface",
+	"s": "server",
+	"f": "filter_file",
+}
+
+var (
+	config_file    string
+	config_flags   map[string]string
+	current_config atomic.Value
+)
+
+// flagOverride records a config option given on the command line.
+type flagOverride struct {
+	option *configOption
+}
+
+func (f *flagOverride) String() string {
+	if f.option == nil {
+		return ""
+	}
+	return f.option.def
+}
+
+func (f *flagOverride) Set(value string) error {
+	probe := new(Config)
+	if err := f.option.set(probe, value); err != nil {
+		return err
+	}
+	config_flags[f.option.name] = value
+	return nil
+}
+
+func (f *flagOverride) IsBoolFlag() bool {
+	return f.option.def == "true" || f.option.def == "false"
+}
+
+func init() {
+	config_flags = make(map[string]string)
+
+	flag.StringVar(&config_file, "c", "", "config file")
+	for _, option := range config_options {
+		flag.Var(&flagOverride{option}, option.name, option.usage)
+	}
+	for alias, name := range config_aliases {
+		option := findConfigOption(name)
+		flag.Var(&flagOverride{option}, alias, option.usage)
+	}
+}
+
+func findConfigOption(name string) *configOption {
+	for _, option := range config_options {
+		if option.name == name {
+			return option
+		}
+	}
+	return nil
+}
+
+// Conf returns the configuration in effect. The returned value must not be
+// modified, a reload replaces it as a whole.
+func Conf() *Config {
+	return current_config.Load().(*Config)
+}
+
+func (c *Config) Set(name, value string) error {
+	option := findConfigOption(name)
+	if option == nil {
+		return fmt.Errorf("unknown option %q", name)
+	}
+	if err := option.set(c, value); err != nil {
+		return fmt.Errorf("%s: %s", name, err)
+	}
+	return nil
+}
+
+func (c *Config) Validate() error {
+	if c.Interface == "" {
+		return fmt.Errorf("need network interface name")
+	}
+	switch c.Output {
+	case OUTPUT_TCP:
+		servers := c.ServerList()
+		if len(servers) == 0 {
+			return fmt.Errorf("need server address")
+		}
+		seen := make(map[string]bool, len(servers))
+		for _, server := range servers {
+			if seen[server] {
+				return fmt.Errorf("server %s is listed twice", server)
+			}
+			seen[server] = true
+		}
+		if c.UpstreamMode != UPSTREAM_FAILOVER && c.UpstreamMode != UPSTREAM_FANOUT {
+			return fmt.Errorf("unknown upstream mode %q", c.UpstreamMode)
+		}
+	case OUTPUT_MQTT:
+		if c.MQTTBroker == "" {
+			return fmt.Errorf("need mqtt broker")
+		}
+		if err := ValidateMQTTTopic(c.MQTTTopic); err != nil {
+			return err
+		}
+		if err := ValidateMQTTTopic(c.MQTTStatusTopic); err != nil {
+			return err
+		}
+		if c.MQTTQoS < 0 || c.MQTTQoS > 2 {
+			return fmt.Errorf("mqtt_qos must be 0, 1 or 2")
+		}
+	default:
+		return fmt.Errorf("unknown output %q", c.Output)
+	}
+	if _, err := ParseLevel(c.LogLevel); err != nil {
+		return err
+	}
+	if c.LogBackups < 0 {
+		return fmt.Errorf("log_backups must not be negative")
+	}
+	if c.MACAddrExpire <= 0 {
+		return fmt.Errorf("mac_addr_expire must be positive")
+	}
+	if c.PseudoKeyFile != "" {
+		c.Pseudo = true
+	}
+	if c.Pseudo && c.PseudoRotate < time.Minute {
+		return fmt.Errorf("pseudonym rotation period must be at least one minute")
+	}
+	if c.DialTimeout <= 0 || c.WriteTimeout <= 0 {
+		return fmt.Errorf("dial_timeout and write_timeout must be positive")
+	}
+	if c.ReconnectMin <= 0 || c.ReconnectMax < c.ReconnectMin {
+		return fmt.Errorf("reconnect_min must be positive and not above reconnect_max")
+	}
+	if c.HeartbeatInterval < 0 || (c.HeartbeatInterval > 0 && c.HeartbeatInterval < time.Second) {
+		return fmt.Errorf("heartbeat_interval must be 0 or at least one second")
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return fmt.Errorf("tls_cert and tls_key must be given together")
+	}
+	if c.BatchSize < 1 || c.BatchSize > 4096 {
+		return fmt.Errorf("batch_size must be between 1 and 4096")
+	}
+	if c.BatchLatency <= 0 {
+		return fmt.Errorf("batch_latency must be positive")
+	}
+	switch c.Compression {
+	case ENCODING_NONE, ENCODING_GZIP, ENCODING_ZSTD:
+	default:
+		return fmt.Errorf("unknown compression %q", c.Compression)
+	}
+	if c.SpoolDir != "" && (c.SpoolSegmentSize <= 0 || c.SpoolMaxSize < c.SpoolSegmentSize) {
+		return fmt.Errorf("spool_max_size must be at least spool_segment_size")
+	}
+	if c.Report != REPORT_EVENTS && c.Report != REPORT_SUMMARY {
+		return fmt.Errorf("unknown report mode: %s", c.Report)
+	}
+	if c.Report == REPORT_SUMMARY && c.SummaryInterval < time.Second {
+		return fmt.Errorf("summary interval is too short")
+	}
+	return nil
+}
+
+// ServerList returns the servers of the server option in order of preference.
+func (c *Config) ServerList() []string {
+	var servers []string
+	for _, server := range strings.Split(c.Server, ",") {
+		if server = strings.TrimSpace(server); server != "" {
+			servers = append(servers, server)
+		}
+	}
+	return servers
+}
+
+func LoadConfigFile(c *Config, filename string) error {
+	fp, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	scanner := bufio.NewScanner(fp)
+	line_no := 0
+	for scanner.Scan() {
+		line_no++
+		line := scanner.Text()
+		if idx := strings.Index(line, "#"); idx >= 0 {
+			line = line[:idx]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		idx := strings.Index(line, "=")
+		if idx < 0 {
+			return fmt.Errorf("%s:%d: expected \"key = value\"", filename, line_no)
+		}
+		key := strings.TrimSpace(line[:idx])
+		value := strings.Trim(strings.TrimSpace(line[idx+1:]), "\"")
+		if err := c.Set(key, value); err != nil {
+			return fmt.Errorf("%s:%d: %s", filename, line_no, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// BuildConfig applies defaults, then the config file, then command line flags.
+func BuildConfig() (*Config, error) {
+	c := new(Config)
+	for _, option := range config_options {
+		if err := option.set(c, option.def); err != nil {
+			return nil, err
+		}
+	}
+
+	if config_file != "" {
+		if err := LoadConfigFile(c, config_file); err != nil {
+			return nil, err
+		}
+	}
+
+	for name, value := range config_flags {
+		if err := c.Set(name, value); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func ApplyLogConfig(c *Config) error {
+	level := c.LogLevel
+	if c.Debug {
+		level = "debug"
+	}
+	return Log.Configure(level, c.LogOutput, c.LogMaxSize, int(c.LogBackups))
+}
+
+func ReloadConfig() {
+	c, err := BuildConfig()
+	if err != nil {
+		Log.Error("reload config failed, keeping old one", "err", err)
+		return
+	}
+
+	old := Conf()
+	if c.Interface != old.Interface {
+		Log.Warn("interface change needs a restart")
+		c.Interface = old.Interface
+	}
+	if c.MACAddressPath != old.MACAddressPath {
+		Log.Warn("mac_address_path change needs a restart")
+		c.MACAddressPath = old.MACAddressPath
+	}
+	if c.Report != old.Report {
+		Log.Warn("report mode change needs a restart")
+		c.Report = old.Report
+	}
+	if c.SpoolDir != old.SpoolDir || c.SpoolMaxSize != old.SpoolMaxSize ||
+		c.SpoolSegmentSize != old.SpoolSegmentSize {
+		Log.Warn("spool change needs a restart")
+		c.SpoolDir = old.SpoolDir
+		c.SpoolMaxSize = old.SpoolMaxSize
+		c.SpoolSegmentSize = old.SpoolSegmentSize
+	}
+	if c.Output != old.Output || c.MQTTBroker != old.MQTTBroker || c.MQTTClientID != old.MQTTClientID ||
+		c.MQTTUsername != old.MQTTUsername || c.MQTTPassword != old.MQTTPassword ||
+		c.MQTTStatusTopic != old.MQTTStatusTopic {
+		Log.Warn("output or mqtt broker change needs a restart")
+		c.Output = old.Output
+		c.MQTTBroker = old.MQTTBroker
+		c.MQTTClientID = old.MQTTClientID
+		c.MQTTUsername = old.MQTTUsername
+		c.MQTTPassword = old.MQTTPassword
+		c.MQTTStatusTopic = old.MQTTStatusTopic
+	}
+	if c.SeqFile != old.SeqFile {
+		Log.Warn("seq_file change needs a restart")
+		c.SeqFile = old.SeqFile
+	}
+	if c.StatusFile != old.StatusFile {
+		Log.Warn("status_file change needs a restart")
+		c.StatusFile = old.StatusFile
+	}
+	if c.UpstreamMode != old.UpstreamMode {
+		Log.Warn("upstream_mode change needs a restart")
+		c.UpstreamMode = old.UpstreamMode
+	}
+	if c.Server != old.Server && old.UpstreamMode == UPSTREAM_FANOUT && len(old.ServerList()) > 1 {
+		Log.Warn("server change with upstream_mode fanout needs a restart")
+		c.Server = old.Server
+	} else if c.Server != old.Server {
+		Log.Info("server changed, used on next reconnect", "server", c.Server)
+	}
+
+	if err := ApplyLogConfig(c); err != nil {
+		Log.Error("apply log config failed", "err", err)
+	}
+
+	current_config.Store(c)
+	Log.Info("config reloaded")
+
+	ReloadMacFilter()
+}
+
+func WatchConfigSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		ReloadConfig()
+	}
+}
@@ -0,0 +1,279 @@
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MAC filter file format, one rule per line:
+//
+//	# staff phones
+//	ignore 00:1b:63:84:45:e6
+//	ignore 00:1b:63             (OUI prefix)
+//	ignore 02:00:00:00:00:00/02:00:00:00:00:00   (mask, e.g. locally administered)
+//	ignore 00:1b:63:84:00:00/32 (prefix length in bits)
+//	watch  a4:5e:60
+//
+// A MAC matching any "ignore" rule is dropped. When at least one "watch" rule
+// exists, only MACs matching a watch rule are tracked.
+const (
+	FILTER_CHECK_INTERVAL = 5
+)
+
+type macRule struct {
+	addr [6]byte
+	mask [6]byte
+}
+
+func (r *macRule) Match(mac []byte) bool {
+	for i := 0; i < 6; i++ {
+		if mac[i]&r.mask[i] != r.addr[i] {
+			return false
+		}
+	}
+	return true
+}
+
+type MacFilter struct {
+	ignore []macRule
+	watch  []macRule
+}
+
+func (f *MacFilter) Allowed(mac []byte) bool {
+	if f == nil || len(mac) < 6 {
+		return true
+	}
+
+	for idx := range f.ignore {
+		if f.ignore[idx].Match(mac) {
+			return false
+		}
+	}
+
+	if len(f.watch) == 0 {
+		return true
+	}
+
+	for idx := range f.watch {
+		if f.watch[idx].Match(mac) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	mac_filter      *MacFilter
+	mac_filter_file string
+	mac_filter_mod  time.Time
+	filter_lock     *sync.RWMutex
+
+	// serializes ReloadMacFilter, the only writer of the filter, which
+	// runs at start, on SIGHUP and from WatchMacFilter
+	reload_lock *sync.Mutex
+)
+
+func init() {
+	filter_lock = new(sync.RWMutex)
+	reload_lock = new(sync.Mutex)
+}
+
+// MACAllowed reports whether frames from mac should be tracked at all.
+func MACAllowed(mac []byte) bool {
+	filter_lock.RLock()
+	defer filter_lock.RUnlock()
+
+	return mac_filter.Allowed(mac)
+}
+
+// parseMACBytes accepts both zero padded and unpadded octets ("0:1b:63"),
+// the latter being how this program formats MAC strings.
+func parseMACBytes(s string) ([]byte, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) == 1 {
+		parts = strings.Split(s, "-")
+	}
+	if len(parts) > 6 {
+		return nil, fmt.Errorf("too many octets in %q", s)
+	}
+
+	ret := make([]byte, 0, 6)
+	for _, part := range parts {
+		b, err := strconv.ParseUint(part, 16, 8)
+		if err != nil {
+			return nil, fmt.Errorf("bad octet %q in %q", part, s)
+		}
+		ret = append(ret, byte(b))
+	}
+	return ret, nil
+}
+
+func parseMacRule(s string) (rule macRule, err error) {
+	addr_str := s
+	mask_str := ""
+	if idx := strings.Index(s, "/"); idx >= 0 {
+		addr_str = s[:idx]
+		mask_str = s[idx+1:]
+	}
+
+	addr, err := parseMACBytes(addr_str)
+	if err != nil {
+		return
+	}
+
+	switch {
+	case mask_str == "":
+		// exact MAC or OUI/prefix: mask covers the octets given
+		for i := range addr {
+			rule.mask[i] = 0xff
+		}
+	case strings.Contains(mask_str, ":") || strings.Contains(mask_str, "-"):
+		var mask []byte
+		mask, err = parseMACBytes(mask_str)
+		if err != nil {
+			return
+		}
+		if len(mask) != 6 {
+			err = fmt.Errorf("mask %q must have 6 octets", mask_str)
+			return
+		}
+		copy(rule.mask[:], mask)
+	default:
+		var bits int
+		bits, err = strconv.Atoi(mask_str)
+		if err != nil || bits < 0 || bits > 48 {
+			err = fmt.Errorf("bad prefix length %q", mask_str)
+			return
+		}
+		for i := 0; i < bits; i++ {
+			rule.mask[i/8] |= 0x80 >> uint(i%8)
+		}
+	}
+
+	copy(rule.addr[:], addr)
+	for i := 0; i < 6; i++ {
+		rule.addr[i] &= rule.mask[i]
+	}
+	return
+}
+
+func LoadMacFilter(filename string) (*MacFilter, error) {
+	fp, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	filter := new(MacFilter)
+	scanner := bufio.NewScanner(fp)
+	line_no := 0
+	for scanner.Scan() {
+		line_no++
+		line := scanner.Text()
+		if idx := strings.Index(line, "#"); idx >= 0 {
+			line = line[:idx]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"ignore|watch <mac>\"", filename, line_no)
+		}
+
+		rule, err := parseMacRule(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", filename, line_no, err)
+		}
+
+		switch fields[0] {
+		case "ignore", "deny":
+			filter.ignore = append(filter.ignore, rule)
+		case "watch", "allow":
+			filter.watch = append(filter.watch, rule)
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown list %q", filename, line_no, fields[0])
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+// ReloadMacFilter loads the filter file if it changed since the last load.
+// A broken file keeps the previous filter in place.
+func ReloadMacFilter() {
+	reload_lock.Lock()
+	defer reload_lock.Unlock()
+
+	filter_file := Conf().FilterFile
+	if filter_file == "" {
+		if mac_filter != nil {
+			filter_lock.Lock()
+			mac_filter = nil
+			mac_filter_file = ""
+			filter_lock.Unlock()
+			Log.Info("mac filter disabled")
+		}
+		return
+	}
+
+	info, err := os.Stat(filter_file)
+	if err != nil {
+		Log.Warn("stat mac filter file failed", "err", err)
+		return
+	}
+	if filter_file == mac_filter_file && info.ModTime().Equal(mac_filter_mod) {
+		return
+	}
+
+	filter, err := LoadMacFilter(filter_file)
+	if err != nil {
+		Log.Error("load mac filter failed", "err", err)
+		return
+	}
+
+	filter_lock.Lock()
+	mac_filter = filter
+	mac_filter_file = filter_file
+	mac_filter_mod = info.ModTime()
+	filter_lock.Unlock()
+
+	Log.Info("mac filter loaded", "file", filter_file, "ignore", len(filter.ignore), "watch", len(filter.watch))
+
+	PurgeFilteredMAC()
+}
+
+// PurgeFilteredMAC drops devices from mac_map which the current filter no
+// longer allows, sending a leave so the server does not keep them present.
+func PurgeFilteredMAC() {
+	map_lock.Lock()
+	defer map_lock.Unlock()
+
+	for mac_str, mac_client := range mac_map {
+		mac, err := parseMACBytes(mac_str)
+		if err != nil {
+			continue
+		}
+		if !MACAllowed(mac) {
+			delete(mac_map, mac_str)
+			ReportEvent(NewClient(mac_client, "leave", 0, "", 2))
+		}
+	}
+}
+
+func WatchMacFilter() {
+	for {
+		ReloadMacFilter()
+		time.Sleep(FILTER_CHECK_INTERVAL * time.Second)
+	}
+}
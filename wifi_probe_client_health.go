@@ -0,0 +1,279 @@
+// +build linux
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Reconnects back off exponentially from reconnect_min to reconnect_max,
+// each delay randomized between half and all of it so nodes losing the
+// server together do not come back in lockstep.
+//
+// Servers with the ping capability get a Ping every heartbeat_interval. If
+// nothing, neither pong nor ack, arrived for HEARTBEAT_MISSES intervals the
+// connection is taken as dead, which catches half-open connections TCP
+// keepalive takes minutes to notice.
+//
+// With status_file set the state of every upstream is written there as JSON
+// every STATUS_INTERVAL and on shutdown.
+const (
+	HEARTBEAT_MISSES = 3
+	STATUS_INTERVAL  = 10 * time.Second
+
+	STATE_CONNECTING   = "connecting"
+	STATE_CONNECTED    = "connected"
+	STATE_DISCONNECTED = "disconnected"
+	STATE_STOPPED      = "stopped"
+)
+
+var (
+	start_time time.Time
+)
+
+func init() {
+	start_time = time.Now()
+	rand.Seed(time.Now().UnixNano())
+}
+
+type UpstreamStatus struct {
+	Name      string  `json:"name,omitempty"`
+	Server    string  `json:"server,omitempty"`
+	State     string  `json:"state"`
+	Since     int64   `json:"since"`    // unix time of the last state change
+	Connects  int     `json:"connects"` // successful connects since start
+	Failures  int     `json:"failures"` // failed connects since the last success
+	LastError string  `json:"last_error,omitempty"`
+	RTT       float64 `json:"rtt_ms"`
+	Unacked   int     `json:"unacked"`
+	Spooled   int     `json:"spooled"`
+	Dropped   int     `json:"dropped"`
+}
+
+type NodeStatus struct {
+	NodeID    string            `json:"node_id"`
+	Firmware  string            `json:"firmware"`
+	Started   int64             `json:"started"`
+	Uptime    int64             `json:"uptime"` // seconds
+	Output    string            `json:"output"`
+	Upstreams []*UpstreamStatus `json:"upstreams"`
+}
+
+// SetState records a connection state change of the upstream.
+func (u *Upstream) SetState(state, server string, err error) {
+	u.status_lock.Lock()
+	defer u.status_lock.Unlock()
+
+	status := &u.status
+	if state != status.State || server != status.Server {
+		status.Since = time.Now().Unix()
+	}
+	status.State = state
+	status.Server = server
+	switch {
+	case state == STATE_CONNECTED:
+		status.Connects++
+		status.Failures = 0
+		status.LastError = ""
+	case err != nil:
+		status.Failures++
+		status.LastError = err.Error()
+	}
+}
+
+func (u *Upstream) Stopped() {
+	u.UpdateStatus()
+	u.SetState(STATE_STOPPED, "", nil)
+}
+
+// UpdateStatus copies the counters only the upstream goroutine may read.
+func (u *Upstream) UpdateStatus() {
+	spooled := 0
+	if u.spool != nil {
+		spooled = u.spool.Len()
+	}
+
+	u.status_lock.Lock()
+	u.status.Unacked = len(u.unacked)
+	u.status.Spooled = spooled
+	u.status.RTT = float64(atomic.LoadInt64(&u.rtt)) / float64(time.Millisecond)
+	u.status_lock.Unlock()
+}
+
+func (u *Upstream) Status() *UpstreamStatus {
+	u.status_lock.Lock()
+	status := u.status
+	u.status_lock.Unlock()
+
+	u.lost_lock.Lock()
+	status.Dropped = u.lost.Dropped
+	u.lost_lock.Unlock()
+
+	status.Name = u.name
+	return &status
+}
+
+// RetryDelay returns the time to wait before the next connect and doubles
+// the backoff.
+func (u *Upstream) RetryDelay() time.Duration {
+	conf := Conf()
+	if u.backoff < conf.ReconnectMin {
+		u.backoff = conf.ReconnectMin
+	} else {
+		u.backoff *= 2
+	}
+	if u.backoff > conf.ReconnectMax {
+		u.backoff = conf.ReconnectMax
+	}
+
+	half := int64(u.backoff / 2)
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+// ReadServer passes the acks of one connection to acks, which is closed once
+// the connection fails. Acks are cumulative, so a newer ack replaces one the
+// sender has not taken yet; the last ack is never lost. Every message read
+// counts as a sign of life, pongs update the round trip time.
+func (u *Upstream) ReadServer(proto *ProtoConn, acks chan uint64) {
+	defer close(acks)
+	for {
+		msg_type, payload, err := proto.ReadMessage()
+		if err != nil {
+			return
+		}
+		atomic.StoreInt64(&u.last_read, time.Now().UnixNano())
+
+		switch msg_type {
+		case MsgAck:
+			ack := new(Ack)
+			if err := DecodePayload(payload, ack); err != nil {
+				u.log.Warn("decode ack failed", "err", err)
+				continue
+			}
+			putAck(acks, ack.Seq)
+		case MsgPong:
+			pong := new(Ping)
+			if err := DecodePayload(payload, pong); err != nil {
+				u.log.Warn("decode pong failed", "err", err)
+				continue
+			}
+			atomic.StoreInt64(&u.rtt, time.Now().UnixNano()-pong.Time)
+		}
+	}
+}
+
+// putAck puts seq into the one slot channel acks, replacing the ack waiting
+// there. ReadServer is its only sender.
+func putAck(acks chan uint64, seq uint64) {
+	for {
+		select {
+		case acks <- seq:
+			return
+		default:
+		}
+		select {
+		case <-acks:
+		default:
+		}
+	}
+}
+
+// heartbeatTimer returns the channel firing when the next Ping is due.
+func (u *Upstream) heartbeatTimer(timer <-chan time.Time) <-chan time.Time {
+	interval := Conf().HeartbeatInterval
+	if u.conn == nil || interval <= 0 {
+		return nil
+	}
+	if timer == nil {
+		return time.After(interval)
+	}
+	return timer
+}
+
+// Heartbeat closes a connection the server stopped answering on, otherwise
+// it sends a Ping.
+func (u *Upstream) Heartbeat() {
+	u.UpdateStatus()
+	if u.conn == nil || !HasCapability(u.caps, CAP_PING) {
+		return
+	}
+
+	interval := Conf().HeartbeatInterval
+	silent := time.Since(time.Unix(0, atomic.LoadInt64(&u.last_read)))
+	if silent > HEARTBEAT_MISSES*interval {
+		u.log.Warn("server does not answer, reconnect", "server", u.server, "silent", silent.Round(time.Second))
+		u.Close()
+		return
+	}
+
+	if err := u.conn.WriteMessage(MsgPing, &Ping{Time: time.Now().UnixNano()}); err != nil {
+		u.log.Warn("send heartbeat failed", "server", u.server, "err", err)
+		u.Close()
+	}
+}
+
+func CollectStatus() *NodeStatus {
+	conf := Conf()
+	now := time.Now()
+	status := &NodeStatus{
+		NodeID:   NODE_ID,
+		Firmware: firmware_version,
+		Started:  start_time.Unix(),
+		Uptime:   int64(now.Sub(start_time) / time.Second),
+		Output:   conf.Output,
+	}
+
+	if conf.Output == OUTPUT_MQTT {
+		state := STATE_DISCONNECTED
+		if atomic.LoadInt32(&mqtt_connected) != 0 {
+			state = STATE_CONNECTED
+		}
+		status.Upstreams = append(status.Upstreams, &UpstreamStatus{Server: conf.MQTTBroker, State: state})
+		return status
+	}
+
+	for _, u := range upstreams {
+		status.Upstreams = append(status.Upstreams, u.Status())
+	}
+	return status
+}
+
+func WriteStatus(filename string) error {
+	data, err := json.MarshalIndent(CollectStatus(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// WatchStatus writes the status file until sender_done, and a last time
+// after it.
+func WatchStatus() {
+	filename := Conf().StatusFile
+	if filename == "" {
+		return
+	}
+
+	ticker := time.NewTicker(STATUS_INTERVAL)
+	defer ticker.Stop()
+	for {
+		if err := WriteStatus(filename); err != nil {
+			Log.Warn("write status file failed", "file", filename, "err", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-sender_done:
+			WriteStatus(filename)
+			return
+		}
+	}
+}
@@ -0,0 +1,299 @@
+// +build linux
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// With output mqtt events and summaries are published as JSON to an MQTT
+// 3.1.1 broker instead of being sent to wifi_probe_server. Topics are built
+// from mqtt_topic, {node} is replaced by the node id and {event} by join,
+// leave, summary or loss:
+//
+//	wifi_probe/00:1b:63:84:45:e6/join {"seq":17,"node_id":"00:1b:63:84:45:e6","addr":"...","action":1,"time":1433160000}
+//
+// mqtt_status_topic carries a retained "online" while connected; the broker
+// publishes the retained last will "offline" if the node disappears.
+// Messages which can not be published while the broker is unreachable go to
+// the spool like with output tcp.
+//
+// To try it against a local broker:
+//
+//	mosquitto -v &
+//	mosquitto_sub -t 'wifi_probe/#' -v &
+//	wifi_probe_client -i mon0 -output mqtt -mqtt_broker tcp://127.0.0.1:1883
+//
+// The tests of wifi_probe_client_mqtt_test.go publish to it with
+//
+//	WIFI_PROBE_MQTT_BROKER=tcp://127.0.0.1:1883 make test
+const (
+	OUTPUT_TCP  = "tcp"
+	OUTPUT_MQTT = "mqtt"
+
+	MQTT_PUBLISH_TIMEOUT = 10 * time.Second
+)
+
+var (
+	mqtt_client    mqtt.Client
+	mqtt_online    chan struct{}
+	mqtt_spool     *Spool
+	mqtt_connected int32 // for the status file
+)
+
+func init() {
+	mqtt_online = make(chan struct{}, 1)
+}
+
+func MQTTTopic(template, event string) string {
+	return strings.NewReplacer("{node}", NODE_ID, "{event}", event).Replace(template)
+}
+
+func ValidateMQTTTopic(template string) error {
+	if template == "" || strings.ContainsAny(template, "+#") {
+		return fmt.Errorf("mqtt topic %q must not be empty or contain wildcards", template)
+	}
+	return nil
+}
+
+func eventName(action int) string {
+	if action == 2 {
+		return "leave"
+	}
+	return "join"
+}
+
+func NewMQTTClient(conf *Config) (mqtt.Client, error) {
+	status_topic := MQTTTopic(conf.MQTTStatusTopic, "status")
+	qos := byte(conf.MQTTQoS)
+
+	client_id := conf.MQTTClientID
+	if client_id == "" {
+		client_id = "wifi_probe_" + strings.Replace(NODE_ID, ":", "", -1)
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(conf.MQTTBroker).
+		SetClientID(client_id).
+		SetUsername(conf.MQTTUsername).
+		SetPassword(conf.MQTTPassword).
+		SetProtocolVersion(4).
+		SetCleanSession(true).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(time.Second).
+		SetMaxReconnectInterval(time.Minute).
+		SetKeepAlive(30*time.Second).
+		SetWill(status_topic, "offline", qos, true)
+
+	broker, err := url.Parse(conf.MQTTBroker)
+	if err != nil {
+		return nil, err
+	}
+	if broker.Scheme == "ssl" || broker.Scheme == "tls" || broker.Scheme == "mqtts" {
+		tls_config, err := ClientTLSConfig(conf, broker.Host)
+		if err != nil {
+			return nil, err
+		}
+		opts.SetTLSConfig(tls_config)
+	}
+
+	opts.SetOnConnectHandler(func(client mqtt.Client) {
+		Log.Info("connected to mqtt broker", "broker", conf.MQTTBroker)
+		atomic.StoreInt32(&mqtt_connected, 1)
+		client.Publish(status_topic, qos, true, "online")
+		select {
+		case mqtt_online <- struct{}{}:
+		default:
+		}
+	})
+	opts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
+		atomic.StoreInt32(&mqtt_connected, 0)
+		Log.Warn("mqtt connection lost", "broker", conf.MQTTBroker, "err", err)
+	})
+
+	return mqtt.NewClient(opts), nil
+}
+
+// PublishMQTT publishes v as JSON on the topic of event.
+func PublishMQTT(event string, v interface{}) error {
+	if !mqtt_client.IsConnectionOpen() {
+		return fmt.Errorf("not connected to broker")
+	}
+
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	conf := Conf()
+	token := mqtt_client.Publish(MQTTTopic(conf.MQTTTopic, event), byte(conf.MQTTQoS), false, payload)
+	if !token.WaitTimeout(MQTT_PUBLISH_TIMEOUT) {
+		return fmt.Errorf("publish timed out")
+	}
+	return token.Error()
+}
+
+type mqttEvent struct {
+	*Client
+	Time int64 `json:"time"`
+}
+
+type mqttSummary struct {
+	*Summary
+	Time int64 `json:"time"`
+}
+
+// mqttTime is the capture time, now for messages spooled by older versions.
+func mqttTime(captured int64) int64 {
+	if captured == 0 {
+		return time.Now().Unix()
+	}
+	return captured
+}
+
+func PublishClient(client *Client) error {
+	return PublishMQTT(eventName(client.Action), &mqttEvent{client, mqttTime(client.Time)})
+}
+
+func PublishSummary(summary *Summary) error {
+	return PublishMQTT("summary", &mqttSummary{summary, mqttTime(summary.Time)})
+}
+
+// PublishFrames publishes messages read back from the spool.
+func PublishFrames(frames []SpoolFrame) error {
+	for _, frame := range frames {
+		var err error
+		switch frame.Type {
+		case MsgEvent:
+			client := new(Client)
+			if err := DecodePayload(frame.Payload, client); err != nil {
+				Log.Warn("drop undecodable spooled event", "err", err)
+				continue
+			}
+			err = PublishClient(client)
+		case MsgSummary:
+			summary := new(Summary)
+			if err := DecodePayload(frame.Payload, summary); err != nil {
+				Log.Warn("drop undecodable spooled summary", "err", err)
+				continue
+			}
+			err = PublishSummary(summary)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DrainSpoolMQTT publishes the spool and pending loss report.
+func DrainSpoolMQTT() {
+	if mqtt_spool == nil || !mqtt_client.IsConnectionOpen() {
+		return
+	}
+
+	if n := mqtt_spool.Len(); n > 0 {
+		Log.Info("draining spool", "events", n)
+		_, err := mqtt_spool.Drain(n, 64, PublishFrames)
+		// a publish returns once the broker has the message
+		mqtt_spool.Release(func(seq uint64) bool { return true })
+		if err != nil {
+			Log.Warn("drain spool failed", "err", err)
+			return
+		}
+	}
+
+	if lost := mqtt_spool.Lost(); lost.Dropped > 0 {
+		lost.NodeID = NODE_ID
+		if err := PublishMQTT("loss", &lost); err != nil {
+			Log.Warn("publish loss report failed", "err", err)
+			return
+		}
+		mqtt_spool.ClearLost()
+	}
+}
+
+func publishOrSpool(client *Client) {
+	if err := PublishClient(client); err != nil {
+		Log.Debug("publish failed, spooling event", "err", err)
+		SpoolMessage(mqtt_spool, MsgEvent, client)
+	}
+	client_pool.Put(client)
+}
+
+func publishSummaryOrSpool(summary *Summary) {
+	DrainSpoolMQTT()
+	if err := PublishSummary(summary); err != nil {
+		Log.Warn("publish summary failed", "err", err)
+		SpoolMessage(mqtt_spool, MsgSummary, summary)
+	}
+}
+
+// MQTTSender takes the place of the upstreams with output mqtt.
+func MQTTSender() {
+	defer close(sender_done)
+
+	conf := Conf()
+	mqtt_spool = OpenConfiguredSpool(conf.SpoolDir)
+
+	var err error
+	mqtt_client, err = NewMQTTClient(conf)
+	if err != nil {
+		Log.Error("can not set up mqtt", "err", err)
+		return
+	}
+	// with connect retry the token only completes once connected, the
+	// client keeps trying in the background
+	mqtt_client.Connect()
+
+	var interval <-chan time.Time
+	if conf.Report == REPORT_SUMMARY {
+		interval = time.After(conf.SummaryInterval)
+	}
+
+	for {
+		// without a spool events wait in client_channel until connected
+		input := client_channel
+		if mqtt_spool == nil && !mqtt_client.IsConnectionOpen() {
+			input = nil
+		}
+
+		select {
+		case <-mqtt_online:
+			DrainSpoolMQTT()
+		case client := <-input:
+			publishOrSpool(client)
+		case <-interval:
+			interval = time.After(Conf().SummaryInterval)
+			publishSummaryOrSpool(TakeSummary())
+		case <-sender_stop:
+			deadline := time.Now().Add(Conf().ShutdownTimeout)
+			for len(client_channel) > 0 && time.Now().Before(deadline) {
+				publishOrSpool(<-client_channel)
+			}
+			if dropped := len(client_channel); dropped > 0 {
+				Log.Warn("shutdown deadline passed, events dropped", "dropped", dropped)
+			}
+			if conf.Report == REPORT_SUMMARY {
+				publishSummaryOrSpool(TakeSummary())
+			}
+
+			// a clean disconnect suppresses the will, so say goodbye
+			status_topic := MQTTTopic(conf.MQTTStatusTopic, "status")
+			mqtt_client.Publish(status_topic, byte(conf.MQTTQoS), true, "offline").WaitTimeout(time.Second)
+			mqtt_client.Disconnect(250)
+			atomic.StoreInt32(&mqtt_connected, 0)
+			if mqtt_spool != nil {
+				mqtt_spool.seal()
+			}
+			return
+		}
+	}
+}
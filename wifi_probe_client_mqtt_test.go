@@ -0,0 +1,246 @@
+// +build linux
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// The broker tests publish through NewMQTTClient to the broker of
+// WIFI_PROBE_MQTT_BROKER and are skipped without one:
+//
+//	mosquitto &
+//	WIFI_PROBE_MQTT_BROKER=tcp://127.0.0.1:1883 make test
+
+const TEST_NODE_ID = "00:1b:63:84:45:e6"
+
+// testConfig sets the defaults and options as the configuration in effect.
+func testConfig(t *testing.T, options map[string]string) *Config {
+	c := new(Config)
+	for _, option := range config_options {
+		if err := option.set(c, option.def); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, value := range options {
+		if err := c.Set(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	current_config.Store(c)
+	NODE_ID = TEST_NODE_ID
+	return c
+}
+
+func TestMQTTTopic(t *testing.T) {
+	NODE_ID = TEST_NODE_ID
+	for _, test := range []struct {
+		template, event, topic string
+	}{
+		{"wifi_probe/{node}/{event}", "join", "wifi_probe/00:1b:63:84:45:e6/join"},
+		{"wifi_probe/{node}/status", "status", "wifi_probe/00:1b:63:84:45:e6/status"},
+		{"site/{event}/{node}/{event}", "leave", "site/leave/00:1b:63:84:45:e6/leave"},
+		{"fixed", "summary", "fixed"},
+	} {
+		if topic := MQTTTopic(test.template, test.event); topic != test.topic {
+			t.Errorf("MQTTTopic(%q, %q) = %q, want %q", test.template, test.event, topic, test.topic)
+		}
+	}
+
+	for template, ok := range map[string]bool{
+		"wifi_probe/{node}/{event}": true,
+		"":                          false,
+		"wifi_probe/+/{event}":      false,
+		"wifi_probe/#":              false,
+	} {
+		if err := ValidateMQTTTopic(template); (err == nil) != ok {
+			t.Errorf("ValidateMQTTTopic(%q) = %v", template, err)
+		}
+	}
+}
+
+func TestMQTTWill(t *testing.T) {
+	conf := testConfig(t, map[string]string{"mqtt_qos": "2"})
+	client, err := NewMQTTClient(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := client.OptionsReader()
+	if !opts.WillEnabled() || opts.WillTopic() != "wifi_probe/"+TEST_NODE_ID+"/status" ||
+		string(opts.WillPayload()) != "offline" || opts.WillQos() != 2 || !opts.WillRetained() {
+		t.Errorf("will %v %q %q qos %d retained %v", opts.WillEnabled(), opts.WillTopic(),
+			opts.WillPayload(), opts.WillQos(), opts.WillRetained())
+	}
+	if opts.ClientID() != "wifi_probe_001b638445e6" {
+		t.Errorf("client id %q", opts.ClientID())
+	}
+}
+
+type testMessage struct {
+	topic    string
+	payload  string
+	qos      byte
+	retained bool
+}
+
+// testSubscriber collects the messages of topic from the test broker. A live
+// subscriber skips retained messages, e.g. left by an earlier failed run.
+func testSubscriber(t *testing.T, broker, id, topic string, live bool) (mqtt.Client, chan testMessage) {
+	messages := make(chan testMessage, 64)
+	opts := mqtt.NewClientOptions().AddBroker(broker).SetClientID(id).SetCleanSession(true)
+	client := mqtt.NewClient(opts)
+	if token := client.Connect(); !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("subscriber can not connect to %s: %v", broker, token.Error())
+	}
+	token := client.Subscribe(topic, 2, func(_ mqtt.Client, msg mqtt.Message) {
+		if live && msg.Retained() {
+			return
+		}
+		messages <- testMessage{msg.Topic(), string(msg.Payload()), msg.Qos(), msg.Retained()}
+	})
+	if !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("subscribe %s: %v", topic, token.Error())
+	}
+	return client, messages
+}
+
+func expectMessage(t *testing.T, messages chan testMessage, topic string) testMessage {
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case msg := <-messages:
+			if msg.topic == topic {
+				return msg
+			}
+		case <-deadline:
+			t.Fatalf("no message on %s", topic)
+		}
+	}
+}
+
+// testProxy forwards connections to addr until cut, so the broker sees the
+// node vanish without a DISCONNECT.
+type testProxy struct {
+	listener net.Listener
+	lock     sync.Mutex
+	conns    []net.Conn
+}
+
+func newTestProxy(t *testing.T, addr string) *testProxy {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := &testProxy{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			upstream, err := net.Dial("tcp", addr)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			proxy.lock.Lock()
+			proxy.conns = append(proxy.conns, conn, upstream)
+			proxy.lock.Unlock()
+			go io.Copy(upstream, conn)
+			go io.Copy(conn, upstream)
+		}
+	}()
+	return proxy
+}
+
+func (p *testProxy) cut() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, conn := range p.conns {
+		conn.Close()
+	}
+	p.conns = nil
+}
+
+func (p *testProxy) Close() {
+	p.listener.Close()
+	p.cut()
+}
+
+func TestMQTTBroker(t *testing.T) {
+	broker := os.Getenv("WIFI_PROBE_MQTT_BROKER")
+	if broker == "" {
+		t.Skip("WIFI_PROBE_MQTT_BROKER not set")
+	}
+	broker_url, err := url.Parse(broker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := newTestProxy(t, broker_url.Host)
+	defer proxy.Close()
+
+	conf := testConfig(t, map[string]string{
+		"mqtt_broker":       "tcp://" + proxy.listener.Addr().String(),
+		"mqtt_topic":        "wifi_probe_test/{node}/{event}",
+		"mqtt_status_topic": "wifi_probe_test/{node}/status",
+		"mqtt_qos":          "1",
+	})
+	prefix := "wifi_probe_test/" + TEST_NODE_ID + "/"
+	subscriber, messages := testSubscriber(t, broker, "wifi_probe_test_sub", prefix+"#", true)
+	defer subscriber.Disconnect(100)
+
+	mqtt_client, err = NewMQTTClient(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token := mqtt_client.Connect(); !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("connect through proxy: %v", token.Error())
+	}
+	defer mqtt_client.Disconnect(100)
+
+	if msg := expectMessage(t, messages, prefix+"status"); msg.payload != "online" {
+		t.Errorf("status %q, want online", msg.payload)
+	}
+	// retained, so a later subscriber sees it at once
+	late, late_messages := testSubscriber(t, broker, "wifi_probe_test_late", prefix+"status", false)
+	if msg := expectMessage(t, late_messages, prefix+"status"); msg.payload != "online" || !msg.retained {
+		t.Errorf("late status %q retained %v, want retained online", msg.payload, msg.retained)
+	}
+	late.Disconnect(100)
+
+	for _, action := range []int{1, 2} {
+		client := &Client{Seq: 17, NodeID: TEST_NODE_ID, Addr: "00:11:22:33:44:55", From: "probe", RSSI: 61, Action: action}
+		if err := PublishClient(client); err != nil {
+			t.Fatalf("publish: %v", err)
+		}
+		msg := expectMessage(t, messages, prefix+eventName(action))
+		if msg.qos != 1 || msg.retained {
+			t.Errorf("%s qos %d retained %v, want qos 1 not retained", msg.topic, msg.qos, msg.retained)
+		}
+		var event map[string]interface{}
+		if err := json.Unmarshal([]byte(msg.payload), &event); err != nil {
+			t.Fatalf("payload %q: %v", msg.payload, err)
+		}
+		if event["addr"] != client.Addr || event["action"] != float64(action) || event["time"] == nil {
+			t.Errorf("payload %q", msg.payload)
+		}
+	}
+
+	// the broker publishes the will once the connection is gone
+	proxy.cut()
+	if msg := expectMessage(t, messages, prefix+"status"); msg.payload != "offline" {
+		t.Errorf("will %q, want offline", msg.payload)
+	}
+
+	// clear the retained status
+	subscriber.Publish(prefix+"status", 1, true, "").WaitTimeout(time.Second)
+}
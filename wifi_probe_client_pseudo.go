@@ -0,0 +1,145 @@
+// +build linux
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Station MACs are replaced by HMAC-SHA256(salt, mac) before they leave the
+// node. The salt is derived from the shared key and the index of the current
+// rotation window, so a device keeps the same pseudonym for the whole window
+// (and on every node sharing the key) but cannot be linked across windows.
+//
+// The key file holds the key as hex or raw bytes. It is re-read whenever a new
+// window starts, so keys can be distributed by just replacing the file.
+var (
+	pseudo_lock   *sync.Mutex
+	pseudo_key    []byte
+	pseudo_window int64
+	pseudo_salt   []byte
+)
+
+func init() {
+	pseudo_lock = new(sync.Mutex)
+	pseudo_window = -1
+}
+
+func ReadPseudoKey() ([]byte, error) {
+	pseudo_key_file := Conf().PseudoKeyFile
+	if pseudo_key_file == "" {
+		if pseudo_key != nil {
+			return pseudo_key, nil
+		}
+		// no distributed key: pseudonyms are only stable within this process
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		Log.Warn("no pseudonym key file, using a random key")
+		return key, nil
+	}
+
+	data, err := ioutil.ReadFile(pseudo_key_file)
+	if err != nil {
+		return nil, err
+	}
+
+	text := strings.TrimSpace(string(data))
+	if key, err := hex.DecodeString(text); err == nil && len(key) > 0 {
+		if len(key) < 16 {
+			return nil, fmt.Errorf("pseudonym key in %s is shorter than 16 bytes", pseudo_key_file)
+		}
+		return key, nil
+	}
+	if len(data) < 16 {
+		return nil, fmt.Errorf("pseudonym key in %s is shorter than 16 bytes", pseudo_key_file)
+	}
+	return data, nil
+}
+
+// pseudoSalt returns the salt of the window containing now.
+// pseudo_lock must be held.
+func pseudoSalt(now time.Time) []byte {
+	window := now.Unix() / int64(Conf().PseudoRotate/time.Second)
+	if window == pseudo_window && pseudo_salt != nil {
+		return pseudo_salt
+	}
+
+	key, err := ReadPseudoKey()
+	if err != nil {
+		Log.Error("read pseudonym key failed", "err", err)
+		if pseudo_key == nil {
+			return nil
+		}
+		// keep using the previous key rather than leaking raw MACs
+		key = pseudo_key
+	}
+
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(window))
+	mac := hmac.New(sha256.New, key)
+	mac.Write(buf[:])
+
+	pseudo_key = key
+	pseudo_window = window
+	pseudo_salt = mac.Sum(nil)
+	return pseudo_salt
+}
+
+// Pseudonymize maps a MAC string to its pseudonym in the current window.
+// With pseudonymization disabled the MAC is returned unchanged. Without a
+// pseudonym it fails, the device must not be reported under its MAC.
+func Pseudonymize(mac_str string) (string, error) {
+	conf := Conf()
+	if !conf.Pseudo {
+		return mac_str, nil
+	}
+
+	mac, err := parseMACBytes(mac_str)
+	if err != nil {
+		return "", err
+	}
+	if len(mac) != 6 {
+		return "", fmt.Errorf("bad mac address %q", mac_str)
+	}
+
+	pseudo_lock.Lock()
+	salt := pseudoSalt(time.Now())
+	pseudo_lock.Unlock()
+	if salt == nil {
+		return "", fmt.Errorf("no pseudonym salt")
+	}
+
+	h := hmac.New(sha256.New, salt)
+	h.Write(mac)
+	sum := h.Sum(nil)
+
+	if conf.PseudoKeepOUI {
+		return fmt.Sprintf("%02x:%02x:%02x-%s", mac[0], mac[1], mac[2], hex.EncodeToString(sum[:8])), nil
+	}
+	return hex.EncodeToString(sum[:12]), nil
+}
+
+func CheckPseudoFlags() bool {
+	if !Conf().Pseudo {
+		return true
+	}
+
+	pseudo_lock.Lock()
+	defer pseudo_lock.Unlock()
+	if pseudoSalt(time.Now()) == nil {
+		Log.Error("can not derive pseudonym salt", "key_file", Conf().PseudoKeyFile)
+		return false
+	}
+	return true
+}
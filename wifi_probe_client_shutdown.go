@@ -0,0 +1,145 @@
+// +build linux
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// On SIGTERM/SIGINT the capture loop stops, every device still present gets
+// a leave event with From "shutdown", and every upstream flushes what is
+// queued before its connection is closed. Whatever is not sent within
+// shutdown_timeout is dropped.
+var (
+	stopping    int32
+	sender_stop chan struct{}
+	sender_done chan struct{}
+)
+
+func init() {
+	sender_stop = make(chan struct{})
+	sender_done = make(chan struct{})
+}
+
+func IsStopping() bool {
+	return atomic.LoadInt32(&stopping) != 0
+}
+
+func WatchStopSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-signals
+	Log.Info("stopping", "signal", sig)
+	atomic.StoreInt32(&stopping, 1)
+
+	// a sender or frame handler stuck on a full client_channel must not
+	// keep the daemon from exiting
+	time.AfterFunc(2*Conf().ShutdownTimeout+2*time.Second, func() {
+		Log.Error("shutdown takes too long, exit now")
+		os.Exit(1)
+	})
+}
+
+// LeaveAll sends a leave for every device in mac_map and empties it.
+func LeaveAll() (count int) {
+	map_lock.Lock()
+	defer map_lock.Unlock()
+
+	dropped := 0
+	for mac_str, mac_client := range mac_map {
+		delete(mac_map, mac_str)
+		if TryReportEvent(NewClient(mac_client, "shutdown", 0, "", 2)) {
+			count++
+		} else {
+			dropped++
+		}
+	}
+	if dropped > 0 {
+		Log.Warn("queue full, leave events dropped", "dropped", dropped)
+	}
+	return
+}
+
+// Flush sends what is left in the queue until it is empty or the deadline
+// has passed, then waits for the server to ack and closes the connection.
+// Messages which could not be sent or were not acked in time are kept in the
+// spool for the next start.
+func (u *Upstream) Flush(deadline time.Time) {
+	sent := 0
+	for time.Now().Before(deadline) {
+		if u.conn == nil {
+			if u.spool != nil {
+				break
+			}
+			u.Connect()
+			if u.conn != nil && !u.Retransmit() {
+				u.Close()
+			}
+			if u.conn == nil {
+				time.Sleep(200 * time.Millisecond)
+				continue
+			}
+		}
+		if u.spool != nil && u.spool.Len() > 0 {
+			// the queue goes behind what is left of the spool
+			break
+		}
+		u.conn.WriteTimeout = deadline.Sub(time.Now())
+
+		select {
+		case client := <-u.queue:
+			u.SendClient(client)
+			sent++
+			continue
+		case summary := <-u.summaries:
+			u.SendSummary(summary)
+			sent++
+			continue
+		default:
+		}
+		goto DONE
+	}
+
+	if u.spool != nil {
+		spooled := 0
+		for len(u.queue) > 0 {
+			client := <-u.queue
+			u.SpoolMessage(MsgEvent, client)
+			client_pool.Put(client)
+			spooled++
+		}
+		for len(u.summaries) > 0 {
+			u.SpoolMessage(MsgSummary, <-u.summaries)
+			spooled++
+		}
+		u.log.Info("messages spooled for next start", "messages", spooled)
+	}
+
+DONE:
+	if dropped := len(u.queue) + len(u.summaries); dropped > 0 {
+		u.log.Warn("shutdown deadline passed, messages dropped", "dropped", dropped)
+	}
+	u.log.Info("sender flushed", "sent", sent)
+	u.WaitAcks(deadline)
+	u.SpoolUnacked()
+	u.Close()
+	if u.spool != nil {
+		u.spool.seal()
+	}
+}
+
+func Shutdown() {
+	Log.Info("sending leave for present devices", "devices", LeaveAll())
+
+	close(sender_stop)
+	select {
+	case <-sender_done:
+	case <-time.After(Conf().ShutdownTimeout + time.Second):
+		Log.Warn("sender did not stop in time")
+	}
+	Log.Info("stopped")
+}
@@ -0,0 +1,371 @@
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Spool keeps messages on disk while the server is unreachable. It is a
+// directory of segment files named <number>.spool, each a sequence of
+// frames as sent on the wire (see WriteFrame). New messages are appended to
+// the newest segment, draining sends segments oldest first. A segment sent
+// completely is removed once the server acked its last message, until then
+// a restart sends it again and the server drops what it already has. When
+// the spool grows beyond its size limit the oldest segments are deleted and
+// the loss is reported to the server after reconnect.
+//
+// Each spool belongs to one sender goroutine, so it does no locking.
+const (
+	SPOOL_SUFFIX = ".spool"
+)
+
+type spoolSegment struct {
+	number int64
+	size   int64
+	frames int
+	offset int64 // bytes of this segment already sent
+
+	last_seq uint64 // of the last message sent with a seq
+}
+
+type Spool struct {
+	dir          string
+	max_size     int64
+	segment_size int64
+
+	segments []*spoolSegment
+	sent     []*spoolSegment // sent completely, waiting for the ack
+	writer   *os.File
+	size     int64
+
+	lost Loss
+}
+
+func OpenSpool(dir string, max_size, segment_size int64) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Spool{dir: dir, max_size: max_size, segment_size: segment_size}
+	for _, info := range files {
+		name := info.Name()
+		if !strings.HasSuffix(name, SPOOL_SUFFIX) {
+			continue
+		}
+		number, err := strconv.ParseInt(strings.TrimSuffix(name, SPOOL_SUFFIX), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		seg := &spoolSegment{number: number}
+		if err := s.scan(seg); err != nil {
+			Log.Warn("spool segment damaged, keeping readable part", "file", name, "err", err)
+		}
+		if seg.frames == 0 {
+			os.Remove(s.path(seg))
+			continue
+		}
+		s.segments = append(s.segments, seg)
+		s.size += seg.size
+	}
+	sort.Slice(s.segments, func(i, j int) bool {
+		return s.segments[i].number < s.segments[j].number
+	})
+	return s, nil
+}
+
+func (s *Spool) path(seg *spoolSegment) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%016d%s", seg.number, SPOOL_SUFFIX))
+}
+
+// scan counts the complete frames of a segment, a torn write at the end of
+// the file (power loss) is cut off.
+func (s *Spool) scan(seg *spoolSegment) error {
+	fp, err := os.Open(s.path(seg))
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	reader := bufio.NewReader(fp)
+	for {
+		_, payload, err := ReadFrame(reader)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			os.Truncate(s.path(seg), seg.size)
+			return err
+		}
+		seg.frames++
+		seg.size += int64(len(payload)) + 5
+	}
+}
+
+// Len returns the number of messages waiting in the spool.
+func (s *Spool) Len() int {
+	frames := 0
+	for _, seg := range s.segments {
+		frames += seg.frames
+	}
+	return frames
+}
+
+func (s *Spool) Append(msg_type MsgType, payload []byte) error {
+	last := len(s.segments) - 1
+	if s.writer == nil || s.segments[last].size >= s.segment_size {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+		last = len(s.segments) - 1
+	}
+
+	if err := WriteFrame(s.writer, msg_type, payload); err != nil {
+		return err
+	}
+	seg := s.segments[last]
+	seg.frames++
+	seg.size += int64(len(payload)) + 5
+	s.size += int64(len(payload)) + 5
+
+	s.trim()
+	return nil
+}
+
+// rotate starts a new segment for appending.
+func (s *Spool) rotate() error {
+	s.seal()
+
+	number := time.Now().UnixNano()
+	if n := len(s.segments); n > 0 && s.segments[n-1].number >= number {
+		number = s.segments[n-1].number + 1
+	}
+	seg := &spoolSegment{number: number}
+
+	fp, err := os.OpenFile(s.path(seg), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	s.writer = fp
+	s.segments = append(s.segments, seg)
+	return nil
+}
+
+// seal closes the segment being appended to.
+func (s *Spool) seal() {
+	if s.writer != nil {
+		s.writer.Close()
+		s.writer = nil
+	}
+}
+
+// trim drops the oldest segments while the spool is over its size limit.
+func (s *Spool) trim() {
+	for s.size > s.max_size && len(s.segments) > 1 {
+		seg := s.segments[0]
+		os.Remove(s.path(seg))
+		s.segments = s.segments[1:]
+		s.size -= seg.size
+
+		now := time.Now().Unix()
+		if s.lost.Dropped == 0 {
+			s.lost.Since = now
+		}
+		s.lost.Until = now
+		s.lost.Dropped += seg.frames
+		s.lost.Reason = "spool overflow"
+		Log.Warn("spool full, oldest events dropped", "dropped", seg.frames, "max_size", s.max_size)
+	}
+}
+
+type SpoolFrame struct {
+	Type    MsgType
+	Payload []byte
+}
+
+// Drain hands at most max spooled messages to send in groups of at most
+// batch, oldest first, and returns the number sent. It stops at the first
+// error; groups not sent stay in the spool. Segments sent completely are kept
+// until Release.
+func (s *Spool) Drain(max, batch int, send func(frames []SpoolFrame) error) (int, error) {
+	sent := 0
+	for len(s.segments) > 0 && sent < max {
+		seg := s.segments[0]
+		if len(s.segments) == 1 {
+			// appends go to a new segment from here on
+			s.seal()
+		}
+		n, done, err := s.drainSegment(seg, max-sent, batch, send)
+		sent += n
+		if err != nil || !done {
+			return sent, err
+		}
+		s.segments = s.segments[1:]
+		s.size -= seg.size
+		s.sent = append(s.sent, seg)
+	}
+	return sent, nil
+}
+
+// drainSegment sends at most max messages of seg from where the last call
+// stopped, done reports whether the end of seg was reached.
+func (s *Spool) drainSegment(seg *spoolSegment, max, batch int, send func(frames []SpoolFrame) error) (sent int, done bool, err error) {
+	fp, err := os.Open(s.path(seg))
+	if err != nil {
+		return 0, false, err
+	}
+	defer fp.Close()
+
+	if _, err := fp.Seek(seg.offset, io.SeekStart); err != nil {
+		return 0, false, err
+	}
+
+	reader := bufio.NewReader(fp)
+	frames := make([]SpoolFrame, 0, batch)
+	var size int64
+	for sent < max {
+		msg_type, payload, read_err := ReadFrame(reader)
+		if read_err != nil && read_err != io.EOF {
+			// damaged tail, nothing more to get out of this segment
+			Log.Warn("spool segment damaged", "file", s.path(seg), "err", read_err)
+			read_err = io.EOF
+		}
+		if read_err == nil {
+			frames = append(frames, SpoolFrame{msg_type, payload})
+			size += int64(len(payload)) + 5
+		}
+
+		if len(frames) > 0 && (len(frames) >= batch || sent+len(frames) >= max || read_err == io.EOF) {
+			if err := send(frames); err != nil {
+				return sent, false, err
+			}
+			for _, frame := range frames {
+				if seq := frameSeq(frame.Type, frame.Payload); seq != 0 {
+					seg.last_seq = seq
+				}
+			}
+			seg.offset += size
+			seg.frames -= len(frames)
+			sent += len(frames)
+			frames = frames[:0]
+			size = 0
+		}
+
+		if read_err == io.EOF {
+			return sent, true, nil
+		}
+	}
+	return sent, false, nil
+}
+
+// Release removes the segments sent completely whose last message acked
+// reports as stored, oldest first.
+func (s *Spool) Release(acked func(seq uint64) bool) {
+	for len(s.sent) > 0 && acked(s.sent[0].last_seq) {
+		os.Remove(s.path(s.sent[0]))
+		s.sent = s.sent[1:]
+	}
+}
+
+// Lost returns the messages dropped since the last ClearLost.
+func (s *Spool) Lost() Loss {
+	return s.lost
+}
+
+func (s *Spool) ClearLost() {
+	s.lost = Loss{}
+}
+
+// OpenConfiguredSpool opens the spool in dir with the configured limits, it
+// returns nil if dir is empty or the spool can not be opened.
+func OpenConfiguredSpool(dir string) *Spool {
+	if dir == "" {
+		return nil
+	}
+
+	conf := Conf()
+	s, err := OpenSpool(dir, conf.SpoolMaxSize, conf.SpoolSegmentSize)
+	if err != nil {
+		Log.Error("open spool failed, running without", "dir", dir, "err", err)
+		return nil
+	}
+	if n := s.Len(); n > 0 {
+		Log.Info("spool has events from a previous run", "dir", dir, "events", n)
+	}
+	return s
+}
+
+// SpoolMessage keeps a message in s for later, it is lost if s is nil.
+func SpoolMessage(s *Spool, msg_type MsgType, v interface{}) {
+	if s == nil {
+		Log.Warn("no server connection, message dropped", "type", msg_type)
+		return
+	}
+
+	payload, err := EncodePayload(v)
+	if err == nil {
+		err = s.Append(msg_type, payload)
+	}
+	if err != nil {
+		Log.Error("spool message failed", "type", msg_type, "err", err)
+	}
+}
+
+func (u *Upstream) SpoolMessage(msg_type MsgType, v interface{}) {
+	SpoolMessage(u.spool, msg_type, v)
+}
+
+// DrainSpool sends the next part of the spool and pending loss reports on
+// the current connection. It sends no more than fits into the unacked window,
+// the run loop reads acks before it is called again. It returns false if the
+// connection broke.
+func (u *Upstream) DrainSpool() bool {
+	if u.conn == nil {
+		return true
+	}
+
+	if u.spool != nil {
+		u.spool.Release(u.Acked)
+		if n := u.spool.Len(); n > 0 && !u.WindowFull() {
+			u.log.Debug("draining spool", "events", n)
+			if _, err := u.spool.Drain(MAX_UNACKED-len(u.unacked), u.BatchSize(), u.SendSpoolFrames); err != nil {
+				u.log.Warn("drain spool failed", "err", err)
+				return false
+			}
+		}
+
+		if lost := u.spool.Lost(); lost.Dropped > 0 {
+			lost.NodeID = NODE_ID
+			if err := u.conn.WriteMessage(MsgLoss, &lost); err != nil {
+				u.log.Warn("send loss report failed", "err", err)
+				return false
+			}
+			u.spool.ClearLost()
+		}
+	}
+
+	if lost := u.TakeLost(); lost.Dropped > 0 {
+		lost.NodeID = NODE_ID
+		if err := u.conn.WriteMessage(MsgLoss, &lost); err != nil {
+			u.log.Warn("send loss report failed", "err", err)
+			u.ReturnLost(lost)
+			return false
+		}
+	}
+	return true
+}
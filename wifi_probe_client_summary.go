@@ -0,0 +1,153 @@
+// +build linux
+
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	REPORT_EVENTS  = "events"
+	REPORT_SUMMARY = "summary"
+
+	RSSI_BUCKET_SIZE = 10
+	SUMMARY_MAX_SSID = 64
+)
+
+type deviceStat struct {
+	ssi   int // strongest signal, smaller is stronger
+	ssids map[string]bool
+}
+
+var (
+	summary_lock    *sync.Mutex
+	summary_start   time.Time
+	summary_devices map[string]*deviceStat
+	summary_joins   int
+	summary_leaves  int
+)
+
+func init() {
+	summary_lock = new(sync.Mutex)
+	summary_devices = make(map[string]*deviceStat, 128)
+	summary_start = time.Now()
+}
+
+// ReportEvent queues a join/leave for the server, or only counts it when
+// reporting summaries.
+func ReportEvent(client *Client) {
+	if Conf().Report != REPORT_SUMMARY {
+		client.Seq = NextSeq()
+		client_channel <- client
+		return
+	}
+
+	summary_lock.Lock()
+	switch client.Action {
+	case 1:
+		summary_joins++
+	case 2:
+		summary_leaves++
+	}
+	summary_lock.Unlock()
+
+	client_pool.Put(client)
+}
+
+// TryReportEvent is ReportEvent without blocking on a full queue.
+func TryReportEvent(client *Client) bool {
+	if Conf().Report == REPORT_SUMMARY {
+		ReportEvent(client)
+		return true
+	}
+
+	client.Seq = NextSeq()
+	select {
+	case client_channel <- client:
+		return true
+	default:
+		client_pool.Put(client)
+		return false
+	}
+}
+
+// ObserveDevice records a frame from mac_str for the current interval.
+func ObserveDevice(mac_str string, ssi_signal int, ssid string) {
+	if Conf().Report != REPORT_SUMMARY {
+		return
+	}
+
+	summary_lock.Lock()
+	defer summary_lock.Unlock()
+
+	stat, ok := summary_devices[mac_str]
+	if !ok {
+		stat = &deviceStat{ssi: ssi_signal}
+		summary_devices[mac_str] = stat
+	}
+	if ssi_signal > 0 && ssi_signal < stat.ssi {
+		stat.ssi = ssi_signal
+	}
+	if ssid != "" {
+		if stat.ssids == nil {
+			stat.ssids = make(map[string]bool, 2)
+		}
+		stat.ssids[ssid] = true
+	}
+}
+
+// TakeSummary returns the aggregate of the interval so far and starts a new one.
+func TakeSummary() *Summary {
+	summary_lock.Lock()
+	defer summary_lock.Unlock()
+
+	now := time.Now()
+	summary := &Summary{
+		Seq:      NextSeq(),
+		NodeID:   NODE_ID,
+		Start:    summary_start.Unix(),
+		Interval: int(now.Sub(summary_start) / time.Second),
+		Devices:  len(summary_devices),
+		Joins:    summary_joins,
+		Leaves:   summary_leaves,
+		RSSI:     make(map[int]int, 8),
+		SSID:     make(map[string]int, 16),
+		Time:     now.Unix(),
+	}
+
+	for _, stat := range summary_devices {
+		if stat.ssi > 0 {
+			summary.RSSI[stat.ssi/RSSI_BUCKET_SIZE*RSSI_BUCKET_SIZE]++
+		}
+		for ssid := range stat.ssids {
+			summary.SSID[ssid]++
+		}
+	}
+	TrimSSIDHistogram(summary.SSID, SUMMARY_MAX_SSID)
+
+	summary_start = now
+	summary_devices = make(map[string]*deviceStat, len(summary_devices))
+	summary_joins = 0
+	summary_leaves = 0
+	return summary
+}
+
+// TrimSSIDHistogram keeps only the max most probed SSIDs.
+func TrimSSIDHistogram(hist map[string]int, max int) {
+	if len(hist) <= max {
+		return
+	}
+
+	ssids := make([]string, 0, len(hist))
+	for ssid := range hist {
+		ssids = append(ssids, ssid)
+	}
+	sort.Slice(ssids, func(i, j int) bool {
+		return hist[ssids[i]] > hist[ssids[j]]
+	})
+	for _, ssid := range ssids[max:] {
+		delete(hist, ssid)
+	}
+}
@@ -0,0 +1,77 @@
+// +build linux
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+)
+
+// With tls_cert and tls_key set the node connects with TLS and presents its
+// certificate, the server takes the node id from it. tls_ca is the CA bundle
+// the server certificate is checked against, the system roots if empty.
+// The files are read on every connect, so renewed certificates are picked up
+// without a restart.
+func TLSEnabled(c *Config) bool {
+	return c.TLSCert != "" || c.TLSCA != ""
+}
+
+// ClientTLSConfig returns the TLS settings for connecting to addr.
+func ClientTLSConfig(c *Config, addr string) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: c.TLSServerName,
+	}
+
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		config.ServerName = host
+	}
+
+	if c.TLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(c.TLSCert, c.TLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("load node certificate: %s", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if c.TLSCA != "" {
+		pool, err := LoadCertPool(c.TLSCA)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+// DialServer connects to server, with TLS if enabled.
+func DialServer(c *Config, server string) (net.Conn, error) {
+	// keepalive notices a dead peer even while the connection is idle
+	dialer := &net.Dialer{Timeout: c.DialTimeout, KeepAlive: 30 * time.Second}
+	conn, err := dialer.Dial("tcp", server)
+	if err != nil || !TLSEnabled(c) {
+		return conn, err
+	}
+
+	config, err := ClientTLSConfig(c, server)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	tls_conn := tls.Client(conn, config)
+	tls_conn.SetDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	if err := tls_conn.Handshake(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("tls handshake: %s", err)
+	}
+	tls_conn.SetDeadline(time.Time{})
+	return tls_conn, nil
+}
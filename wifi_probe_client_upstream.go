@@ -0,0 +1,472 @@
+// +build linux
+
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// An upstream is one destination of the node's messages, with its own queue,
+// server connection, unacked window and spool. With upstream_mode failover
+// there is a single upstream using the first server of the server list that
+// accepts it, it moves back to a preferred server once that is reachable
+// again. With upstream_mode fanout every server is an upstream of its own and
+// each event is copied to all of them, a slow or unreachable server does not
+// hold back the others.
+//
+// Each upstream is driven by its own goroutine running Run, the fields below
+// the connection are only used by that goroutine.
+//
+// Connection state for diagnostics is kept in status, see
+// wifi_probe_client_health.go.
+const (
+	UPSTREAM_FAILOVER = "failover"
+	UPSTREAM_FANOUT   = "fanout"
+
+	UPSTREAM_QUEUE_SIZE = 1024
+	FAILBACK_INTERVAL   = time.Minute
+)
+
+type Upstream struct {
+	// accessed atomically, first in the struct for 64 bit alignment on
+	// 32 bit platforms
+	last_read int64 // unix nanoseconds of the last message from the server
+	rtt       int64 // round trip time of the last ping in nanoseconds
+
+	name      string
+	fixed     string // server of a fanout upstream, failover reads Conf
+	log       *Logger
+	queue     chan *Client
+	summaries chan *Summary
+	stop      chan struct{}
+	done      chan struct{}
+
+	lost_lock *sync.Mutex
+	lost      Loss // events dropped on a full queue
+
+	status_lock *sync.Mutex
+	status      UpstreamStatus
+
+	server       string
+	rank         int // index of server in the server list
+	conn         *ProtoConn
+	caps         []string
+	acks         <-chan uint64
+	unacked      []sentFrame
+	ack_progress time.Time
+	resend       bool
+	pending      []*Client
+	spool        *Spool
+	backoff      time.Duration
+	connected    time.Time
+}
+
+var (
+	upstreams []*Upstream
+)
+
+func NewUpstream(name, fixed string, queue chan *Client) *Upstream {
+	u := &Upstream{
+		name:      name,
+		fixed:     fixed,
+		log:       Log,
+		queue:     queue,
+		summaries: make(chan *Summary, 16),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+		lost_lock: new(sync.Mutex),
+
+		status_lock: new(sync.Mutex),
+		status:      UpstreamStatus{State: STATE_DISCONNECTED, Since: time.Now().Unix()},
+	}
+	if name != "" {
+		u.log = Log.With("upstream", name)
+	}
+	return u
+}
+
+// spoolName turns a server address into a directory name.
+func spoolName(server string) string {
+	return strings.NewReplacer(":", "_", "/", "_", "[", "", "]", "").Replace(server)
+}
+
+// StartUpstreams sets up the upstreams of the configuration and starts
+// sending.
+func StartUpstreams() {
+	conf := Conf()
+	servers := conf.ServerList()
+
+	if conf.UpstreamMode == UPSTREAM_FANOUT && len(servers) > 1 {
+		for _, server := range servers {
+			u := NewUpstream(server, server, make(chan *Client, UPSTREAM_QUEUE_SIZE))
+			if conf.SpoolDir != "" {
+				u.spool = OpenConfiguredSpool(filepath.Join(conf.SpoolDir, spoolName(server)))
+			}
+			upstreams = append(upstreams, u)
+		}
+	} else {
+		// a single upstream takes events straight from client_channel
+		u := NewUpstream("", "", client_channel)
+		u.spool = OpenConfiguredSpool(conf.SpoolDir)
+		upstreams = append(upstreams, u)
+	}
+
+	for _, u := range upstreams {
+		go u.Run()
+	}
+	go Dispatch()
+}
+
+// Enqueue hands a copy of client to the upstream, it is dropped and counted
+// as lost if the queue is full.
+func (u *Upstream) Enqueue(client *Client) {
+	c := client_pool.Get().(*Client)
+	*c = *client
+	select {
+	case u.queue <- c:
+		return
+	default:
+	}
+	client_pool.Put(c)
+
+	u.lost_lock.Lock()
+	now := time.Now().Unix()
+	if u.lost.Dropped == 0 {
+		u.lost.Since = now
+		u.log.Warn("upstream queue full, dropping events")
+	}
+	u.lost.Until = now
+	u.lost.Dropped++
+	u.lost.Reason = "upstream queue full"
+	u.lost_lock.Unlock()
+}
+
+// TakeLost returns and clears the events dropped by Enqueue.
+func (u *Upstream) TakeLost() Loss {
+	u.lost_lock.Lock()
+	defer u.lost_lock.Unlock()
+	lost := u.lost
+	u.lost = Loss{}
+	return lost
+}
+
+// ReturnLost adds back a loss record which could not be sent.
+func (u *Upstream) ReturnLost(lost Loss) {
+	u.lost_lock.Lock()
+	defer u.lost_lock.Unlock()
+	if u.lost.Dropped == 0 {
+		u.lost = lost
+		return
+	}
+	u.lost.Since = lost.Since
+	u.lost.Dropped += lost.Dropped
+}
+
+// Dispatch copies events to the upstreams in fanout mode and produces the
+// summaries of report summary. On sender_stop it stops the upstreams and
+// waits for them to flush.
+func Dispatch() {
+	defer close(sender_done)
+
+	var input chan *Client
+	if len(upstreams) > 1 {
+		input = client_channel
+	}
+
+	var interval <-chan time.Time
+	if Conf().Report == REPORT_SUMMARY {
+		interval = time.After(Conf().SummaryInterval)
+	}
+
+	dispatch := func(client *Client) {
+		for _, u := range upstreams {
+			u.Enqueue(client)
+		}
+		client_pool.Put(client)
+	}
+	summarize := func() {
+		// upstreams only read the summary, so they can share it
+		summary := TakeSummary()
+		for _, u := range upstreams {
+			select {
+			case u.summaries <- summary:
+			default:
+				u.log.Warn("upstream summary queue full, summary dropped")
+			}
+		}
+	}
+
+	for {
+		select {
+		case client := <-input:
+			dispatch(client)
+		case <-interval:
+			interval = time.After(Conf().SummaryInterval)
+			summarize()
+		case <-sender_stop:
+			deadline := time.Now().Add(Conf().ShutdownTimeout)
+			if input != nil {
+				for len(input) > 0 {
+					dispatch(<-input)
+				}
+			}
+			// the final summary carries the leaves of the shutdown
+			if interval != nil {
+				summarize()
+			}
+
+			for _, u := range upstreams {
+				close(u.stop)
+			}
+			for _, u := range upstreams {
+				select {
+				case <-u.done:
+				case <-time.After(deadline.Add(time.Second).Sub(time.Now())):
+					u.log.Warn("upstream did not stop in time")
+				}
+			}
+			return
+		}
+	}
+}
+
+// Servers returns the servers the upstream may connect to, most preferred
+// first.
+func (u *Upstream) Servers() []string {
+	if u.fixed != "" {
+		return []string{u.fixed}
+	}
+	return Conf().ServerList()
+}
+
+// Connect connects to the first server of servers which accepts us.
+func (u *Upstream) Connect() {
+	u.Close()
+	for rank, server := range u.Servers() {
+		u.SetState(STATE_CONNECTING, server, nil)
+		proto, ack, err := ConnectServer(server)
+		if err != nil {
+			u.log.Warn("failed connect to server", "server", server, "err", err)
+			u.SetState(STATE_DISCONNECTED, server, err)
+			continue
+		}
+		u.log.Info("connected to server", "server", server, "version", ack.Version,
+			"capabilities", strings.Join(ack.Capabilities, ","))
+		u.adopt(server, rank, proto, ack)
+		return
+	}
+}
+
+func (u *Upstream) adopt(server string, rank int, proto *ProtoConn, ack *HelloAck) {
+	u.server = server
+	u.rank = rank
+	u.conn = proto
+	u.caps = ack.Capabilities
+	u.conn.WriteTimeout = Conf().WriteTimeout
+	u.connected = time.Now()
+	u.backoff = 0
+	atomic.StoreInt64(&u.last_read, u.connected.UnixNano())
+	atomic.StoreInt64(&u.rtt, 0)
+	if HasCapability(u.caps, CAP_ACK) || HasCapability(u.caps, CAP_PING) {
+		acks := make(chan uint64, 1)
+		go u.ReadServer(proto, acks)
+		u.acks = acks
+	}
+	u.resend = true
+	u.SetState(STATE_CONNECTED, server, nil)
+}
+
+// Failback moves to a server preferred over the current one if one of them
+// is reachable again. Unacked messages are sent again on the new connection.
+func (u *Upstream) Failback() {
+	servers := u.Servers()
+	for rank := 0; rank < u.rank && rank < len(servers); rank++ {
+		proto, ack, err := ConnectServer(servers[rank])
+		if err != nil {
+			continue
+		}
+		u.log.Info("failing back to preferred server", "server", servers[rank], "from", u.server)
+		u.FlushPending()
+		u.Close()
+		u.adopt(servers[rank], rank, proto, ack)
+		return
+	}
+}
+
+// failbackTimer returns the channel firing when a preferred server should be
+// tried again.
+func (u *Upstream) failbackTimer(timer <-chan time.Time) <-chan time.Time {
+	if u.conn == nil || u.rank == 0 {
+		return nil
+	}
+	if timer == nil {
+		return time.After(FAILBACK_INTERVAL)
+	}
+	return timer
+}
+
+func (u *Upstream) Close() {
+	if u.conn != nil {
+		u.conn.Close()
+		u.log.Info("disconnected from server", "server", u.server,
+			"connected", time.Since(u.connected).Round(time.Second))
+		u.SetState(STATE_DISCONNECTED, u.server, nil)
+	}
+	u.conn = nil
+	u.caps = nil
+	u.acks = nil
+}
+
+// ConnectServer dials server and does the protocol handshake.
+func ConnectServer(server string) (*ProtoConn, *HelloAck, error) {
+	conn, err := DialServer(Conf(), server)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	proto, ack, err := ClientHandshake(conn, NewHello())
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return proto, ack, nil
+}
+
+func (u *Upstream) SendClient(client *Client) {
+	payload, err := EncodePayload(client)
+	if err == nil {
+		err = u.WriteTracked(MsgEvent, payload, client.Seq)
+	}
+	if err != nil {
+		u.log.Warn("send data to server failed", "server", u.server, "err", err)
+		u.Close()
+		u.SpoolMessage(MsgEvent, client)
+	}
+	client_pool.Put(client)
+}
+
+func (u *Upstream) SendSummary(summary *Summary) {
+	if u.conn == nil {
+		u.Connect()
+	}
+	if u.conn != nil && (!u.Retransmit() || !u.DrainSpool()) {
+		u.Close()
+	}
+	if u.conn == nil {
+		u.SpoolMessage(MsgSummary, summary)
+		return
+	}
+
+	payload, err := EncodePayload(summary)
+	if err == nil {
+		err = u.WriteTracked(MsgSummary, payload, summary.Seq)
+	}
+	if err != nil {
+		u.log.Warn("send summary to server failed", "server", u.server, "err", err)
+		u.Close()
+		u.SpoolMessage(MsgSummary, summary)
+	}
+}
+
+func (u *Upstream) Run() {
+	defer close(u.done)
+
+	u.Connect()
+	var retry <-chan time.Time
+	var flush <-chan time.Time
+	var ack_timer <-chan time.Time
+	var failback <-chan time.Time
+	var heartbeat <-chan time.Time
+	ready := make(chan struct{})
+	close(ready)
+
+	for {
+		if u.conn != nil && (!u.Retransmit() || !u.DrainSpool()) {
+			u.Close()
+		}
+		u.UpdateStatus()
+
+		if u.conn != nil {
+			retry = nil
+			flush = u.batchTimer(flush)
+			ack_timer = u.ackTimer(ack_timer)
+			failback = u.failbackTimer(failback)
+			heartbeat = u.heartbeatTimer(heartbeat)
+
+			// stop taking events while the server lags behind with acks,
+			// while the spool is drained they queue up behind it in order
+			input := u.queue
+			backlog := u.spool != nil && u.spool.Len() > 0
+			var drain chan struct{}
+			if backlog && !u.WindowFull() {
+				drain = ready
+			}
+			if u.WindowFull() && !backlog {
+				input = nil
+			}
+
+			select {
+			case client := <-input:
+				if backlog {
+					u.SpoolMessage(MsgEvent, client)
+					client_pool.Put(client)
+				} else if u.QueueClient(client) {
+					u.FlushPending()
+				}
+			case <-drain:
+			case summary := <-u.summaries:
+				u.SendSummary(summary)
+			case <-flush:
+				flush = nil
+				u.FlushPending()
+			case seq, ok := <-u.acks:
+				u.ReceiveAck(seq, ok)
+			case <-ack_timer:
+				ack_timer = nil
+				u.CheckAckTimeout()
+			case <-failback:
+				failback = nil
+				u.Failback()
+			case <-heartbeat:
+				heartbeat = nil
+				u.Heartbeat()
+			case <-u.stop:
+				u.FlushPending()
+				u.Flush(time.Now().Add(Conf().ShutdownTimeout))
+				u.Stopped()
+				return
+			}
+			continue
+		}
+		u.FlushPending()
+		heartbeat = nil
+
+		// without a spool events stay in the queue until we reconnect
+		var input chan *Client
+		if u.spool != nil {
+			input = u.queue
+		}
+		if retry == nil {
+			retry = time.After(u.RetryDelay())
+		}
+
+		select {
+		case client := <-input:
+			u.SpoolMessage(MsgEvent, client)
+			client_pool.Put(client)
+		case summary := <-u.summaries:
+			u.SendSummary(summary)
+		case <-retry:
+			retry = nil
+			u.Connect()
+		case <-u.stop:
+			u.Flush(time.Now().Add(Conf().ShutdownTimeout))
+			u.Stopped()
+			return
+		}
+	}
+}
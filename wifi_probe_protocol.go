@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+)
+
+// Wire protocol between wifi_probe_client and wifi_probe_server.
+//
+// A connection starts with the 4 byte magic "NXFI" sent by the node, followed
+// by length prefixed messages in both directions:
+//
+//	+----------------+--------+------------------+
+//	| length uint32  | type   | payload          |
+//	| (type+payload) | uint8  | one gob value    |
+//	+----------------+--------+------------------+
+//
+// The first message of the node is a Hello, answered by a HelloAck from the
+// server which carries the negotiated version. Each payload is a self
+// contained gob stream, so fields can be added to the message structs without
+// breaking peers, and unknown message types can be skipped by length.
+//
+// Nodes from before this protocol send a bare gob stream of Client values;
+// the server tells them apart by the missing magic.
+const (
+	PROTOCOL_MAGIC       = "NXFI"
+	PROTOCOL_VERSION     = 1
+	PROTOCOL_MIN_VERSION = 1
+
+	MAX_MESSAGE_SIZE  = 4 << 20
+	HANDSHAKE_TIMEOUT = 10 * time.Second
+)
+
+type MsgType uint8
+
+const (
+	MsgHello    MsgType = 1
+	MsgHelloAck MsgType = 2
+	MsgEvent    MsgType = 3
+	MsgSummary  MsgType = 4
+	MsgLoss     MsgType = 5
+	MsgBatch    MsgType = 6
+	MsgAck      MsgType = 7
+	MsgPing     MsgType = 8
+	MsgPong     MsgType = 9
+)
+
+var msg_type_names = map[MsgType]string{
+	MsgHello:    "hello",
+	MsgHelloAck: "hello_ack",
+	MsgEvent:    "event",
+	MsgSummary:  "summary",
+	MsgLoss:     "loss",
+	MsgBatch:    "batch",
+	MsgAck:      "ack",
+	MsgPing:     "ping",
+	MsgPong:     "pong",
+}
+
+func (t MsgType) String() string {
+	if name, ok := msg_type_names[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("type%d", uint8(t))
+}
+
+// Capabilities announced in Hello and HelloAck.
+const (
+	CAP_EVENTS  = "events"
+	CAP_SUMMARY = "summary"
+	CAP_BATCH   = "batch"
+	CAP_GZIP    = "gzip"
+	CAP_ZSTD    = "zstd"
+	CAP_ACK     = "ack"
+	CAP_PING    = "ping"
+)
+
+// Batch encodings, a batch may only use one the server announced.
+const (
+	ENCODING_NONE = "none"
+	ENCODING_GZIP = "gzip"
+	ENCODING_ZSTD = "zstd"
+)
+
+type Hello struct {
+	Version      int // highest version the node speaks
+	MinVersion   int // lowest version the node speaks
+	NodeID       string
+	Firmware     string
+	Capabilities []string
+	Heartbeat    int64 // seconds between pings with CAP_PING, 0 from older nodes
+}
+
+type HelloAck struct {
+	Version      int    // version used for the rest of the connection
+	Error        string // non empty if the node was rejected
+	Capabilities []string
+}
+
+// Client is a join (Action 1) or leave (Action 2) of a station at a node.
+// Seq increases per node, 0 for nodes without sequence numbers. Time is the
+// unix time the node captured the event, 0 from older nodes; the server then
+// uses the time it received the event.
+type Client struct {
+	Seq    uint64 `json:"seq,omitempty"`
+	NodeID string `json:"node_id"`
+	Addr   string `json:"addr"`
+	From   string `json:"from"`
+	Model  string `json:"model"`
+	RSSI   int    `json:"rssi"`
+	SSID   string `json:"ssid"`
+	Action int    `json:"action"`
+	Time   int64  `json:"timestamp,omitempty"`
+}
+
+// Summary aggregates one reporting interval of a node running with
+// report summary. Time is when the node took it, like Client.Time.
+type Summary struct {
+	Seq      uint64         `json:"seq,omitempty"`
+	NodeID   string         `json:"node_id"`
+	Start    int64          `json:"start"`
+	Interval int            `json:"interval"`
+	Devices  int            `json:"devices"` // unique devices seen in the interval
+	Joins    int            `json:"joins"`
+	Leaves   int            `json:"leaves"`
+	RSSI     map[int]int    `json:"rssi"` // bucket -> devices, bucket 60 covers -60..-69 dBm
+	SSID     map[string]int `json:"ssid"` // probed SSID -> devices
+	Time     int64          `json:"timestamp,omitempty"`
+}
+
+// Loss reports events a node had to throw away, e.g. on spool overflow.
+type Loss struct {
+	NodeID  string `json:"node_id"`
+	Dropped int    `json:"dropped"`
+	Since   int64  `json:"since"` // unix time of the first and last drop
+	Until   int64  `json:"until"`
+	Reason  string `json:"reason"`
+}
+
+// Ack is sent by servers with the ack capability once messages are stored.
+// It is cumulative: Seq is the last message stored, every message sent
+// before it on the connection is stored as well.
+type Ack struct {
+	Seq uint64
+}
+
+// Ping is the heartbeat of a node, the server answers it with a Pong carrying
+// the same Time so the node can measure the round trip.
+type Ping struct {
+	Time int64 // unix nanoseconds
+}
+
+// Batch carries several events in one message. Data is a gob encoded
+// []Client, compressed according to Encoding.
+type Batch struct {
+	Encoding string
+	Count    int
+	Data     []byte
+}
+
+var (
+	zstd_once    sync.Once
+	zstd_encoder *zstd.Encoder
+	zstd_decoder *zstd.Decoder
+	zstd_err     error
+)
+
+func initZstd() {
+	// small window, the nodes are routers with a few MB of RAM
+	zstd_encoder, zstd_err = zstd.NewWriter(nil, zstd.WithWindowSize(1<<16), zstd.WithEncoderConcurrency(1))
+	if zstd_err != nil {
+		return
+	}
+	zstd_decoder, zstd_err = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(MAX_MESSAGE_SIZE*4), zstd.WithDecoderConcurrency(1))
+}
+
+func NewBatch(clients []*Client, encoding string) (*Batch, error) {
+	data, err := EncodePayload(clients)
+	if err != nil {
+		return nil, err
+	}
+
+	switch encoding {
+	case "", ENCODING_NONE:
+		encoding = ENCODING_NONE
+	case ENCODING_GZIP:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		data = buf.Bytes()
+	case ENCODING_ZSTD:
+		zstd_once.Do(initZstd)
+		if zstd_err != nil {
+			return nil, zstd_err
+		}
+		data = zstd_encoder.EncodeAll(data, nil)
+	default:
+		return nil, fmt.Errorf("unknown batch encoding %q", encoding)
+	}
+
+	return &Batch{Encoding: encoding, Count: len(clients), Data: data}, nil
+}
+
+func (b *Batch) Clients() ([]Client, error) {
+	data := b.Data
+	switch b.Encoding {
+	case "", ENCODING_NONE:
+	case ENCODING_GZIP:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		data, err = ioutil.ReadAll(io.LimitReader(r, MAX_MESSAGE_SIZE*4))
+		if err != nil {
+			return nil, err
+		}
+	case ENCODING_ZSTD:
+		zstd_once.Do(initZstd)
+		if zstd_err != nil {
+			return nil, zstd_err
+		}
+		var err error
+		data, err = zstd_decoder.DecodeAll(data, nil)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown batch encoding %q", b.Encoding)
+	}
+
+	var clients []Client
+	if err := DecodePayload(data, &clients); err != nil {
+		return nil, err
+	}
+	return clients, nil
+}
+
+func HasCapability(caps []string, name string) bool {
+	for _, c := range caps {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ProtoConn reads and writes framed messages on a connection. A write
+// failing to complete within WriteTimeout breaks the connection.
+type ProtoConn struct {
+	conn         net.Conn
+	reader       *bufio.Reader
+	writer       *bufio.Writer
+	Version      int
+	WriteTimeout time.Duration
+}
+
+func NewProtoConn(conn net.Conn, reader *bufio.Reader) *ProtoConn {
+	if reader == nil {
+		reader = bufio.NewReader(conn)
+	}
+	return &ProtoConn{
+		conn:   conn,
+		reader: reader,
+		writer: bufio.NewWriter(conn),
+	}
+}
+
+func (p *ProtoConn) Conn() net.Conn {
+	return p.conn
+}
+
+func (p *ProtoConn) Close() error {
+	return p.conn.Close()
+}
+
+func EncodePayload(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func DecodePayload(payload []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(payload)).Decode(v)
+}
+
+// WriteFrame writes one length prefixed message to w.
+func WriteFrame(w io.Writer, msg_type MsgType, payload []byte) error {
+	var head [5]byte
+	binary.BigEndian.PutUint32(head[:4], uint32(len(payload)+1))
+	head[4] = byte(msg_type)
+
+	if _, err := w.Write(head[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// ReadFrame reads one length prefixed message from r.
+func ReadFrame(r io.Reader) (MsgType, []byte, error) {
+	var head [5]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return 0, nil, err
+	}
+
+	size := binary.BigEndian.Uint32(head[:4])
+	if size < 1 || size > MAX_MESSAGE_SIZE {
+		return 0, nil, fmt.Errorf("bad message size %d", size)
+	}
+
+	payload := make([]byte, size-1)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return MsgType(head[4]), payload, nil
+}
+
+// WriteRaw writes one message with an already encoded payload.
+func (p *ProtoConn) WriteRaw(msg_type MsgType, payload []byte) error {
+	if p.WriteTimeout > 0 {
+		p.conn.SetWriteDeadline(time.Now().Add(p.WriteTimeout))
+	}
+	if err := WriteFrame(p.writer, msg_type, payload); err != nil {
+		return err
+	}
+	return p.writer.Flush()
+}
+
+func (p *ProtoConn) WriteMessage(msg_type MsgType, v interface{}) error {
+	payload, err := EncodePayload(v)
+	if err != nil {
+		return err
+	}
+	return p.WriteRaw(msg_type, payload)
+}
+
+func (p *ProtoConn) ReadMessage() (MsgType, []byte, error) {
+	return ReadFrame(p.reader)
+}
+
+// Buffered returns the number of bytes received but not read yet.
+func (p *ProtoConn) Buffered() int {
+	return p.reader.Buffered()
+}
+
+// ClientHandshake sends magic and hello and waits for the server's answer.
+func ClientHandshake(conn net.Conn, hello *Hello) (*ProtoConn, *HelloAck, error) {
+	conn.SetDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	defer conn.SetDeadline(time.Time{})
+
+	p := NewProtoConn(conn, nil)
+	if _, err := p.writer.WriteString(PROTOCOL_MAGIC); err != nil {
+		return nil, nil, err
+	}
+	if err := p.WriteMessage(MsgHello, hello); err != nil {
+		return nil, nil, err
+	}
+
+	msg_type, payload, err := p.ReadMessage()
+	if err != nil {
+		return nil, nil, err
+	}
+	if msg_type != MsgHelloAck {
+		return nil, nil, fmt.Errorf("expected hello_ack, got %s", msg_type)
+	}
+
+	ack := new(HelloAck)
+	if err := DecodePayload(payload, ack); err != nil {
+		return nil, nil, err
+	}
+	if ack.Error != "" {
+		return nil, ack, fmt.Errorf("server rejected hello: %s", ack.Error)
+	}
+	if ack.Version < hello.MinVersion || ack.Version > hello.Version {
+		return nil, ack, fmt.Errorf("server chose unsupported version %d", ack.Version)
+	}
+
+	p.Version = ack.Version
+	return p, ack, nil
+}
+
+// IsProtoConn tells a framed connection from a legacy bare gob stream.
+func IsProtoConn(reader *bufio.Reader) bool {
+	magic, err := reader.Peek(len(PROTOCOL_MAGIC))
+	return err == nil && string(magic) == PROTOCOL_MAGIC
+}
+
+// ServerHandshake reads magic and hello and answers it. The caller must have
+// checked IsProtoConn. Nodes whose version range does not overlap ours get a
+// HelloAck with Error set.
+func ServerHandshake(conn net.Conn, reader *bufio.Reader, caps []string) (*ProtoConn, *Hello, error) {
+	conn.SetDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	defer conn.SetDeadline(time.Time{})
+
+	if _, err := reader.Discard(len(PROTOCOL_MAGIC)); err != nil {
+		return nil, nil, err
+	}
+
+	p := NewProtoConn(conn, reader)
+	msg_type, payload, err := p.ReadMessage()
+	if err != nil {
+		return nil, nil, err
+	}
+	if msg_type != MsgHello {
+		return nil, nil, fmt.Errorf("expected hello, got %s", msg_type)
+	}
+
+	hello := new(Hello)
+	if err := DecodePayload(payload, hello); err != nil {
+		return nil, nil, err
+	}
+
+	ack := &HelloAck{Capabilities: caps}
+	ack.Version = hello.Version
+	if ack.Version > PROTOCOL_VERSION {
+		ack.Version = PROTOCOL_VERSION
+	}
+	if ack.Version < hello.MinVersion || ack.Version < PROTOCOL_MIN_VERSION {
+		ack.Error = fmt.Sprintf("no common protocol version, server speaks %d..%d, node %d..%d",
+			PROTOCOL_MIN_VERSION, PROTOCOL_VERSION, hello.MinVersion, hello.Version)
+	}
+
+	if err := p.WriteMessage(MsgHelloAck, ack); err != nil {
+		return nil, hello, err
+	}
+	if ack.Error != "" {
+		return nil, hello, errors.New(ack.Error)
+	}
+
+	p.Version = ack.Version
+	return p, hello, nil
+}
+
+// LoadCertPool reads a PEM bundle of CA certificates.
+func LoadCertPool(filename string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%s: no certificates found", filename)
+	}
+	return pool, nil
+}
@@ -1,21 +1,21 @@
 package main
 
 import (
-	"database/sql"
+	"bufio"
+	"crypto/tls"
 	"encoding/gob"
 	"flag"
 	"fmt"
-	_ "github.com/go-sql-driver/mysql"
 	"io"
-	"log"
 	"net"
-	"sync"
+	"os"
+	"strings"
 	"time"
 )
 
+// The -mysql_* flags configure the default mysql storage, the table names
+// apply to every SQL storage.
 var (
-	db *sql.DB
-
 	mysql_username string
 	mysql_password string
 	mysql_host     string
@@ -23,118 +23,363 @@ var (
 	mysql_database string
 	mysql_table    string
 
-	listen_addr string
+	mysql_summary_table string
 
-	client_pool *sync.Pool
+	listen_addr         string
+	summary_listen_addr string
+	idle_timeout        time.Duration
 )
 
-type Client struct {
-	NodeID string
-	Addr   string
-	From   string
-	Model  string
-	RSSI   int
-	SSID   string
-	Action int
-}
-
 func init() {
 	flag.StringVar(&mysql_username, "mysql_username", "root", "mysql server username")
 	flag.StringVar(&mysql_password, "mysql_password", "", "mysql server password")
 	flag.StringVar(&mysql_host, "mysql_host", "127.0.0.1", "mysql server hostname")
 	flag.IntVar(&mysql_port, "mysql_port", 3306, "mysql server port")
 	flag.StringVar(&mysql_database, "mysql_database", "wifi_probe", "mysql server database name")
-	flag.StringVar(&mysql_table, "mysql_table", "mysql", "mysql server table name")
+	flag.StringVar(&mysql_table, "mysql_table", "clients", "mysql server table name")
+	flag.StringVar(&mysql_summary_table, "mysql_summary_table", "summaries", "mysql server table name of node summaries")
 
 	flag.StringVar(&listen_addr, "listen_addr", "0.0.0.0:15076", "server listen host and port")
-
-	client_pool = &sync.Pool{
-		New: func() interface{} {
-			return new(Client)
-		},
-	}
+	AddLogFlags()
+	flag.StringVar(&summary_listen_addr, "summary_listen_addr", "", "plaintext listen address for summaries of old nodes, unauthenticated, disabled if empty (formerly 0.0.0.0:15077)")
+	flag.DurationVar(&idle_timeout, "idle_timeout", 2*time.Minute, "close connections of pinging nodes silent for this long, at least IDLE_HEARTBEATS of their heartbeats")
 }
 
-func (this *Client) Insert(table_name string) {
-	sql := fmt.Sprintf("INSERT INTO %s VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", table_name)
-	stmtIns, err := db.Prepare(sql)
+// IDLE_HEARTBEATS is how many heartbeats of a node the idle timeout waits at
+// least, so nodes pinging less often than -idle_timeout are not dropped.
+const IDLE_HEARTBEATS = 3
+
+func HandleConnection(conn net.Conn) {
+	peer_id, err := PeerNodeID(conn)
 	if err != nil {
-		log.Println("can not do db.Prepare:", err)
-		log.Println("reconnect to mysql")
-		ConnectMysql()
+		Log.Warn("tls handshake failed", "remote", conn.RemoteAddr(), "err", err)
+		conn.Close()
 		return
 	}
-	defer stmtIns.Close()
 
-	now_timestamp := time.Now().Unix()
-	now_timestring := time.Now().Format("2006-01-02 15:04:05")
-	_, err = stmtIns.Exec(nil, this.NodeID, this.Addr, this.From, this.Model, this.RSSI, this.SSID, this.Action,
-		now_timestamp, now_timestring)
-	if err != nil {
-		log.Println("can not do stmt.Exec:", err)
-		log.Println("reconnect to mysql")
-		ConnectMysql()
+	reader := bufio.NewReader(conn)
+	if IsProtoConn(reader) {
+		HandleProtoConnection(conn, reader, peer_id)
+	} else {
+		HandleLegacyConnection(conn, reader, peer_id)
 	}
 }
 
-func ConnectMysql() {
-	var err error
+var server_capabilities = []string{CAP_EVENTS, CAP_SUMMARY, CAP_BATCH, CAP_GZIP, CAP_ZSTD, CAP_ACK, CAP_PING}
 
-	host_info := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s", mysql_username, mysql_password,
-		mysql_host, mysql_port, mysql_database)
+// NormalizeRSSI stores the RSSI as positive magnitude of the dBm, as the
+// nodes send it; other sensors may send the negative dBm.
+func NormalizeRSSI(client *Client) {
+	if client.RSSI < 0 {
+		client.RSSI = -client.RSSI
+	}
+}
 
-	db, err = sql.Open("mysql", host_info)
-	if err != nil {
-		log.Println("failed connect to mysql:", err)
-		return
+// ClientRecord returns the record of an event of node node_id. The id in the
+// event is only kept if the connection is not authenticated by a certificate.
+func ClientRecord(log *Logger, node_id, peer_id string, client *Client) *Record {
+	if client.NodeID == "" || peer_id != "" {
+		client.NodeID = node_id
 	}
+	NormalizeRSSI(client)
+	log.Debug("got client data", "seq", client.Seq, "mac", client.Addr, "from", client.From,
+		"rssi", client.RSSI, "action", client.Action)
+	return &Record{Client: client, Received: time.Now()}
+}
+
+// StoreClient queues an event for the writer, done is called once it is
+// stored.
+func StoreClient(log *Logger, node_id, peer_id string, client *Client, done func(err error)) {
+	writer.Submit(ClientRecord(log, node_id, peer_id, client), done)
+}
 
-	err = db.Ping()
+func HandleProtoConnection(conn net.Conn, reader *bufio.Reader, peer_id string) {
+	log := Log.With("remote", conn.RemoteAddr())
+	defer conn.Close()
+
+	proto, hello, err := ServerHandshake(conn, reader, server_capabilities)
 	if err != nil {
-		log.Println("failed ping mysql server:", err)
+		log.Warn("handshake failed", "err", err)
 		return
 	}
+	if peer_id != "" && hello.NodeID != peer_id {
+		log.Warn("node id differs from certificate, using certificate", "hello", hello.NodeID, "cert", peer_id)
+		hello.NodeID = peer_id
+	}
+	log = log.With("node", hello.NodeID)
+	log.Info("node connected", "version", proto.Version, "firmware", hello.Firmware,
+		"capabilities", strings.Join(hello.Capabilities, ","))
+	node_registry.Connected(hello.NodeID, conn.RemoteAddr().String(), hello.Firmware)
+	defer node_registry.Disconnected(hello.NodeID)
+
+	// messages are acked as the writer stores them, a failed insert
+	// closes the connection so the node sends it again
+	acker := NewAcker(conn, proto, log, HasCapability(hello.Capabilities, CAP_ACK))
+	defer acker.Stop()
+
+	// a pinging node is never silent for long, so a node gone without
+	// closing the connection does not hold it forever
+	pings := HasCapability(hello.Capabilities, CAP_PING)
+	proto.WriteTimeout = 10 * time.Second
+	timeout := idle_timeout
+	if heartbeat := time.Duration(hello.Heartbeat) * time.Second; IDLE_HEARTBEATS*heartbeat > timeout {
+		timeout = IDLE_HEARTBEATS * heartbeat
+	}
+
+	for {
+		if pings && idle_timeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(timeout))
+		}
+		msg_type, payload, err := proto.ReadMessage()
+		if err == io.EOF {
+			log.Info("connection close")
+			return
+		}
+		if err != nil {
+			log.Warn("read message failed", "err", err)
+			return
+		}
+
+		switch msg_type {
+		case MsgEvent:
+			client := new(Client)
+			if err := DecodePayload(payload, client); err != nil {
+				log.Warn("decode event failed", "err", err)
+				return
+			}
+			StoreClient(log, hello.NodeID, peer_id, client, acker.Stored(client.Seq))
+		case MsgBatch:
+			batch := new(Batch)
+			if err := DecodePayload(payload, batch); err != nil {
+				log.Warn("decode batch failed", "err", err)
+				return
+			}
+			clients, err := batch.Clients()
+			if err != nil {
+				log.Warn("unpack batch failed", "encoding", batch.Encoding, "err", err)
+				return
+			}
+			log.Debug("got batch", "events", len(clients), "encoding", batch.Encoding, "size", len(batch.Data))
+			for idx := range clients {
+				StoreClient(log, hello.NodeID, peer_id, &clients[idx], acker.Stored(clients[idx].Seq))
+			}
+		case MsgSummary:
+			summary := new(Summary)
+			if err := DecodePayload(payload, summary); err != nil {
+				log.Warn("decode summary failed", "err", err)
+				return
+			}
+			if summary.NodeID == "" || peer_id != "" {
+				summary.NodeID = hello.NodeID
+			}
+			log.Debug("got summary data", "seq", summary.Seq, "devices", summary.Devices,
+				"joins", summary.Joins, "leaves", summary.Leaves)
+			writer.Submit(&Record{Summary: summary}, acker.Stored(summary.Seq))
+		case MsgPing:
+			// echoed unchanged, the node measures the round trip with it
+			if err := acker.WriteRaw(MsgPong, payload); err != nil {
+				log.Warn("send pong failed", "err", err)
+				return
+			}
+		case MsgLoss:
+			loss := new(Loss)
+			if err := DecodePayload(payload, loss); err != nil {
+				log.Warn("decode loss report failed", "err", err)
+				return
+			}
+			log.Warn("node lost events", "dropped", loss.Dropped, "reason", loss.Reason,
+				"since", time.Unix(loss.Since, 0).Format("2006-01-02 15:04:05"),
+				"until", time.Unix(loss.Until, 0).Format("2006-01-02 15:04:05"))
+		default:
+			// sent by a newer node, it must not depend on us understanding it
+			log.Debug("skip unknown message", "type", msg_type, "size", len(payload))
+		}
+	}
 }
 
-func HandleConnection(conn net.Conn) {
-	decoder := gob.NewDecoder(conn)
+// HandleLegacyConnection reads the bare gob stream of nodes from before the
+// versioned protocol.
+func HandleLegacyConnection(conn net.Conn, reader *bufio.Reader, peer_id string) {
+	log := Log.With("remote", conn.RemoteAddr(), "legacy", true)
+	decoder := gob.NewDecoder(reader)
 	for {
-		client := client_pool.Get().(*Client)
-		client.Model = ""
+		client := new(Client)
 		err := decoder.Decode(client)
 		if err == io.EOF {
-			log.Println("connection close")
+			log.Info("connection close")
+			conn.Close()
+			break
+		}
+		if err != nil {
+			log.Warn("decode network data failed", "err", err)
+			conn.Close()
+			break
+		}
+		if peer_id != "" {
+			client.NodeID = peer_id
+		}
+		NormalizeRSSI(client)
+		log.Debug("got client data", "node", client.NodeID, "mac", client.Addr, "from", client.From,
+			"rssi", client.RSSI, "action", client.Action)
+		writer.Submit(&Record{Client: client}, nil)
+	}
+}
+
+// HandleSummaryConnection reads summaries of nodes from before the versioned
+// protocol. The connection is neither encrypted nor authenticated and the
+// node id is taken from the payload, so the listener is only opened with
+// -summary_listen_addr for a network of such nodes.
+func HandleSummaryConnection(conn net.Conn) {
+	log := Log.With("remote", conn.RemoteAddr())
+	decoder := gob.NewDecoder(conn)
+	for {
+		summary := new(Summary)
+		err := decoder.Decode(summary)
+		if err == io.EOF {
+			log.Info("summary connection close")
 			conn.Close()
 			break
 		}
 		if err != nil {
-			log.Println("decode network data failed:", err)
+			log.Warn("decode summary data failed", "err", err)
 			conn.Close()
 			break
 		}
-		log.Println("got client data:", client)
-		client.Insert(mysql_table)
-		client_pool.Put(client)
+		log.Debug("got summary data", "node", summary.NodeID, "devices", summary.Devices,
+			"joins", summary.Joins, "leaves", summary.Leaves)
+		writer.Submit(&Record{Summary: summary}, nil)
+	}
+}
+
+func ListenSummary() {
+	listen_sock, err := net.Listen("tcp", summary_listen_addr)
+	if err != nil {
+		Log.Error("can not listen for summary tcp", "addr", summary_listen_addr, "err", err)
+		return
+	}
+	Log.Info("server listen for summaries", "addr", summary_listen_addr)
+	if TLSEnabled() {
+		Log.Warn("summary listener accepts unauthenticated summaries of any node despite tls", "addr", summary_listen_addr)
+	}
+
+	for {
+		conn, err := listen_sock.Accept()
+		if err != nil {
+			continue
+		}
+		go HandleSummaryConnection(conn)
 	}
 }
 
 func CheckFlags() {
 	flag.Parse()
+
+	if err := SetupLog(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 }
 
 func main() {
-	log.Println("Start server")
-
 	CheckFlags()
-	ConnectMysql()
+	if flag.Arg(0) == "migrate" {
+		MigrateCommand(flag.Args()[1:])
+	}
+	if flag.Arg(0) == "rollup" {
+		RollupCommand(flag.Args()[1:])
+	}
+	if flag.Arg(0) == "prune" {
+		PruneCommand(flag.Args()[1:])
+	}
+	if flag.Arg(0) == "normalize-rssi" {
+		NormalizeRSSICommand(flag.Args()[1:])
+	}
+	Log.Info("start server")
+
+	var err error
+	store, err = OpenStorage(storage_kind, storage_dsn)
+	if err != nil {
+		Log.Error("can not open storage", "storage", storage_kind, "err", err)
+		return
+	}
+	defer store.Close()
+	Log.Info("storage opened", "storage", storage_kind)
+	if s, ok := store.(*SQLStorage); ok {
+		// migrate now rather than on the first event
+		if err := s.ready(); err != nil {
+			Log.Error("database not ready", "storage", storage_kind, "err", err)
+		}
+	}
+	writer = NewWriter(store)
+	series, err := OpenTimeSeries()
+	if err != nil {
+		Log.Error("can not open time series output", "err", err)
+		return
+	}
+	var sessions []*Session
+	if s, ok := store.(SessionStorage); ok && sessions_enabled {
+		sessions, err = s.OpenSessions()
+		if err != nil {
+			Log.Warn("can not read open sessions", "err", err)
+		}
+	}
+	if series != nil {
+		series.Load(sessions)
+		writer.Observe(series.Observe)
+		go series.Run(store)
+	}
+	live_hub.Load(sessions)
+	writer.Observe(live_hub.Observe)
+	writer.Observe(node_registry.Observe)
+	go writer.Run()
+	if s, ok := store.(SessionStorage); ok {
+		go ExpireSessionsLoop(s)
+	}
+	if s, ok := store.(*SQLStorage); ok {
+		go PruneRollupsLoop(s)
+		go PartitionLoop(s)
+	}
+	if s, ok := store.(PruneStorage); ok {
+		go PruneLoop(s)
+	}
 
 	listen_sock, err := net.Listen("tcp", listen_addr)
 	if err != nil {
-		log.Println("can not listen for tcp:", err)
+		Log.Error("can not listen for tcp", "addr", listen_addr, "err", err)
 		return
 	}
-	log.Println("Server listen:", listen_addr)
+	if TLSEnabled() {
+		tls_config, err := ServerTLSConfig()
+		if err != nil {
+			Log.Error("can not set up tls", "err", err)
+			return
+		}
+		listen_sock = tls.NewListener(listen_sock, tls_config)
+	}
+	Log.Info("server listen", "addr", listen_addr, "tls", TLSEnabled())
+
+	if summary_listen_addr != "" {
+		go ListenSummary()
+	}
+
+	if http_addr != "" {
+		go ListenHTTP()
+	}
+
+	if plain_listen_addr != "" {
+		plain_sock, err := net.Listen("tcp", plain_listen_addr)
+		if err != nil {
+			Log.Error("can not listen for tcp", "addr", plain_listen_addr, "err", err)
+			return
+		}
+		Log.Info("server listen", "addr", plain_listen_addr, "tls", false)
+		go AcceptConnections(plain_sock)
+	}
+
+	AcceptConnections(listen_sock)
+}
 
+func AcceptConnections(listen_sock net.Listener) {
 	for {
 		conn, err := listen_sock.Accept()
 		if err != nil {
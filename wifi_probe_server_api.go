@@ -0,0 +1,582 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The query API reads the stored data back, on the listener of the HTTP
+// ingest:
+//
+//	GET /api/v1/nodes                       nodes with last event, devices present and online status
+//	GET /api/v1/nodes/<node_id>/present     devices present at a node, by open session
+//	GET /api/v1/devices/<addr>/history      events of a device    node, action, from, to
+//	GET /api/v1/sessions                    sessions              node, addr, open, from, to
+//	GET /api/v1/rollups                     rollups               node, period, from, to
+//
+// from and to take unix times, RFC 3339 times or days like 2015-06-01 and
+// select on timestamp, start of the session or start of the rollup period.
+// Lists are newest first, limit rows at most (default API_DEFAULT_LIMIT);
+// the next page is requested with the cursor of the response. JSON is the
+// default, CSV is returned for format=csv or "Accept: text/csv", the cursor
+// is then in the X-Next-Cursor header:
+//
+//	{"items": [{"addr": "...", "nodeid": "...", ...}], "next_cursor": "8213"}
+//
+// Requests authenticate like the ingest or with a token parameter.
+// -api_token and -http_token read every node, node tokens of
+// -http_token_file only their own node. Only the nodes and the present
+// devices can be read from the jsonl storage, nodes without their stored
+// events.
+const (
+	API_DEFAULT_LIMIT = 100
+	API_MAX_LIMIT     = 1000
+)
+
+var api_token string
+
+func init() {
+	flag.StringVar(&api_token, "api_token", "", "token of the query API allowed to read every node, besides -http_token")
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+type apiPage struct {
+	Items      []map[string]interface{} `json:"items"`
+	NextCursor string                   `json:"next_cursor,omitempty"`
+}
+
+// apiColumn is a column of a query, text or integer.
+type apiColumn struct {
+	name string
+	text bool
+}
+
+var (
+	event_api_columns = []apiColumn{{"id", false}, {"nodeid", true}, {"addr", true}, {"from", true},
+		{"model", true}, {"rssi", false}, {"ssid", true}, {"action", false}, {"timestamp", false}, {"seq", false}}
+	session_api_columns = []apiColumn{{"id", false}, {"nodeid", true}, {"addr", true}, {"source", true},
+		{"start", false}, {"end", false}, {"duration", false}, {"peak_rssi", false}, {"expired", false}}
+	rollup_api_columns = []apiColumn{{"id", false}, {"nodeid", true}, {"period", true}, {"start", false},
+		{"visitors", false}, {"new_visitors", false}, {"returning_visitors", false}, {"sessions", false},
+		{"dwell_total", false}, {"dwell_p50", false}, {"dwell_p90", false}, {"dwell_p99", false}}
+	node_api_columns = []apiColumn{{"nodeid", true}, {"first_seen", false}, {"last_seen", false},
+		{"events", false}, {"present", false}, {"online", false}, {"connected_since", false},
+		{"firmware", true}, {"events_last_minute", false}, {"events_last_hour", false}}
+	present_api_columns = []apiColumn{{"nodeid", true}, {"addr", true}, {"source", true},
+		{"start", false}, {"duration", false}, {"peak_rssi", false}}
+)
+
+// apiQuery is a page of rows of one table, selected by conditions with ?
+// placeholders.
+type apiQuery struct {
+	table   string
+	columns []apiColumn
+	where   []string
+	args    []interface{}
+	cursor  int64 // rows with a lower id, 0 for the first page
+	limit   int
+}
+
+func (query *apiQuery) filter(condition string, args ...interface{}) {
+	query.where = append(query.where, condition)
+	query.args = append(query.args, args...)
+}
+
+// Page returns the rows of query and the cursor of the next page, 0 on the
+// last one.
+func (s *SQLStorage) Page(query *apiQuery) ([]map[string]interface{}, int64, error) {
+	q := s.dialect.quote
+	names := make([]string, len(query.columns))
+	for idx, column := range query.columns {
+		names[idx] = q(column.name)
+	}
+	if query.cursor > 0 {
+		query.filter(q("id")+" < ?", query.cursor)
+	}
+	statement := fmt.Sprintf("SELECT %s FROM %s", strings.Join(names, ", "), q(query.table))
+	if len(query.where) > 0 {
+		statement += " WHERE " + strings.Join(query.where, " AND ")
+	}
+	statement += fmt.Sprintf(" ORDER BY %s DESC LIMIT %d", q("id"), query.limit+1)
+
+	rows, err := s.db.Query(s.dialect.Bind(statement), query.args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	items, err := scanAPIRows(rows, query.columns)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var next int64
+	if len(items) > query.limit {
+		items = items[:query.limit]
+		next = items[len(items)-1]["id"].(int64)
+	}
+	return items, next, nil
+}
+
+func scanAPIRows(rows *sql.Rows, columns []apiColumn) ([]map[string]interface{}, error) {
+	defer rows.Close()
+	items := []map[string]interface{}{}
+	for rows.Next() {
+		dest := make([]interface{}, len(columns))
+		for idx, column := range columns {
+			if column.text {
+				dest[idx] = new(sql.NullString)
+			} else {
+				dest[idx] = new(sql.NullInt64)
+			}
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+
+		item := make(map[string]interface{}, len(columns))
+		for idx, column := range columns {
+			item[column.name] = nil
+			switch v := dest[idx].(type) {
+			case *sql.NullString:
+				if v.Valid {
+					item[column.name] = v.String
+				}
+			case *sql.NullInt64:
+				if v.Valid {
+					item[column.name] = v.Int64
+				}
+			}
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// Nodes returns every node with events, with the devices present at it.
+// First and last seen and the events are the totals counted on insert,
+// retention does not lower them.
+func (s *SQLStorage) Nodes(node_id string) ([]map[string]interface{}, error) {
+	q := s.dialect.quote
+	statement := fmt.Sprintf("SELECT %s, %s, %s, %s FROM %s",
+		q("nodeid"), q("first_seen"), q("last_seen"), q("events"), q("nodes"))
+	var args []interface{}
+	if node_id != "" {
+		statement += fmt.Sprintf(" WHERE %s = ?", q("nodeid"))
+		args = append(args, node_id)
+	}
+	statement += fmt.Sprintf(" ORDER BY %s", q("nodeid"))
+
+	rows, err := s.db.Query(s.dialect.Bind(statement), args...)
+	if err != nil {
+		return nil, err
+	}
+	nodes, err := scanAPIRows(rows, node_api_columns[:4])
+	if err != nil {
+		return nil, err
+	}
+
+	present := make(map[string]int64)
+	if sessions_enabled {
+		sessions, err := s.OpenSessions()
+		if err != nil {
+			return nil, err
+		}
+		for _, session := range sessions {
+			present[session.NodeID]++
+		}
+	}
+	for _, node := range nodes {
+		node["present"] = present[node["nodeid"].(string)]
+	}
+	return nodes, nil
+}
+
+// parseAPITime parses a unix time, an RFC 3339 time or a day.
+func parseAPITime(value string) (int64, error) {
+	if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return n, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.Unix(), nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return 0, fmt.Errorf("bad time %q", value)
+	}
+	return t.Unix(), nil
+}
+
+// apiRequest holds what every query handler parses.
+type apiRequest struct {
+	w      http.ResponseWriter
+	r      *http.Request
+	params url.Values
+	node   string // node the token is bound to, "" for all
+	csv    bool
+}
+
+// filterTime adds the from and to parameters on column.
+func (req *apiRequest) filterTime(query *apiQuery, s *SQLStorage, column string) error {
+	for _, param := range []string{"from", "to"} {
+		value := req.params.Get(param)
+		if value == "" {
+			continue
+		}
+		at, err := parseAPITime(value)
+		if err != nil {
+			return err
+		}
+		op := ">="
+		if param == "to" {
+			op = "<"
+		}
+		query.filter(fmt.Sprintf("%s %s ?", s.dialect.quote(column), op), at)
+	}
+	return nil
+}
+
+// filterNode restricts query to the node parameter and to the node of the
+// token.
+func (req *apiRequest) filterNode(query *apiQuery, s *SQLStorage) error {
+	node_id, err := req.nodeParam()
+	if err == nil && node_id != "" {
+		query.filter(s.dialect.quote("nodeid")+" = ?", node_id)
+	}
+	return err
+}
+
+func (req *apiRequest) nodeParam() (string, error) {
+	node_id := req.params.Get("node")
+	if req.node != "" {
+		if node_id != "" && node_id != req.node {
+			return "", fmt.Errorf("token is bound to node %q", req.node)
+		}
+		node_id = req.node
+	}
+	return node_id, nil
+}
+
+func (req *apiRequest) page(query *apiQuery) error {
+	query.limit = API_DEFAULT_LIMIT
+	if value := req.params.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > API_MAX_LIMIT {
+			return fmt.Errorf("limit must be 1 to %d", API_MAX_LIMIT)
+		}
+		query.limit = limit
+	}
+	if value := req.params.Get("cursor"); value != "" {
+		cursor, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || cursor < 1 {
+			return fmt.Errorf("bad cursor %q", value)
+		}
+		query.cursor = cursor
+	}
+	return nil
+}
+
+func (req *apiRequest) fail(status int, err error) {
+	writeJSON(req.w, status, &apiError{Error: err.Error()})
+}
+
+func (req *apiRequest) respond(columns []apiColumn, items []map[string]interface{}, next int64) {
+	page := &apiPage{Items: items}
+	if next > 0 {
+		page.NextCursor = strconv.FormatInt(next, 10)
+	}
+	if !req.csv {
+		writeJSON(req.w, http.StatusOK, page)
+		return
+	}
+
+	req.w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	if page.NextCursor != "" {
+		req.w.Header().Set("X-Next-Cursor", page.NextCursor)
+	}
+	out := csv.NewWriter(req.w)
+	record := make([]string, len(columns))
+	for idx, column := range columns {
+		record[idx] = column.name
+	}
+	out.Write(record)
+	for _, item := range items {
+		for idx, column := range columns {
+			record[idx] = ""
+			if value := item[column.name]; value != nil {
+				record[idx] = fmt.Sprint(value)
+			}
+		}
+		out.Write(record)
+	}
+	out.Flush()
+}
+
+// authenticateRead also accepts the -api_token, which can not send events,
+// and the token parameter for browsers which can not set headers on
+// EventSource and WebSocket requests.
+func authenticateRead(r *http.Request) (string, bool) {
+	token := strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+	if api_token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(api_token)) == 1 {
+		return "", true
+	}
+	return checkToken(token)
+}
+
+// apiHandler authenticates a GET request and parses the common parameters.
+func apiHandler(handle func(req *apiRequest)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			writeJSON(w, http.StatusMethodNotAllowed, &apiError{Error: "use GET"})
+			return
+		}
+		node_id, ok := authenticateRead(r)
+		if !ok {
+			Log.Warn("query api with bad token", "remote", r.RemoteAddr)
+			writeJSON(w, http.StatusUnauthorized, &apiError{Error: "bad token"})
+			return
+		}
+
+		params := r.URL.Query()
+		format := params.Get("format")
+		if format != "" && format != "json" && format != "csv" {
+			writeJSON(w, http.StatusBadRequest, &apiError{Error: "format must be json or csv"})
+			return
+		}
+		handle(&apiRequest{
+			w:      w,
+			r:      r,
+			params: params,
+			node:   node_id,
+			csv:    format == "csv" || format == "" && strings.Contains(r.Header.Get("Accept"), "text/csv"),
+		})
+	}
+}
+
+// sqlHandler is an apiHandler of a SQL storage.
+func sqlHandler(handle func(req *apiRequest, s *SQLStorage)) http.HandlerFunc {
+	return apiHandler(func(req *apiRequest) {
+		s, ok := store.(*SQLStorage)
+		if !ok {
+			req.fail(http.StatusNotImplemented, fmt.Errorf("%s storage can not be queried", storage_kind))
+			return
+		}
+		handle(req, s)
+	})
+}
+
+// HandleNodes adds the online status and event rates of the node registry
+// to the stored nodes.
+func HandleNodes(req *apiRequest) {
+	nodes := []map[string]interface{}{}
+	sql_store, is_sql := store.(*SQLStorage)
+	if is_sql {
+		var err error
+		if nodes, err = sql_store.Nodes(req.node); err != nil {
+			Log.Error("query nodes failed", "err", err)
+			req.fail(http.StatusServiceUnavailable, fmt.Errorf("storage unavailable"))
+			return
+		}
+	}
+	by_id := make(map[string]map[string]interface{})
+	for _, node := range nodes {
+		by_id[node["nodeid"].(string)] = node
+	}
+
+	// the jsonl storage only knows the present devices
+	if s, ok := store.(SessionStorage); ok && !is_sql && sessions_enabled {
+		sessions, err := s.OpenSessions()
+		if err != nil {
+			Log.Error("query present devices failed", "err", err)
+			req.fail(http.StatusServiceUnavailable, fmt.Errorf("storage unavailable"))
+			return
+		}
+		for _, session := range sessions {
+			if req.node != "" && session.NodeID != req.node {
+				continue
+			}
+			node := by_id[session.NodeID]
+			if node == nil {
+				node = map[string]interface{}{"nodeid": session.NodeID, "present": int64(0)}
+				by_id[session.NodeID] = node
+				nodes = append(nodes, node)
+			}
+			node["present"] = node["present"].(int64) + 1
+		}
+	}
+
+	for _, state := range node_registry.Nodes(time.Now()) {
+		if req.node != "" && state.NodeID != req.node {
+			continue
+		}
+		node := by_id[state.NodeID]
+		if node == nil {
+			node = map[string]interface{}{"nodeid": state.NodeID, "present": int64(0)}
+			by_id[state.NodeID] = node
+			nodes = append(nodes, node)
+		}
+		node["online"] = state.Online
+		node["events_last_minute"] = state.EventsMinute
+		node["events_last_hour"] = state.EventsHour
+		if state.ConnectedSince != 0 {
+			node["connected_since"] = state.ConnectedSince
+		}
+		if state.Firmware != "" {
+			node["firmware"] = state.Firmware
+		}
+	}
+	for _, node := range nodes {
+		if _, ok := node["online"]; !ok {
+			node["online"] = false
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i]["nodeid"].(string) < nodes[j]["nodeid"].(string)
+	})
+	req.respond(node_api_columns, nodes, 0)
+}
+
+// HandleNode serves /api/v1/nodes/<node_id>/present.
+func HandleNode(req *apiRequest) {
+	path := strings.TrimPrefix(req.r.URL.Path, "/api/v1/nodes/")
+	if !strings.HasSuffix(path, "/present") {
+		req.fail(http.StatusNotFound, fmt.Errorf("not found"))
+		return
+	}
+	node_id := strings.TrimSuffix(path, "/present")
+	if req.node != "" && node_id != req.node {
+		req.fail(http.StatusForbidden, fmt.Errorf("token is bound to node %q", req.node))
+		return
+	}
+	s, ok := store.(SessionStorage)
+	if !ok || !sessions_enabled {
+		req.fail(http.StatusNotImplemented, fmt.Errorf("present devices need sessions"))
+		return
+	}
+
+	sessions, err := s.OpenSessions()
+	if err != nil {
+		Log.Error("query present devices failed", "err", err)
+		req.fail(http.StatusServiceUnavailable, fmt.Errorf("storage unavailable"))
+		return
+	}
+	now := time.Now().Unix()
+	items := []map[string]interface{}{}
+	for _, session := range sessions {
+		if session.NodeID != node_id {
+			continue
+		}
+		items = append(items, map[string]interface{}{
+			"nodeid":    session.NodeID,
+			"addr":      session.Addr,
+			"source":    session.Source,
+			"start":     session.Start,
+			"duration":  now - session.Start,
+			"peak_rssi": session.PeakRSSI,
+		})
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i]["start"].(int64) > items[j]["start"].(int64)
+	})
+	req.respond(present_api_columns, items, 0)
+}
+
+// HandleDevice serves /api/v1/devices/<addr>/history.
+func HandleDevice(req *apiRequest, s *SQLStorage) {
+	addr, rest, _ := strings.Cut(strings.TrimPrefix(req.r.URL.Path, "/api/v1/devices/"), "/")
+	if addr == "" || rest != "history" {
+		req.fail(http.StatusNotFound, fmt.Errorf("not found"))
+		return
+	}
+	query := &apiQuery{table: mysql_table, columns: event_api_columns}
+	query.filter(s.dialect.quote("addr")+" = ?", addr)
+	if value := req.params.Get("action"); value != "" {
+		action, err := strconv.Atoi(value)
+		if err != nil {
+			req.fail(http.StatusBadRequest, fmt.Errorf("bad action %q", value))
+			return
+		}
+		query.filter(s.dialect.quote("action")+" = ?", action)
+	}
+	req.query(s, query, "timestamp")
+}
+
+func HandleSessions(req *apiRequest, s *SQLStorage) {
+	q := s.dialect.quote
+	query := &apiQuery{table: "sessions", columns: session_api_columns}
+	if addr := req.params.Get("addr"); addr != "" {
+		query.filter(q("addr")+" = ?", addr)
+	}
+	switch req.params.Get("open") {
+	case "":
+	case "true", "1":
+		query.filter(q("end") + " IS NULL")
+	case "false", "0":
+		query.filter(q("end") + " IS NOT NULL")
+	default:
+		req.fail(http.StatusBadRequest, fmt.Errorf("open must be true or false"))
+		return
+	}
+	req.query(s, query, "start")
+}
+
+func HandleRollups(req *apiRequest, s *SQLStorage) {
+	period := req.params.Get("period")
+	if period == "" {
+		period = ROLLUP_HOUR
+	}
+	if period != ROLLUP_HOUR && period != ROLLUP_DAY {
+		req.fail(http.StatusBadRequest, fmt.Errorf("period must be %s or %s", ROLLUP_HOUR, ROLLUP_DAY))
+		return
+	}
+	query := &apiQuery{table: "rollups", columns: rollup_api_columns}
+	query.filter(s.dialect.quote("period")+" = ?", period)
+	req.query(s, query, "start")
+}
+
+// query adds the node, time and page parameters to query and responds with
+// its rows.
+func (req *apiRequest) query(s *SQLStorage, query *apiQuery, time_column string) {
+	if err := req.filterNode(query, s); err != nil {
+		req.fail(http.StatusForbidden, err)
+		return
+	}
+	err := req.filterTime(query, s, time_column)
+	if err == nil {
+		err = req.page(query)
+	}
+	if err != nil {
+		req.fail(http.StatusBadRequest, err)
+		return
+	}
+
+	items, next, err := s.Page(query)
+	if err != nil {
+		Log.Error("query failed", "table", query.table, "err", err)
+		req.fail(http.StatusServiceUnavailable, fmt.Errorf("storage unavailable"))
+		return
+	}
+	req.respond(query.columns, items, next)
+}
+
+func RegisterAPI(mux *http.ServeMux) {
+	mux.HandleFunc("/api/v1/nodes", apiHandler(HandleNodes))
+	mux.HandleFunc("/api/v1/nodes/", apiHandler(HandleNode))
+	mux.HandleFunc("/api/v1/devices/", sqlHandler(HandleDevice))
+	mux.HandleFunc("/api/v1/sessions", sqlHandler(HandleSessions))
+	mux.HandleFunc("/api/v1/rollups", sqlHandler(HandleRollups))
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// testAPI serves the query API of storage with the -api_token "reader".
+func testAPI(t *testing.T, storage Storage) *httptest.Server {
+	saved_store, saved_token := store, api_token
+	t.Cleanup(func() { store, api_token = saved_store, saved_token })
+	store = storage
+	api_token = "reader"
+
+	mux := http.NewServeMux()
+	RegisterAPI(mux)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func getPage(t *testing.T, server *httptest.Server, path string, params url.Values) (int, *apiPage) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, server.URL+path+"?"+params.Encode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer reader")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	page := new(apiPage)
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(page); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode, page
+}
+
+func TestAPICursor(t *testing.T) {
+	s := testSQLStorage(t)
+	var records []*Record
+	for idx := 0; idx < 5; idx++ {
+		records = append(records, testEvent("aa:00", 1, 60, uint64(idx+1), int64(idx*60)))
+	}
+	records = append(records, testEvent("aa:01", 1, 60, 6, 600))
+	writeRecords(t, s, records...)
+	server := testAPI(t, s)
+
+	// newest first, pages of 2 until the cursor runs out
+	var seqs []float64
+	params := url.Values{"limit": {"2"}}
+	for pages := 1; ; pages++ {
+		status, page := getPage(t, server, "/api/v1/devices/aa:00/history", params)
+		if status != http.StatusOK {
+			t.Fatalf("page %d: status %d", pages, status)
+		}
+		for _, item := range page.Items {
+			seq, _ := item["seq"].(float64)
+			seqs = append(seqs, seq)
+		}
+		if page.NextCursor == "" {
+			if pages != 3 {
+				t.Errorf("%d pages, want 3", pages)
+			}
+			break
+		}
+		if pages > 3 {
+			t.Fatal("cursor does not end")
+		}
+		params.Set("cursor", page.NextCursor)
+	}
+	want := []float64{5, 4, 3, 2, 1}
+	if len(seqs) != len(want) {
+		t.Fatalf("seqs %v, want %v", seqs, want)
+	}
+	for idx := range want {
+		if seqs[idx] != want[idx] {
+			t.Fatalf("seqs %v, want %v", seqs, want)
+		}
+	}
+
+	for _, test := range []struct {
+		path   string
+		params url.Values
+		status int
+	}{
+		{"/api/v1/devices/aa:00", nil, http.StatusNotFound},
+		{"/api/v1/devices/aa:00/other", nil, http.StatusNotFound},
+		{"/api/v1/devices/aa:00/history", url.Values{"cursor": {"x"}}, http.StatusBadRequest},
+		{"/api/v1/devices/aa:00/history", url.Values{"limit": {"0"}}, http.StatusBadRequest},
+	} {
+		if status, _ := getPage(t, server, test.path, test.params); status != test.status {
+			t.Errorf("%s?%s: status %d, want %d", test.path, test.params.Encode(), status, test.status)
+		}
+	}
+}
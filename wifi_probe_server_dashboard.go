@@ -0,0 +1,38 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// The dashboard is a web page on the HTTP listener for checking an
+// installation from a browser:
+//
+//	GET /dashboard/
+//
+// It lists the nodes with their online status, event rates and devices
+// present, charts the joins and leaves of the live stream and the visitors
+// of the hourly and daily rollups. The page itself needs no token, it asks
+// for one of the query API and reads everything through the API, so a node
+// token shows its own node only. The files are built into the binary and
+// load nothing from elsewhere, it works on a site without internet access.
+//
+//go:embed dashboard
+var dashboard_files embed.FS
+
+func RegisterDashboard(mux *http.ServeMux) {
+	files, err := fs.Sub(dashboard_files, "dashboard")
+	if err != nil {
+		Log.Error("dashboard files missing", "err", err)
+		return
+	}
+	mux.Handle("/dashboard/", http.StripPrefix("/dashboard/", http.FileServer(http.FS(files))))
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		http.Redirect(w, r, "/dashboard/", http.StatusFound)
+	})
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// HTTP ingest for sensors and scripts which do not speak the node protocol.
+// POST /api/v1/events takes a JSON object, a JSON array or NDJSON (one object
+// per line) of events:
+//
+//	{"node_id": "sensor-1", "addr": "00:1b:63:84:45:e6", "rssi": 61, "action": 1, "timestamp": 1433160000}
+//
+// rssi is the magnitude of the dBm like nodes send it, -61 is taken as 61.
+// timestamp is the unix time the event was captured, the time the request
+// is received if it is missing.
+//
+// Requests authenticate with "Authorization: Bearer <token>". The token of
+// -http_token may send events of any node, tokens of -http_token_file are
+// bound to one node id each:
+//
+//	# token                           node id
+//	4f8a1c0e9d2b7a6f5e3c1b0a9d8e7f6c  sensor-1
+//
+// Events go through the same storage path as node connections, events with a
+// seq are deduplicated by (node, seq) so a failed request can be retried.
+//
+// Clients get HTTP_READ_HEADER_TIMEOUT to send the request headers and idle
+// connections are closed after HTTP_IDLE_TIMEOUT. There is no write timeout
+// for the whole response, the live stream stays open.
+const (
+	HTTP_READ_HEADER_TIMEOUT = 10 * time.Second
+	HTTP_IDLE_TIMEOUT        = 2 * time.Minute
+)
+
+var (
+	http_addr       string
+	http_token      string
+	http_token_file string
+
+	http_tokens map[string]string
+)
+
+func init() {
+	flag.StringVar(&http_addr, "http_addr", "", "listen address of the HTTP event ingest, disabled if empty")
+	flag.StringVar(&http_token, "http_token", "", "token of the HTTP ingest allowed to send for any node")
+	flag.StringVar(&http_token_file, "http_token_file", "", "file of \"token node_id\" lines for the HTTP ingest")
+}
+
+func LoadHTTPTokens(filename string) (map[string]string, error) {
+	fp, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	tokens := make(map[string]string)
+	scanner := bufio.NewScanner(fp)
+	line_no := 0
+	for scanner.Scan() {
+		line_no++
+		line := scanner.Text()
+		if idx := strings.Index(line, "#"); idx >= 0 {
+			line = line[:idx]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"token node_id\"", filename, line_no)
+		}
+		tokens[fields[0]] = fields[1]
+	}
+	return tokens, scanner.Err()
+}
+
+// authenticate returns the node id bound to the token of r, "" for the
+// -http_token, and false if the token is unknown.
+func authenticate(r *http.Request) (string, bool) {
+	token := r.Header.Get("Authorization")
+	if !strings.HasPrefix(token, "Bearer ") {
+		return "", false
+	}
+	return checkToken(strings.TrimSpace(strings.TrimPrefix(token, "Bearer ")))
+}
+
+func checkToken(token string) (string, bool) {
+	if token == "" {
+		return "", false
+	}
+	if http_token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(http_token)) == 1 {
+		return "", true
+	}
+	for t, node_id := range http_tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			return node_id, true
+		}
+	}
+	return "", false
+}
+
+// DecodeEvents reads a JSON object, a JSON array or NDJSON of events.
+func DecodeEvents(body io.Reader) ([]*Client, error) {
+	reader := bufio.NewReader(body)
+	for {
+		c, err := reader.Peek(1)
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.ContainsAny(c, " \t\r\n") {
+			break
+		}
+		reader.ReadByte()
+	}
+
+	var clients []*Client
+	decoder := json.NewDecoder(reader)
+	if c, _ := reader.Peek(1); c[0] == '[' {
+		if err := decoder.Decode(&clients); err != nil {
+			return nil, err
+		}
+		return clients, nil
+	}
+
+	for {
+		client := new(Client)
+		err := decoder.Decode(client)
+		if err == io.EOF {
+			return clients, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("event %d: %s", len(clients)+1, err)
+		}
+		clients = append(clients, client)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+type ingestResult struct {
+	Accepted int    `json:"accepted"`
+	Error    string `json:"error,omitempty"`
+}
+
+func HandleIngest(w http.ResponseWriter, r *http.Request) {
+	log := Log.With("remote", r.RemoteAddr, "http", true)
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSON(w, http.StatusMethodNotAllowed, &ingestResult{Error: "use POST"})
+		return
+	}
+
+	node_id, ok := authenticate(r)
+	if !ok {
+		log.Warn("http ingest with bad token")
+		writeJSON(w, http.StatusUnauthorized, &ingestResult{Error: "bad token"})
+		return
+	}
+
+	clients, err := DecodeEvents(http.MaxBytesReader(w, r.Body, MAX_MESSAGE_SIZE))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, &ingestResult{Error: err.Error()})
+		return
+	}
+
+	for idx, client := range clients {
+		if client.NodeID == "" && node_id == "" {
+			err = fmt.Errorf("event %d: missing node_id", idx+1)
+		} else if client.Addr == "" {
+			err = fmt.Errorf("event %d: missing addr", idx+1)
+		} else if client.Action != 1 && client.Action != 2 {
+			err = fmt.Errorf("event %d: action must be 1 (join) or 2 (leave)", idx+1)
+		}
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, &ingestResult{Error: err.Error()})
+			return
+		}
+	}
+
+	// a token bound to a node may only send for that node, like a
+	// certificate on a node connection
+	peer_id := node_id
+	records := make([]*Record, len(clients))
+	for idx, client := range clients {
+		records[idx] = ClientRecord(log, node_id, peer_id, client)
+	}
+	if stored, err := writer.Write(records); err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, &ingestResult{Accepted: stored, Error: "storage unavailable"})
+		return
+	}
+	log.Debug("http ingest", "node", node_id, "events", len(clients))
+	writeJSON(w, http.StatusOK, &ingestResult{Accepted: len(clients)})
+}
+
+func ListenHTTP() {
+	if http_token == "" && http_token_file == "" && api_token == "" {
+		Log.Error("http ingest needs http_token, http_token_file or api_token")
+		return
+	}
+	if http_token_file != "" {
+		tokens, err := LoadHTTPTokens(http_token_file)
+		if err != nil {
+			Log.Error("load http tokens failed", "err", err)
+			return
+		}
+		http_tokens = tokens
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/events", HandleIngest)
+	RegisterAPI(mux)
+	mux.HandleFunc("/api/v1/live", HandleLiveSSE)
+	mux.HandleFunc("/api/v1/live/ws", HandleLiveWS)
+	RegisterDashboard(mux)
+
+	// same certificate as the node listener, but tokens instead of client
+	// certificates
+	server := &http.Server{
+		Addr:              http_addr,
+		Handler:           mux,
+		ReadHeaderTimeout: HTTP_READ_HEADER_TIMEOUT,
+		IdleTimeout:       HTTP_IDLE_TIMEOUT,
+	}
+	Log.Info("http ingest listen", "addr", http_addr, "tls", TLSEnabled())
+	var err error
+	if TLSEnabled() {
+		err = server.ListenAndServeTLS(tls_cert, tls_key)
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != nil {
+		Log.Error("can not listen for http", "addr", http_addr, "err", err)
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// JSONLStorage appends events and summaries as JSON lines to one file per
+// kind and day received in a directory, for deployments without a database:
+//
+//	clients-20150601.jsonl    {"seq":17,"node_id":"...","addr":"...","action":1,"timestamp":1433160000}
+//	summaries-20150601.jsonl  {"seq":18,"node_id":"...","start":1433159940,...,"timestamp":1433160000}
+//
+// Duplicates are recognized by the last JSONL_DEDUP_WINDOW seqs of each node,
+// which covers the ack window nodes send again after a reconnect. The window
+// is filled from the tail of the current files at startup. Lines are written
+// straight to the file, so they survive a crash of the server but not of the
+// machine.
+//
+// Sessions are kept in memory while open and appended to
+// sessions-YYYYMMDD.jsonl of the day they end. Open sessions are lost when
+// the server restarts; the following leaves are dropped and the devices
+// start new sessions with their next join.
+const (
+	JSONL_DEDUP_WINDOW = 8192
+	JSONL_TAIL_SIZE    = 4 << 20
+)
+
+type jsonlFile struct {
+	kind string
+	day  string
+	fp   *os.File
+	seen map[string]*seqWindow
+}
+
+// seqWindow remembers the last seqs of one node.
+type seqWindow struct {
+	seqs  map[uint64]struct{}
+	order []uint64
+	next  int
+}
+
+func (w *seqWindow) Has(seq uint64) bool {
+	_, ok := w.seqs[seq]
+	return ok
+}
+
+func (w *seqWindow) Add(seq uint64) {
+	if w.Has(seq) {
+		return
+	}
+	if len(w.order) < JSONL_DEDUP_WINDOW {
+		w.order = append(w.order, seq)
+	} else {
+		delete(w.seqs, w.order[w.next])
+		w.order[w.next] = seq
+		w.next = (w.next + 1) % JSONL_DEDUP_WINDOW
+	}
+	w.seqs[seq] = struct{}{}
+}
+
+type JSONLStorage struct {
+	lock      *sync.Mutex
+	dir       string
+	clients   *jsonlFile
+	summaries *jsonlFile
+	sessions  *jsonlFile
+	open      map[string]*Session // node_id + " " + addr
+}
+
+func NewJSONLStorage(dir string) (*JSONLStorage, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("jsonl storage needs -storage_dsn")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &JSONLStorage{
+		lock:      new(sync.Mutex),
+		dir:       dir,
+		clients:   &jsonlFile{kind: "clients", seen: make(map[string]*seqWindow)},
+		summaries: &jsonlFile{kind: "summaries", seen: make(map[string]*seqWindow)},
+		sessions:  &jsonlFile{kind: "sessions", seen: make(map[string]*seqWindow)},
+		open:      make(map[string]*Session),
+	}, nil
+}
+
+func (f *jsonlFile) window(node_id string) *seqWindow {
+	w := f.seen[node_id]
+	if w == nil {
+		w = &seqWindow{seqs: make(map[uint64]struct{})}
+		f.seen[node_id] = w
+	}
+	return w
+}
+
+// open switches to the file of day, reading the seqs of its tail if it
+// exists already.
+func (f *jsonlFile) open(dir, day string) error {
+	if f.fp != nil && f.day == day {
+		return nil
+	}
+	if f.fp != nil {
+		f.fp.Close()
+		f.fp = nil
+	}
+
+	filename := filepath.Join(dir, fmt.Sprintf("%s-%s.jsonl", f.kind, day))
+	fp, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if err := f.loadTail(fp); err != nil {
+		Log.Warn("can not read seqs of jsonl file", "file", filename, "err", err)
+	}
+	f.fp = fp
+	f.day = day
+	return nil
+}
+
+func (f *jsonlFile) loadTail(fp *os.File) error {
+	info, err := fp.Stat()
+	if err != nil || info.Size() == 0 {
+		return err
+	}
+	offset := info.Size() - JSONL_TAIL_SIZE
+	if offset < 0 {
+		offset = 0
+	}
+
+	reader := bufio.NewReader(io.NewSectionReader(fp, offset, info.Size()-offset))
+	if offset > 0 {
+		// skip the partial first line
+		if _, err := reader.ReadBytes('\n'); err != nil {
+			return err
+		}
+	}
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var record struct {
+			Seq    uint64 `json:"seq"`
+			NodeID string `json:"node_id"`
+		}
+		if json.Unmarshal(line, &record) == nil && record.Seq != 0 {
+			f.window(record.NodeID).Add(record.Seq)
+		}
+	}
+}
+
+// append writes v as one line unless node_id already stored seq.
+func (f *jsonlFile) append(dir string, received time.Time, node_id string, seq uint64, v interface{}) (bool, error) {
+	if err := f.open(dir, received.Format("20060102")); err != nil {
+		return false, err
+	}
+	if seq != 0 && f.window(node_id).Has(seq) {
+		return false, nil
+	}
+
+	line, err := json.Marshal(v)
+	if err != nil {
+		return false, err
+	}
+	if _, err := f.fp.Write(append(line, '\n')); err != nil {
+		return false, err
+	}
+	if seq != 0 {
+		f.window(node_id).Add(seq)
+	}
+	return true, nil
+}
+
+type jsonlClient struct {
+	*Client
+	Timestamp int64 `json:"timestamp"`
+}
+
+type jsonlSummary struct {
+	*Summary
+	Timestamp int64 `json:"timestamp"`
+}
+
+func (s *JSONLStorage) Write(records []*Record) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, record := range records {
+		if client := record.Client; client != nil {
+			stored, err := s.clients.append(s.dir, record.Received, client.NodeID, client.Seq,
+				&jsonlClient{client, record.Time().Unix()})
+			if err != nil {
+				Log.Error("can not write event", "storage", STORAGE_JSONL, "err", err)
+				return err
+			}
+			record.Duplicate = !stored
+			if !stored {
+				Log.Debug("skip duplicate event", "node", client.NodeID, "seq", client.Seq)
+			} else if sessions_enabled {
+				if err := s.updateSession(client, record.Time()); err != nil {
+					Log.Error("can not write session", "storage", STORAGE_JSONL, "err", err)
+					return err
+				}
+			}
+		}
+		if summary := record.Summary; summary != nil {
+			_, err := s.summaries.append(s.dir, record.Received, summary.NodeID, summary.Seq,
+				&jsonlSummary{summary, record.Time().Unix()})
+			if err != nil {
+				Log.Error("can not write summary", "storage", STORAGE_JSONL, "err", err)
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *JSONLStorage) updateSession(client *Client, at time.Time) error {
+	key := client.NodeID + " " + client.Addr
+	session := s.open[key]
+
+	switch client.Action {
+	case 1:
+		if session == nil {
+			session = &Session{
+				NodeID: client.NodeID,
+				Addr:   client.Addr,
+				Source: client.From,
+				Start:  at.Unix(),
+			}
+			s.open[key] = session
+		}
+		session.peak(client.RSSI)
+	case 2:
+		if session == nil {
+			Log.Debug("leave without open session", "node", client.NodeID, "addr", client.Addr)
+			return nil
+		}
+		session.peak(client.RSSI)
+		delete(s.open, key)
+		return s.closeSession(session, at, false)
+	}
+	return nil
+}
+
+func (s *JSONLStorage) closeSession(session *Session, end time.Time, expired bool) error {
+	session.End = end.Unix()
+	session.Duration = session.End - session.Start
+	session.Expired = expired
+	_, err := s.sessions.append(s.dir, end, session.NodeID, 0, session)
+	return err
+}
+
+func (s *JSONLStorage) ExpireSessions(now, before time.Time) (int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var expired int64
+	for key, session := range s.open {
+		if session.Start >= before.Unix() {
+			continue
+		}
+		delete(s.open, key)
+		if err := s.closeSession(session, now, true); err != nil {
+			return expired, err
+		}
+		expired++
+	}
+	return expired, nil
+}
+
+func (s *JSONLStorage) OpenSessions() ([]*Session, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	sessions := make([]*Session, 0, len(s.open))
+	for _, session := range s.open {
+		copied := *session
+		sessions = append(sessions, &copied)
+	}
+	return sessions, nil
+}
+
+func (s *JSONLStorage) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, f := range []*jsonlFile{s.clients, s.summaries, s.sessions} {
+		f.close()
+	}
+	return nil
+}
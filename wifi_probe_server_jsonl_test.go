@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testJSONLStorage(t *testing.T, dir string) *JSONLStorage {
+	s, err := NewJSONLStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// readLines decodes the JSON lines of the file of kind and day in dir.
+func readLines(t *testing.T, dir, kind, day string, v func() interface{}) []interface{} {
+	t.Helper()
+	fp, err := os.Open(filepath.Join(dir, kind+"-"+day+".jsonl"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+
+	var lines []interface{}
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		line := v()
+		if err := json.Unmarshal(scanner.Bytes(), line); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestJSONLWriteDedup(t *testing.T) {
+	dir := t.TempDir()
+	s := testJSONLStorage(t, dir)
+
+	writeRecords(t, s, testEvent("aa:00", 1, 60, 1, 0), testEvent("aa:01", 1, 60, 2, 0))
+	records := []*Record{testEvent("aa:01", 1, 60, 2, 0), testEvent("aa:02", 1, 60, 0, 5), testEvent("aa:02", 1, 60, 0, 5)}
+	writeRecords(t, s, records...)
+	for idx, duplicate := range []bool{true, false, false} {
+		if records[idx].Duplicate != duplicate {
+			t.Errorf("record %d: Duplicate = %v, want %v", idx, records[idx].Duplicate, duplicate)
+		}
+	}
+	s.Close()
+
+	// the seqs of the file are read back after a restart
+	s = testJSONLStorage(t, dir)
+	record := testEvent("aa:00", 1, 60, 1, 0)
+	writeRecords(t, s, record, testEvent("aa:03", 1, 60, 3, 10))
+	if !record.Duplicate {
+		t.Error("seq 1 stored again after a restart")
+	}
+	s.Close()
+
+	lines := readLines(t, dir, "clients", "20150601", func() interface{} { return new(jsonlClient) })
+	if len(lines) != 5 {
+		t.Fatalf("%d events stored, want 5", len(lines))
+	}
+	if event := lines[0].(*jsonlClient); event.Addr != "aa:00" || event.Timestamp != test_start {
+		t.Errorf("first event %+v, want aa:00 at %d", event.Client, test_start)
+	}
+}
+
+func TestJSONLSessions(t *testing.T) {
+	dir := t.TempDir()
+	s := testJSONLStorage(t, dir)
+
+	writeRecords(t, s,
+		testEvent("aa:00", 1, 70, 1, 0),
+		testEvent("aa:00", 1, 55, 2, 60),
+		testEvent("aa:00", 2, 65, 3, 300),
+		testEvent("aa:01", 2, 60, 4, 310),
+		testEvent("aa:02", 1, 60, 5, 400),
+	)
+	open, err := s.OpenSessions()
+	want := []*Session{{NodeID: TEST_NODE_ID, Addr: "aa:02", Source: "probe", Start: test_start + 400, PeakRSSI: 60}}
+	if err != nil || !reflect.DeepEqual(open, want) {
+		t.Errorf("OpenSessions() = %+v, %v, want %+v", open, err, want)
+	}
+
+	now := time.Unix(test_start+3600, 0)
+	if expired, err := s.ExpireSessions(now, time.Unix(test_start+400, 0)); err != nil || expired != 0 {
+		t.Errorf("ExpireSessions before the start = %d, %v", expired, err)
+	}
+	if expired, err := s.ExpireSessions(now, time.Unix(test_start+401, 0)); err != nil || expired != 1 {
+		t.Errorf("ExpireSessions = %d, %v, want 1", expired, err)
+	}
+	s.Close()
+
+	var sessions []Session
+	for _, line := range readLines(t, dir, "sessions", "20150601", func() interface{} { return new(Session) }) {
+		sessions = append(sessions, *line.(*Session))
+	}
+	closed := []Session{
+		{NodeID: TEST_NODE_ID, Addr: "aa:00", Source: "probe", Start: test_start, End: test_start + 300,
+			Duration: 300, PeakRSSI: 55},
+		{NodeID: TEST_NODE_ID, Addr: "aa:02", Source: "probe", Start: test_start + 400, End: now.Unix(),
+			Duration: 3200, PeakRSSI: 60, Expired: true},
+	}
+	if !reflect.DeepEqual(sessions, closed) {
+		t.Errorf("sessions\n%+v\nwant\n%+v", sessions, closed)
+	}
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// The live hub streams every event as it is stored, duplicates left out, to
+// subscribers on the HTTP listener:
+//
+//	GET /api/v1/live      Server-Sent Events, one "event" message per event
+//	GET /api/v1/live/ws   WebSocket, one JSON text message per event
+//
+// Events have the format of the jsonl storage:
+//
+//	{"seq":17,"node_id":"...","addr":"...","from":"probe","rssi":61,"action":1,"timestamp":1433160000}
+//
+// A join of a device present at another node is a zone change, the event
+// names the node it came from:
+//
+//	{"seq":18,"node_id":"...","addr":"...","from":"probe","rssi":58,"action":1,"timestamp":1433160060,"from_node":"..."}
+//
+// The hub follows the node of each present device from the joins and leaves
+// it streams, starting from the open sessions; a device is present until it
+// leaves or -session_timeout after it joined, like its session.
+//
+// Subscribers filter with node (comma separated node ids), action (1 or join,
+// 2 or leave, zone for zone changes only) and addr_prefix, e.g. "00:1b:63"
+// for one vendor, and authenticate like the query API. The node filter
+// selects the node joined, a node token sees zone changes into its node.
+//
+// The hub never waits for a subscriber. One which falls LIVE_BUFFER events
+// behind is dropped, it gets a "dropped" message or close frame and can
+// reconnect.
+const (
+	LIVE_BUFFER          = 256
+	LIVE_KEEPALIVE       = 15 * time.Second
+	LIVE_WRITE_TIMEOUT   = 10 * time.Second
+	LIVE_MAX_SUBSCRIBERS = 256
+)
+
+var live_hub = NewLiveHub()
+
+type liveSubscriber struct {
+	nodes  map[string]bool // empty for every node
+	action int             // 0 for every action
+	zone   bool            // zone changes only
+	prefix string          // lower case
+
+	events  chan *liveEvent
+	dropped chan struct{} // closed when the hub dropped the subscriber
+}
+
+func (sub *liveSubscriber) match(event *liveEvent) bool {
+	client := event.Client
+	if len(sub.nodes) > 0 && !sub.nodes[client.NodeID] {
+		return false
+	}
+	if sub.action != 0 && client.Action != sub.action {
+		return false
+	}
+	if sub.zone && event.FromNode == "" {
+		return false
+	}
+	return strings.HasPrefix(strings.ToLower(client.Addr), sub.prefix)
+}
+
+// liveEvent is an event as streamed, FromNode is set on zone changes.
+type liveEvent struct {
+	*jsonlClient
+	FromNode string `json:"from_node,omitempty"`
+}
+
+// liveZone is the node a device is present at since its join.
+type liveZone struct {
+	node  string
+	since int64
+}
+
+type LiveHub struct {
+	lock        *sync.Mutex
+	subscribers map[*liveSubscriber]struct{}
+	zones       map[string]liveZone // by addr
+	swept       int64               // unix time zones were last expired
+}
+
+func NewLiveHub() *LiveHub {
+	return &LiveHub{
+		lock:        new(sync.Mutex),
+		subscribers: make(map[*liveSubscriber]struct{}),
+		zones:       make(map[string]liveZone),
+	}
+}
+
+// Load sets the zones of the devices with open sessions.
+func (h *LiveHub) Load(sessions []*Session) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for _, session := range sessions {
+		if zone, ok := h.zones[session.Addr]; !ok || session.Start > zone.since {
+			h.zones[session.Addr] = liveZone{session.NodeID, session.Start}
+		}
+	}
+}
+
+// zoneExpired tells whether a device joined at since is no longer present
+// at now without a leave.
+func zoneExpired(since, now int64) bool {
+	return session_timeout > 0 && now-since >= int64(session_timeout/time.Second)
+}
+
+// zoneChange follows the zone of the device of client and returns the node
+// it moved from, "" if it did not.
+func (h *LiveHub) zoneChange(client *Client, now int64) string {
+	if now-h.swept >= int64(SESSION_EXPIRE_INTERVAL/time.Second) {
+		for addr, zone := range h.zones {
+			if zoneExpired(zone.since, now) {
+				delete(h.zones, addr)
+			}
+		}
+		h.swept = now
+	}
+
+	zone, present := h.zones[client.Addr]
+	present = present && !zoneExpired(zone.since, now)
+	switch client.Action {
+	case 1:
+		if present && zone.node == client.NodeID {
+			return ""
+		}
+		h.zones[client.Addr] = liveZone{client.NodeID, now}
+		if present {
+			return zone.node
+		}
+	case 2:
+		if zone.node == client.NodeID {
+			delete(h.zones, client.Addr)
+		}
+	}
+	return ""
+}
+
+func (h *LiveHub) Subscribe(sub *liveSubscriber) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if len(h.subscribers) >= LIVE_MAX_SUBSCRIBERS {
+		return fmt.Errorf("too many subscribers")
+	}
+	sub.events = make(chan *liveEvent, LIVE_BUFFER)
+	sub.dropped = make(chan struct{})
+	h.subscribers[sub] = struct{}{}
+	return nil
+}
+
+func (h *LiveHub) Unsubscribe(sub *liveSubscriber) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	delete(h.subscribers, sub)
+}
+
+// Observe is the writer observer, it publishes the stored events.
+func (h *LiveHub) Observe(record *Record) {
+	client := record.Client
+	if client == nil {
+		return
+	}
+	now := record.Time().Unix()
+	event := &liveEvent{jsonlClient: &jsonlClient{client, now}}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	event.FromNode = h.zoneChange(client, now)
+	for sub := range h.subscribers {
+		if !sub.match(event) {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+			delete(h.subscribers, sub)
+			close(sub.dropped)
+		}
+	}
+}
+
+// parseLiveFilter reads the filter parameters, restricted to the node of
+// the token.
+func parseLiveFilter(r *http.Request, token_node string) (*liveSubscriber, error) {
+	params := r.URL.Query()
+	sub := &liveSubscriber{
+		nodes:  make(map[string]bool),
+		prefix: strings.ToLower(params.Get("addr_prefix")),
+	}
+	for _, value := range params["node"] {
+		for _, node_id := range strings.Split(value, ",") {
+			if node_id = strings.TrimSpace(node_id); node_id != "" {
+				sub.nodes[node_id] = true
+			}
+		}
+	}
+	if token_node != "" {
+		for node_id := range sub.nodes {
+			if node_id != token_node {
+				return nil, fmt.Errorf("token is bound to node %q", token_node)
+			}
+		}
+		sub.nodes[token_node] = true
+	}
+
+	switch action := params.Get("action"); action {
+	case "":
+	case "join":
+		sub.action = 1
+	case "leave":
+		sub.action = 2
+	case "zone":
+		sub.action = 1
+		sub.zone = true
+	default:
+		n, err := strconv.Atoi(action)
+		if err != nil || n != 1 && n != 2 {
+			return nil, fmt.Errorf("action must be 1, 2, join, leave or zone")
+		}
+		sub.action = n
+	}
+	return sub, nil
+}
+
+// liveSubscribe authenticates a live request and subscribes it, it responds
+// itself and returns nil on failure.
+func liveSubscribe(w http.ResponseWriter, r *http.Request) *liveSubscriber {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeJSON(w, http.StatusMethodNotAllowed, &apiError{Error: "use GET"})
+		return nil
+	}
+	node_id, ok := authenticateRead(r)
+	if !ok {
+		Log.Warn("live subscriber with bad token", "remote", r.RemoteAddr)
+		writeJSON(w, http.StatusUnauthorized, &apiError{Error: "bad token"})
+		return nil
+	}
+	sub, err := parseLiveFilter(r, node_id)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, &apiError{Error: err.Error()})
+		return nil
+	}
+	if err := live_hub.Subscribe(sub); err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, &apiError{Error: err.Error()})
+		return nil
+	}
+	return sub
+}
+
+// writeSSE writes frame to the event stream w and flushes it, failing if
+// the subscriber does not take it within LIVE_WRITE_TIMEOUT.
+func writeSSE(w http.ResponseWriter, frame string) error {
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Now().Add(LIVE_WRITE_TIMEOUT)); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, frame); err != nil {
+		return err
+	}
+	return rc.Flush()
+}
+
+func HandleLiveSSE(w http.ResponseWriter, r *http.Request) {
+	if _, ok := w.(http.Flusher); !ok {
+		writeJSON(w, http.StatusInternalServerError, &apiError{Error: "streaming not supported"})
+		return
+	}
+	sub := liveSubscribe(w, r)
+	if sub == nil {
+		return
+	}
+	defer live_hub.Unsubscribe(sub)
+	log := Log.With("remote", r.RemoteAddr, "live", "sse")
+	log.Info("live subscriber connected")
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := writeSSE(w, ": connected\n\n"); err != nil {
+		log.Info("live subscriber gone", "err", err)
+		return
+	}
+
+	keepalive := time.NewTicker(LIVE_KEEPALIVE)
+	defer keepalive.Stop()
+	for {
+		var frame string
+		select {
+		case event := <-sub.events:
+			data, err := json.Marshal(event)
+			if err != nil {
+				log.Warn("can not encode live event", "err", err)
+				continue
+			}
+			frame = fmt.Sprintf("event: event\ndata: %s\n\n", data)
+		case <-keepalive.C:
+			frame = ": keepalive\n\n"
+		case <-sub.dropped:
+			log.Warn("live subscriber too slow, dropped")
+			writeSSE(w, "event: dropped\ndata: {\"error\":\"too slow\"}\n\n")
+			return
+		case <-r.Context().Done():
+			log.Info("live subscriber disconnected")
+			return
+		}
+		if err := writeSSE(w, frame); err != nil {
+			log.Info("live subscriber gone", "err", err)
+			return
+		}
+	}
+}
+
+var live_upgrader = websocket.Upgrader{
+	// tokens instead of cookies, any origin may subscribe with one
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+func HandleLiveWS(w http.ResponseWriter, r *http.Request) {
+	sub := liveSubscribe(w, r)
+	if sub == nil {
+		return
+	}
+	defer live_hub.Unsubscribe(sub)
+	log := Log.With("remote", r.RemoteAddr, "live", "ws")
+
+	conn, err := live_upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Warn("websocket upgrade failed", "err", err)
+		return
+	}
+	defer conn.Close()
+	log.Info("live subscriber connected")
+
+	// reads only handle control frames, they end with the connection
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	keepalive := time.NewTicker(LIVE_KEEPALIVE)
+	defer keepalive.Stop()
+	for {
+		var err error
+		select {
+		case event := <-sub.events:
+			conn.SetWriteDeadline(time.Now().Add(LIVE_WRITE_TIMEOUT))
+			err = conn.WriteJSON(event)
+		case <-keepalive.C:
+			err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(LIVE_WRITE_TIMEOUT))
+		case <-sub.dropped:
+			log.Warn("live subscriber too slow, dropped")
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "too slow"),
+				time.Now().Add(LIVE_WRITE_TIMEOUT))
+			return
+		case <-closed:
+			log.Info("live subscriber disconnected")
+			return
+		}
+		if err != nil {
+			log.Info("live subscriber gone", "err", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,739 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The server owns the schema of the SQL storages. Migrations are numbered,
+// the applied ones are recorded in schema_migrations and every pending one
+// is applied at startup unless -auto_migrate=false. The migrate command
+// shows and changes the state by hand:
+//
+//	wifi_probe_server -storage sqlite -storage_dsn probe.db migrate status
+//	wifi_probe_server ... migrate up         apply pending migrations
+//	wifi_probe_server ... migrate down       roll back the latest migration
+//	wifi_probe_server ... migrate down 1     roll back to version 1
+//
+// Rewriting the rows of big tables is left to commands of their own which
+// work in batches while the server runs:
+//
+//	wifi_probe_server ... normalize-rssi dry-run|now   positive rssi, see migration 5
+//
+// In statements {clients} and {summaries} stand for the tables of
+// -mysql_table and -mysql_summary_table. MySQL commits every schema change
+// on its own, so a migration failing there halfway has to be cleaned up by
+// hand; PostgreSQL and SQLite roll it back.
+type migration struct {
+	version int
+	name    string
+	up      map[string][]string // dialect name -> statements
+	down    map[string][]string
+
+	// skip reports a database which already has the change, e.g. from an
+	// older server creating tables itself; the migration is only recorded
+	skip func(s *SQLStorage) (bool, error)
+
+	// skip_table reports a table of {clients} and {summaries} which has the
+	// change already, the statements on it are left out
+	skip_table func(s *SQLStorage, table string) (bool, error)
+}
+
+var auto_migrate bool
+
+func init() {
+	flag.BoolVar(&auto_migrate, "auto_migrate", true, "apply pending schema migrations at startup")
+}
+
+var migrations = []*migration{
+	{
+		version: 1,
+		name:    "create clients and summaries",
+		up: map[string][]string{
+			STORAGE_MYSQL: {
+				"CREATE TABLE IF NOT EXISTS `{clients}` (" +
+					"`id` int(11) NOT NULL AUTO_INCREMENT, `nodeid` varchar(128) NOT NULL, " +
+					"`addr` varchar(128) NOT NULL, `from` varchar(128) NOT NULL, `model` varchar(128) NOT NULL, " +
+					"`rssi` int(11) NOT NULL, `ssid` varchar(128) DEFAULT NULL, `action` int(11) DEFAULT NULL, " +
+					"`timestamp` int(64) NOT NULL, `time` varchar(128) NOT NULL, PRIMARY KEY (`id`)" +
+					") ENGINE=InnoDB DEFAULT CHARSET=utf8",
+				"CREATE TABLE IF NOT EXISTS `{summaries}` (" +
+					"`id` int(11) NOT NULL AUTO_INCREMENT, `nodeid` varchar(128) NOT NULL, " +
+					"`start` int(64) NOT NULL, `interval` int(11) NOT NULL, `devices` int(11) NOT NULL, " +
+					"`joins` int(11) NOT NULL, `leaves` int(11) NOT NULL, `rssi_hist` text NOT NULL, " +
+					"`ssid_hist` text NOT NULL, `timestamp` int(64) NOT NULL, `time` varchar(128) NOT NULL, " +
+					"PRIMARY KEY (`id`), KEY `nodeid_start` (`nodeid`, `start`)" +
+					") ENGINE=InnoDB DEFAULT CHARSET=utf8",
+			},
+			STORAGE_POSTGRES: {
+				`CREATE TABLE IF NOT EXISTS "{clients}" (` +
+					`"id" bigserial PRIMARY KEY, "nodeid" varchar(128) NOT NULL, "addr" varchar(128) NOT NULL, ` +
+					`"from" varchar(128) NOT NULL, "model" varchar(128) NOT NULL, "rssi" integer NOT NULL, ` +
+					`"ssid" varchar(128), "action" integer, "timestamp" bigint NOT NULL, "time" varchar(128) NOT NULL)`,
+				`CREATE TABLE IF NOT EXISTS "{summaries}" (` +
+					`"id" bigserial PRIMARY KEY, "nodeid" varchar(128) NOT NULL, "start" bigint NOT NULL, ` +
+					`"interval" integer NOT NULL, "devices" integer NOT NULL, "joins" integer NOT NULL, ` +
+					`"leaves" integer NOT NULL, "rssi_hist" text NOT NULL, "ssid_hist" text NOT NULL, ` +
+					`"timestamp" bigint NOT NULL, "time" varchar(128) NOT NULL)`,
+				`CREATE INDEX IF NOT EXISTS "{summaries}_nodeid_start" ON "{summaries}" ("nodeid", "start")`,
+			},
+			STORAGE_SQLITE: {
+				`CREATE TABLE IF NOT EXISTS "{clients}" (` +
+					`"id" INTEGER PRIMARY KEY AUTOINCREMENT, "nodeid" TEXT NOT NULL, "addr" TEXT NOT NULL, ` +
+					`"from" TEXT NOT NULL, "model" TEXT NOT NULL, "rssi" INTEGER NOT NULL, "ssid" TEXT, ` +
+					`"action" INTEGER, "timestamp" INTEGER NOT NULL, "time" TEXT NOT NULL)`,
+				`CREATE TABLE IF NOT EXISTS "{summaries}" (` +
+					`"id" INTEGER PRIMARY KEY AUTOINCREMENT, "nodeid" TEXT NOT NULL, "start" INTEGER NOT NULL, ` +
+					`"interval" INTEGER NOT NULL, "devices" INTEGER NOT NULL, "joins" INTEGER NOT NULL, ` +
+					`"leaves" INTEGER NOT NULL, "rssi_hist" TEXT NOT NULL, "ssid_hist" TEXT NOT NULL, ` +
+					`"timestamp" INTEGER NOT NULL, "time" TEXT NOT NULL)`,
+				`CREATE INDEX IF NOT EXISTS "{summaries}_nodeid_start" ON "{summaries}" ("nodeid", "start")`,
+			},
+		},
+		down: map[string][]string{
+			STORAGE_MYSQL:    {"DROP TABLE `{summaries}`", "DROP TABLE `{clients}`"},
+			STORAGE_POSTGRES: {`DROP TABLE "{summaries}"`, `DROP TABLE "{clients}"`},
+			STORAGE_SQLITE:   {`DROP TABLE "{summaries}"`, `DROP TABLE "{clients}"`},
+		},
+	},
+	{
+		version: 2,
+		name:    "add seq to clients and summaries",
+		up: map[string][]string{
+			STORAGE_MYSQL: {
+				"ALTER TABLE `{clients}` ADD `seq` bigint unsigned DEFAULT NULL, ADD UNIQUE KEY `nodeid_seq` (`nodeid`, `seq`)",
+				"ALTER TABLE `{summaries}` ADD `seq` bigint unsigned DEFAULT NULL, ADD UNIQUE KEY `nodeid_seq` (`nodeid`, `seq`)",
+			},
+			STORAGE_POSTGRES: {
+				`ALTER TABLE "{clients}" ADD "seq" bigint`,
+				`CREATE UNIQUE INDEX "{clients}_nodeid_seq" ON "{clients}" ("nodeid", "seq")`,
+				`ALTER TABLE "{summaries}" ADD "seq" bigint`,
+				`CREATE UNIQUE INDEX "{summaries}_nodeid_seq" ON "{summaries}" ("nodeid", "seq")`,
+			},
+			STORAGE_SQLITE: {
+				`ALTER TABLE "{clients}" ADD "seq" INTEGER`,
+				`CREATE UNIQUE INDEX "{clients}_nodeid_seq" ON "{clients}" ("nodeid", "seq")`,
+				`ALTER TABLE "{summaries}" ADD "seq" INTEGER`,
+				`CREATE UNIQUE INDEX "{summaries}_nodeid_seq" ON "{summaries}" ("nodeid", "seq")`,
+			},
+		},
+		down: map[string][]string{
+			STORAGE_MYSQL: {
+				"ALTER TABLE `{clients}` DROP KEY `nodeid_seq`, DROP `seq`",
+				"ALTER TABLE `{summaries}` DROP KEY `nodeid_seq`, DROP `seq`",
+			},
+			STORAGE_POSTGRES: {
+				`DROP INDEX IF EXISTS "{clients}_nodeid_seq"`,
+				`ALTER TABLE "{clients}" DROP "seq"`,
+				`DROP INDEX IF EXISTS "{summaries}_nodeid_seq"`,
+				`ALTER TABLE "{summaries}" DROP "seq"`,
+			},
+			STORAGE_SQLITE: {
+				`DROP INDEX IF EXISTS "{clients}_nodeid_seq"`,
+				`ALTER TABLE "{clients}" DROP "seq"`,
+				`DROP INDEX IF EXISTS "{summaries}_nodeid_seq"`,
+				`ALTER TABLE "{summaries}" DROP "seq"`,
+			},
+		},
+		// tables of the old probe_install.sql or of servers creating their
+		// tables themselves have seq already, tables upgraded by hand may
+		// have it in only one of them
+		skip_table: func(s *SQLStorage, table string) (bool, error) {
+			return s.HasColumn(table, "seq")
+		},
+	},
+	{
+		version: 3,
+		name:    "create sessions",
+		up: map[string][]string{
+			STORAGE_MYSQL: {
+				"CREATE TABLE IF NOT EXISTS `sessions` (" +
+					"`id` bigint NOT NULL AUTO_INCREMENT, `nodeid` varchar(128) NOT NULL, " +
+					"`addr` varchar(128) NOT NULL, `source` varchar(128) NOT NULL, `start` bigint NOT NULL, " +
+					"`end` bigint DEFAULT NULL, `duration` int(11) DEFAULT NULL, `peak_rssi` int(11) NOT NULL, " +
+					"`expired` tinyint NOT NULL DEFAULT 0, PRIMARY KEY (`id`), " +
+					"KEY `open` (`nodeid`, `addr`, `end`), KEY `start` (`start`)" +
+					") ENGINE=InnoDB DEFAULT CHARSET=utf8",
+			},
+			STORAGE_POSTGRES: {
+				`CREATE TABLE IF NOT EXISTS "sessions" (` +
+					`"id" bigserial PRIMARY KEY, "nodeid" varchar(128) NOT NULL, "addr" varchar(128) NOT NULL, ` +
+					`"source" varchar(128) NOT NULL, "start" bigint NOT NULL, "end" bigint, "duration" integer, ` +
+					`"peak_rssi" integer NOT NULL, "expired" smallint NOT NULL DEFAULT 0)`,
+				`CREATE INDEX IF NOT EXISTS "sessions_open" ON "sessions" ("nodeid", "addr", "end")`,
+				`CREATE INDEX IF NOT EXISTS "sessions_start" ON "sessions" ("start")`,
+			},
+			STORAGE_SQLITE: {
+				`CREATE TABLE IF NOT EXISTS "sessions" (` +
+					`"id" INTEGER PRIMARY KEY AUTOINCREMENT, "nodeid" TEXT NOT NULL, "addr" TEXT NOT NULL, ` +
+					`"source" TEXT NOT NULL, "start" INTEGER NOT NULL, "end" INTEGER, "duration" INTEGER, ` +
+					`"peak_rssi" INTEGER NOT NULL, "expired" INTEGER NOT NULL DEFAULT 0)`,
+				`CREATE INDEX IF NOT EXISTS "sessions_open" ON "sessions" ("nodeid", "addr", "end")`,
+				`CREATE INDEX IF NOT EXISTS "sessions_start" ON "sessions" ("start")`,
+			},
+		},
+		down: map[string][]string{
+			STORAGE_MYSQL:    {"DROP TABLE `sessions`"},
+			STORAGE_POSTGRES: {`DROP TABLE "sessions"`},
+			STORAGE_SQLITE:   {`DROP TABLE "sessions"`},
+		},
+	},
+	{
+		version: 4,
+		name:    "create visitor rollups",
+		up: map[string][]string{
+			STORAGE_MYSQL: {
+				"CREATE TABLE IF NOT EXISTS `rollups` (" +
+					"`id` bigint NOT NULL AUTO_INCREMENT, `nodeid` varchar(128) NOT NULL, " +
+					"`period` varchar(8) NOT NULL, `start` bigint NOT NULL, " +
+					"`visitors` int(11) NOT NULL DEFAULT 0, `new_visitors` int(11) NOT NULL DEFAULT 0, " +
+					"`returning_visitors` int(11) NOT NULL DEFAULT 0, `sessions` int(11) NOT NULL DEFAULT 0, " +
+					"`dwell_total` bigint NOT NULL DEFAULT 0, `dwell_p50` int(11) NOT NULL DEFAULT 0, " +
+					"`dwell_p90` int(11) NOT NULL DEFAULT 0, `dwell_p99` int(11) NOT NULL DEFAULT 0, " +
+					"`dwell_hist` text NOT NULL, PRIMARY KEY (`id`), " +
+					"UNIQUE KEY `nodeid_period_start` (`nodeid`, `period`, `start`), KEY `period_start` (`period`, `start`)" +
+					") ENGINE=InnoDB DEFAULT CHARSET=utf8",
+				"CREATE TABLE IF NOT EXISTS `visitors` (" +
+					"`id` bigint NOT NULL AUTO_INCREMENT, `nodeid` varchar(128) NOT NULL, " +
+					"`addr` varchar(128) NOT NULL, `first_seen` bigint NOT NULL, PRIMARY KEY (`id`), " +
+					"UNIQUE KEY `nodeid_addr` (`nodeid`, `addr`)" +
+					") ENGINE=InnoDB DEFAULT CHARSET=utf8",
+				"CREATE TABLE IF NOT EXISTS `rollup_visitors` (" +
+					"`id` bigint NOT NULL AUTO_INCREMENT, `nodeid` varchar(128) NOT NULL, " +
+					"`period` varchar(8) NOT NULL, `start` bigint NOT NULL, `addr` varchar(128) NOT NULL, " +
+					"PRIMARY KEY (`id`), UNIQUE KEY `nodeid_period_start_addr` (`nodeid`, `period`, `start`, `addr`), " +
+					"KEY `start` (`start`)" +
+					") ENGINE=InnoDB DEFAULT CHARSET=utf8",
+			},
+			STORAGE_POSTGRES: {
+				`CREATE TABLE IF NOT EXISTS "rollups" (` +
+					`"id" bigserial PRIMARY KEY, "nodeid" varchar(128) NOT NULL, "period" varchar(8) NOT NULL, ` +
+					`"start" bigint NOT NULL, "visitors" integer NOT NULL DEFAULT 0, ` +
+					`"new_visitors" integer NOT NULL DEFAULT 0, "returning_visitors" integer NOT NULL DEFAULT 0, ` +
+					`"sessions" integer NOT NULL DEFAULT 0, "dwell_total" bigint NOT NULL DEFAULT 0, ` +
+					`"dwell_p50" integer NOT NULL DEFAULT 0, "dwell_p90" integer NOT NULL DEFAULT 0, ` +
+					`"dwell_p99" integer NOT NULL DEFAULT 0, "dwell_hist" text NOT NULL)`,
+				`CREATE UNIQUE INDEX IF NOT EXISTS "rollups_nodeid_period_start" ON "rollups" ("nodeid", "period", "start")`,
+				`CREATE INDEX IF NOT EXISTS "rollups_period_start" ON "rollups" ("period", "start")`,
+				`CREATE TABLE IF NOT EXISTS "visitors" (` +
+					`"id" bigserial PRIMARY KEY, "nodeid" varchar(128) NOT NULL, "addr" varchar(128) NOT NULL, ` +
+					`"first_seen" bigint NOT NULL)`,
+				`CREATE UNIQUE INDEX IF NOT EXISTS "visitors_nodeid_addr" ON "visitors" ("nodeid", "addr")`,
+				`CREATE TABLE IF NOT EXISTS "rollup_visitors" (` +
+					`"id" bigserial PRIMARY KEY, "nodeid" varchar(128) NOT NULL, "period" varchar(8) NOT NULL, ` +
+					`"start" bigint NOT NULL, "addr" varchar(128) NOT NULL)`,
+				`CREATE UNIQUE INDEX IF NOT EXISTS "rollup_visitors_key" ON "rollup_visitors" ("nodeid", "period", "start", "addr")`,
+				`CREATE INDEX IF NOT EXISTS "rollup_visitors_start" ON "rollup_visitors" ("start")`,
+			},
+			STORAGE_SQLITE: {
+				`CREATE TABLE IF NOT EXISTS "rollups" (` +
+					`"id" INTEGER PRIMARY KEY AUTOINCREMENT, "nodeid" TEXT NOT NULL, "period" TEXT NOT NULL, ` +
+					`"start" INTEGER NOT NULL, "visitors" INTEGER NOT NULL DEFAULT 0, ` +
+					`"new_visitors" INTEGER NOT NULL DEFAULT 0, "returning_visitors" INTEGER NOT NULL DEFAULT 0, ` +
+					`"sessions" INTEGER NOT NULL DEFAULT 0, "dwell_total" INTEGER NOT NULL DEFAULT 0, ` +
+					`"dwell_p50" INTEGER NOT NULL DEFAULT 0, "dwell_p90" INTEGER NOT NULL DEFAULT 0, ` +
+					`"dwell_p99" INTEGER NOT NULL DEFAULT 0, "dwell_hist" TEXT NOT NULL)`,
+				`CREATE UNIQUE INDEX IF NOT EXISTS "rollups_nodeid_period_start" ON "rollups" ("nodeid", "period", "start")`,
+				`CREATE INDEX IF NOT EXISTS "rollups_period_start" ON "rollups" ("period", "start")`,
+				`CREATE TABLE IF NOT EXISTS "visitors" (` +
+					`"id" INTEGER PRIMARY KEY AUTOINCREMENT, "nodeid" TEXT NOT NULL, "addr" TEXT NOT NULL, ` +
+					`"first_seen" INTEGER NOT NULL)`,
+				`CREATE UNIQUE INDEX IF NOT EXISTS "visitors_nodeid_addr" ON "visitors" ("nodeid", "addr")`,
+				`CREATE TABLE IF NOT EXISTS "rollup_visitors" (` +
+					`"id" INTEGER PRIMARY KEY AUTOINCREMENT, "nodeid" TEXT NOT NULL, "period" TEXT NOT NULL, ` +
+					`"start" INTEGER NOT NULL, "addr" TEXT NOT NULL)`,
+				`CREATE UNIQUE INDEX IF NOT EXISTS "rollup_visitors_key" ON "rollup_visitors" ("nodeid", "period", "start", "addr")`,
+				`CREATE INDEX IF NOT EXISTS "rollup_visitors_start" ON "rollup_visitors" ("start")`,
+			},
+		},
+		down: map[string][]string{
+			STORAGE_MYSQL:    {"DROP TABLE `rollup_visitors`", "DROP TABLE `visitors`", "DROP TABLE `rollups`"},
+			STORAGE_POSTGRES: {`DROP TABLE "rollup_visitors"`, `DROP TABLE "visitors"`, `DROP TABLE "rollups"`},
+			STORAGE_SQLITE:   {`DROP TABLE "rollup_visitors"`, `DROP TABLE "visitors"`, `DROP TABLE "rollups"`},
+		},
+	},
+	{
+		// the HTTP ingest stored negative dBm as sent, events are stored
+		// as positive magnitude like the nodes send them. Updating every
+		// row at startup would hold up the server on a big table, so the
+		// migration only records the version; the normalize-rssi command
+		// converts the old rows in batches
+		version: 5,
+		name:    "positive rssi",
+	},
+	{
+		// the columns retention selects on
+		version: 6,
+		name:    "index retention columns",
+		up: map[string][]string{
+			STORAGE_MYSQL: {
+				"ALTER TABLE `{clients}` ADD KEY `timestamp` (`timestamp`)",
+				"ALTER TABLE `{summaries}` ADD KEY `timestamp` (`timestamp`)",
+				"ALTER TABLE `sessions` ADD KEY `end` (`end`)",
+			},
+			STORAGE_POSTGRES: {
+				`CREATE INDEX IF NOT EXISTS "{clients}_timestamp" ON "{clients}" ("timestamp")`,
+				`CREATE INDEX IF NOT EXISTS "{summaries}_timestamp" ON "{summaries}" ("timestamp")`,
+				`CREATE INDEX IF NOT EXISTS "sessions_end" ON "sessions" ("end")`,
+			},
+			STORAGE_SQLITE: {
+				`CREATE INDEX IF NOT EXISTS "{clients}_timestamp" ON "{clients}" ("timestamp")`,
+				`CREATE INDEX IF NOT EXISTS "{summaries}_timestamp" ON "{summaries}" ("timestamp")`,
+				`CREATE INDEX IF NOT EXISTS "sessions_end" ON "sessions" ("end")`,
+			},
+		},
+		down: map[string][]string{
+			STORAGE_MYSQL: {
+				"ALTER TABLE `sessions` DROP KEY `end`",
+				"ALTER TABLE `{summaries}` DROP KEY `timestamp`",
+				"ALTER TABLE `{clients}` DROP KEY `timestamp`",
+			},
+			STORAGE_POSTGRES: {
+				`DROP INDEX IF EXISTS "sessions_end"`,
+				`DROP INDEX IF EXISTS "{summaries}_timestamp"`,
+				`DROP INDEX IF EXISTS "{clients}_timestamp"`,
+			},
+			STORAGE_SQLITE: {
+				`DROP INDEX IF EXISTS "sessions_end"`,
+				`DROP INDEX IF EXISTS "{summaries}_timestamp"`,
+				`DROP INDEX IF EXISTS "{clients}_timestamp"`,
+			},
+		},
+	},
+	{
+		// PostgreSQL only, see wifi_probe_server_retention.go. The table so
+		// far becomes the partition of everything up to its last event,
+		// attaching it reads it once but copies nothing. A unique key of the
+		// partitioned table has to include the timestamp, so (nodeid, seq)
+		// becomes (nodeid, seq, timestamp); down fails if duplicates of
+		// (nodeid, seq) were stored since.
+		version: 7,
+		name:    "partition events by day",
+		up: map[string][]string{
+			STORAGE_POSTGRES: {
+				`ALTER TABLE "{clients}" RENAME TO "{clients}_before"`,
+				`ALTER INDEX IF EXISTS "{clients}_pkey" RENAME TO "{clients}_before_pkey"`,
+				`ALTER INDEX IF EXISTS "{clients}_nodeid_seq" RENAME TO "{clients}_before_nodeid_seq"`,
+				`ALTER INDEX IF EXISTS "{clients}_timestamp" RENAME TO "{clients}_before_timestamp"`,
+				`CREATE TABLE "{clients}" (LIKE "{clients}_before" INCLUDING DEFAULTS) PARTITION BY RANGE ("timestamp")`,
+				`ALTER SEQUENCE "{clients}_id_seq" OWNED BY "{clients}"."id"`,
+				`CREATE INDEX "{clients}_id" ON "{clients}" ("id")`,
+				`CREATE UNIQUE INDEX "{clients}_nodeid_seq" ON "{clients}" ("nodeid", "seq", "timestamp")`,
+				`CREATE INDEX "{clients}_timestamp" ON "{clients}" ("timestamp")`,
+				`DO $$ DECLARE cutoff bigint; BEGIN ` +
+					`SELECT COALESCE(MAX("timestamp"), 0) + 1 INTO cutoff FROM "{clients}_before"; ` +
+					`EXECUTE format('ALTER TABLE %I ATTACH PARTITION %I FOR VALUES FROM (MINVALUE) TO (%s)', ` +
+					`'{clients}', '{clients}_before', cutoff); END $$`,
+				`CREATE TABLE "{clients}_default" PARTITION OF "{clients}" DEFAULT`,
+			},
+		},
+		down: map[string][]string{
+			STORAGE_POSTGRES: {
+				`ALTER TABLE "{clients}" RENAME TO "{clients}_partitioned"`,
+				`CREATE TABLE "{clients}" (LIKE "{clients}_partitioned" INCLUDING DEFAULTS)`,
+				`INSERT INTO "{clients}" SELECT * FROM "{clients}_partitioned"`,
+				`ALTER SEQUENCE "{clients}_id_seq" OWNED BY "{clients}"."id"`,
+				`DROP TABLE "{clients}_partitioned"`,
+				`ALTER TABLE "{clients}" ADD PRIMARY KEY ("id")`,
+				`CREATE UNIQUE INDEX "{clients}_nodeid_seq" ON "{clients}" ("nodeid", "seq")`,
+				`CREATE INDEX "{clients}_timestamp" ON "{clients}" ("timestamp")`,
+			},
+		},
+	}, {
+		// totals of the nodes list, counted on insert, rather than grouping
+		// every event on each request
+		version: 8,
+		name:    "node totals",
+		up: map[string][]string{
+			STORAGE_MYSQL: {
+				"CREATE TABLE IF NOT EXISTS `nodes` (" +
+					"`id` bigint NOT NULL AUTO_INCREMENT, `nodeid` varchar(128) NOT NULL, " +
+					"`first_seen` bigint NOT NULL, `last_seen` bigint NOT NULL, `events` bigint NOT NULL DEFAULT 0, " +
+					"PRIMARY KEY (`id`), UNIQUE KEY `nodeid` (`nodeid`)" +
+					") ENGINE=InnoDB DEFAULT CHARSET=utf8",
+				"INSERT INTO `nodes` (`nodeid`, `first_seen`, `last_seen`, `events`) " +
+					"SELECT `nodeid`, MIN(`timestamp`), MAX(`timestamp`), COUNT(*) FROM `{clients}` GROUP BY `nodeid`",
+			},
+			STORAGE_POSTGRES: {
+				`CREATE TABLE IF NOT EXISTS "nodes" (` +
+					`"id" bigserial PRIMARY KEY, "nodeid" varchar(128) NOT NULL, "first_seen" bigint NOT NULL, ` +
+					`"last_seen" bigint NOT NULL, "events" bigint NOT NULL DEFAULT 0)`,
+				`CREATE UNIQUE INDEX IF NOT EXISTS "nodes_nodeid" ON "nodes" ("nodeid")`,
+				`INSERT INTO "nodes" ("nodeid", "first_seen", "last_seen", "events") ` +
+					`SELECT "nodeid", MIN("timestamp"), MAX("timestamp"), COUNT(*) FROM "{clients}" GROUP BY "nodeid"`,
+			},
+			STORAGE_SQLITE: {
+				`CREATE TABLE IF NOT EXISTS "nodes" (` +
+					`"id" INTEGER PRIMARY KEY AUTOINCREMENT, "nodeid" TEXT NOT NULL, "first_seen" INTEGER NOT NULL, ` +
+					`"last_seen" INTEGER NOT NULL, "events" INTEGER NOT NULL DEFAULT 0)`,
+				`CREATE UNIQUE INDEX IF NOT EXISTS "nodes_nodeid" ON "nodes" ("nodeid")`,
+				`INSERT INTO "nodes" ("nodeid", "first_seen", "last_seen", "events") ` +
+					`SELECT "nodeid", MIN("timestamp"), MAX("timestamp"), COUNT(*) FROM "{clients}" GROUP BY "nodeid"`,
+			},
+		},
+		down: map[string][]string{
+			STORAGE_MYSQL:    {"DROP TABLE IF EXISTS `nodes`"},
+			STORAGE_POSTGRES: {`DROP TABLE IF EXISTS "nodes"`},
+			STORAGE_SQLITE:   {`DROP TABLE IF EXISTS "nodes"`},
+		},
+	},
+	{
+		// the device history and sessions of one device, paged by id
+		version: 9,
+		name:    "index device history",
+		up: map[string][]string{
+			STORAGE_MYSQL: {
+				"ALTER TABLE `{clients}` ADD KEY `addr_id` (`addr`, `id`)",
+				"ALTER TABLE `sessions` ADD KEY `addr_id` (`addr`, `id`)",
+			},
+			STORAGE_POSTGRES: {
+				`CREATE INDEX IF NOT EXISTS "{clients}_addr_id" ON "{clients}" ("addr", "id")`,
+				`CREATE INDEX IF NOT EXISTS "sessions_addr_id" ON "sessions" ("addr", "id")`,
+			},
+			STORAGE_SQLITE: {
+				`CREATE INDEX IF NOT EXISTS "{clients}_addr_id" ON "{clients}" ("addr", "id")`,
+				`CREATE INDEX IF NOT EXISTS "sessions_addr_id" ON "sessions" ("addr", "id")`,
+			},
+		},
+		down: map[string][]string{
+			STORAGE_MYSQL: {
+				"ALTER TABLE `sessions` DROP KEY `addr_id`",
+				"ALTER TABLE `{clients}` DROP KEY `addr_id`",
+			},
+			STORAGE_POSTGRES: {
+				`DROP INDEX IF EXISTS "sessions_addr_id"`,
+				`DROP INDEX IF EXISTS "{clients}_addr_id"`,
+			},
+			STORAGE_SQLITE: {
+				`DROP INDEX IF EXISTS "sessions_addr_id"`,
+				`DROP INDEX IF EXISTS "{clients}_addr_id"`,
+			},
+		},
+	},
+}
+
+// expandTables replaces the table placeholders of a migration statement.
+func expandTables(stmt string) string {
+	return strings.NewReplacer("{clients}", mysql_table, "{summaries}", mysql_summary_table).Replace(stmt)
+}
+
+// skipTables leaves out the statements on the tables m.skip_table reports.
+func (s *SQLStorage) skipTables(m *migration, stmts []string) ([]string, error) {
+	placeholders := map[string]string{"{clients}": mysql_table, "{summaries}": mysql_summary_table}
+	skipped := make(map[string]bool)
+	for placeholder, table := range placeholders {
+		has, err := m.skip_table(s, table)
+		if err != nil {
+			return nil, err
+		}
+		if has {
+			Log.Info("table has migration already", "version", m.version, "name", m.name, "table", table)
+			skipped[placeholder] = true
+		}
+	}
+
+	var kept []string
+	for _, stmt := range stmts {
+		skip := false
+		for placeholder := range skipped {
+			skip = skip || strings.Contains(stmt, placeholder)
+		}
+		if !skip {
+			kept = append(kept, stmt)
+		}
+	}
+	return kept, nil
+}
+
+func (s *SQLStorage) HasColumn(table, column string) (bool, error) {
+	var count int
+	err := s.db.QueryRow(s.dialect.column_sql, table, column).Scan(&count)
+	return count > 0, err
+}
+
+func (s *SQLStorage) createMigrationTable() error {
+	q := s.dialect.quote
+	_, err := s.db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s integer NOT NULL PRIMARY KEY, "+
+		"%s varchar(128) NOT NULL, %s bigint NOT NULL)",
+		q("schema_migrations"), q("version"), q("name"), q("applied")))
+	return err
+}
+
+// AppliedMigrations returns the unix time each applied version was applied.
+func (s *SQLStorage) AppliedMigrations() (map[int]int64, error) {
+	if err := s.createMigrationTable(); err != nil {
+		return nil, err
+	}
+	q := s.dialect.quote
+	rows, err := s.db.Query(fmt.Sprintf("SELECT %s, %s FROM %s", q("version"), q("applied"), q("schema_migrations")))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]int64)
+	for rows.Next() {
+		var version int
+		var at int64
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		applied[version] = at
+	}
+	return applied, rows.Err()
+}
+
+// runMigration applies m, or rolls it back if up is false, and records it.
+func (s *SQLStorage) runMigration(m *migration, up bool) error {
+	q := s.dialect.quote
+	stmts := m.down[s.dialect.name]
+	if up {
+		stmts = m.up[s.dialect.name]
+		if m.skip != nil {
+			skip, err := m.skip(s)
+			if err != nil {
+				return err
+			}
+			if skip {
+				Log.Info("schema has migration already, recording it", "version", m.version, "name", m.name)
+				stmts = nil
+			}
+		}
+		if m.skip_table != nil {
+			var err error
+			if stmts, err = s.skipTables(m, stmts); err != nil {
+				return err
+			}
+		}
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(expandTables(stmt)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %s", m.version, err)
+		}
+	}
+	if up {
+		_, err = tx.Exec(fmt.Sprintf("INSERT INTO %s (%s, %s, %s) VALUES (%s, %s, %s)",
+			q("schema_migrations"), q("version"), q("name"), q("applied"),
+			s.dialect.param(1), s.dialect.param(2), s.dialect.param(3)),
+			m.version, m.name, time.Now().Unix())
+	} else {
+		_, err = tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s = %s",
+			q("schema_migrations"), q("version"), s.dialect.param(1)), m.version)
+	}
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("migration %d: %s", m.version, err)
+	}
+	return tx.Commit()
+}
+
+// Migrate applies every pending migration in order.
+func (s *SQLStorage) Migrate() error {
+	applied, err := s.AppliedMigrations()
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if _, ok := applied[m.version]; ok {
+			continue
+		}
+		Log.Info("applying migration", "version", m.version, "name", m.name)
+		if err := s.runMigration(m, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rollback rolls back applied migrations above version, latest first.
+func (s *SQLStorage) Rollback(version int) error {
+	applied, err := s.AppliedMigrations()
+	if err != nil {
+		return err
+	}
+	for idx := len(migrations) - 1; idx >= 0; idx-- {
+		m := migrations[idx]
+		if m.version <= version {
+			break
+		}
+		if _, ok := applied[m.version]; !ok {
+			continue
+		}
+		Log.Info("rolling back migration", "version", m.version, "name", m.name)
+		if err := s.runMigration(m, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LatestMigration returns the highest applied version, 0 if none is.
+func (s *SQLStorage) LatestMigration() (int, error) {
+	applied, err := s.AppliedMigrations()
+	latest := 0
+	for version := range applied {
+		if version > latest {
+			latest = version
+		}
+	}
+	return latest, err
+}
+
+func (s *SQLStorage) PrintMigrations() error {
+	applied, err := s.AppliedMigrations()
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		state := "pending"
+		if at, ok := applied[m.version]; ok {
+			state = "applied " + time.Unix(at, 0).Format("2006-01-02 15:04:05")
+		}
+		fmt.Printf("%4d  %-40s %s\n", m.version, m.name, state)
+	}
+	return nil
+}
+
+// MigrateCommand runs "migrate status|up|down [version]" and exits.
+func MigrateCommand(args []string) {
+	usage := commandUsage("migrate status|up|down [version]")
+	if len(args) < 1 {
+		usage()
+	}
+	version := -1
+	switch args[0] {
+	case "status", "up":
+	case "down":
+		if len(args) > 1 {
+			var err error
+			if version, err = strconv.Atoi(args[1]); err != nil {
+				usage()
+			}
+		}
+	default:
+		usage()
+	}
+
+	RunCommand("schema to migrate", false, func(storage Storage) error {
+		s := storage.(*SQLStorage)
+		var err error
+		switch args[0] {
+		case "up":
+			err = s.Migrate()
+		case "down":
+			if version < 0 {
+				version, err = s.LatestMigration()
+				version--
+			}
+			if err == nil {
+				err = s.Rollback(version)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		return s.PrintMigrations()
+	})
+}
+
+// CheckSchema returns an error if a migration is pending.
+func (s *SQLStorage) CheckSchema() error {
+	applied, err := s.AppliedMigrations()
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if _, ok := applied[m.version]; !ok {
+			return fmt.Errorf("schema migration %d is pending, run \"migrate up\"", m.version)
+		}
+	}
+	return nil
+}
+
+// rssi_columns are the columns the HTTP ingest stored negative dBm in
+// before migration 5.
+var rssi_columns = []struct{ table, column string }{
+	{"{clients}", "rssi"},
+	{"sessions", "peak_rssi"},
+}
+
+// NormalizeRSSI makes the negative rssi of rssi_columns positive, or counts
+// them if dry, and returns the rows per table. It updates ranges of
+// prune_batch ids, pausing prune_pause in between.
+func (s *SQLStorage) NormalizeRSSI(dry bool) (map[string]int64, error) {
+	q := s.dialect.quote
+	counts := make(map[string]int64)
+	for _, rc := range rssi_columns {
+		table := expandTables(rc.table)
+		if dry {
+			var rows int64
+			err := s.db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE %s < 0",
+				q(table), q(rc.column))).Scan(&rows)
+			counts[table] = rows
+			if err != nil {
+				return counts, err
+			}
+			continue
+		}
+
+		var first, last *int64
+		err := s.db.QueryRow(fmt.Sprintf("SELECT MIN(%s), MAX(%s) FROM %s",
+			q("id"), q("id"), q(table))).Scan(&first, &last)
+		if err != nil {
+			return counts, err
+		}
+		counts[table] = 0
+		if first == nil {
+			continue
+		}
+		update := s.dialect.Bind(fmt.Sprintf("UPDATE %s SET %s = -%s WHERE %s >= ? AND %s < ? AND %s < 0",
+			q(table), q(rc.column), q(rc.column), q("id"), q("id"), q(rc.column)))
+		for from := *first; from <= *last; from += int64(prune_batch) {
+			result, err := s.db.Exec(update, from, from+int64(prune_batch))
+			if err != nil {
+				return counts, err
+			}
+			updated, _ := result.RowsAffected()
+			counts[table] += updated
+			time.Sleep(prune_pause)
+		}
+	}
+	return counts, nil
+}
+
+// NormalizeRSSICommand runs "normalize-rssi dry-run|now" and exits.
+func NormalizeRSSICommand(args []string) {
+	usage := commandUsage("normalize-rssi dry-run|now")
+	if len(args) < 1 || args[0] != "dry-run" && args[0] != "now" {
+		usage()
+	}
+	dry := args[0] == "dry-run"
+
+	RunCommand("rssi to normalize", false, func(storage Storage) error {
+		s := storage.(*SQLStorage)
+		if err := s.CheckSchema(); err != nil {
+			return err
+		}
+		counts, err := s.NormalizeRSSI(dry)
+		verb := "updated"
+		if dry {
+			verb = "would update"
+		}
+		for _, rc := range rssi_columns {
+			table := expandTables(rc.table)
+			if rows, ok := counts[table]; ok {
+				fmt.Printf("%-16s %s %d rows\n", table, verb, rows)
+			}
+		}
+		return err
+	})
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The node registry follows the nodes connected to this server and the
+// rate of their events, for the query API and the dashboard. A node is
+// online while it has a connection with the versioned protocol, legacy
+// nodes and HTTP senders without a handshake while they sent an event
+// within NODE_ONLINE_WINDOW. The registry is not stored, after a restart
+// nodes are known again as they reconnect; the SQL storages keep the first
+// and last event and the events of each node in the nodes table.
+const (
+	NODE_ONLINE_WINDOW = 5 * time.Minute
+	NODE_RATE_MINUTES  = 60
+)
+
+var node_registry = NewNodeRegistry()
+
+// NodeState is what the registry knows of a node.
+type NodeState struct {
+	NodeID         string                   `json:"nodeid"`
+	Online         bool                     `json:"online"`
+	Connections    int                      `json:"connections"`
+	ConnectedSince int64                    `json:"connected_since,omitempty"`
+	Remote         string                   `json:"remote,omitempty"`
+	Firmware       string                   `json:"firmware,omitempty"`
+	LastEvent      int64                    `json:"last_event,omitempty"`
+	EventsMinute   int64                    `json:"events_last_minute"`
+	EventsHour     int64                    `json:"events_last_hour"`
+	minutes        [NODE_RATE_MINUTES]int64 // events per minute, by unix minute modulo
+	minute_stamps  [NODE_RATE_MINUTES]int64 // unix minute of each count
+	handshake      bool                     // connected with the versioned protocol
+}
+
+type NodeRegistry struct {
+	lock  *sync.Mutex
+	nodes map[string]*NodeState
+}
+
+func NewNodeRegistry() *NodeRegistry {
+	return &NodeRegistry{
+		lock:  new(sync.Mutex),
+		nodes: make(map[string]*NodeState),
+	}
+}
+
+func (reg *NodeRegistry) node(node_id string) *NodeState {
+	node := reg.nodes[node_id]
+	if node == nil {
+		node = &NodeState{NodeID: node_id}
+		reg.nodes[node_id] = node
+	}
+	return node
+}
+
+func (reg *NodeRegistry) Connected(node_id, remote, firmware string) {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	node := reg.node(node_id)
+	if node.Connections == 0 {
+		node.ConnectedSince = time.Now().Unix()
+	}
+	node.Connections++
+	node.handshake = true
+	node.Remote = remote
+	node.Firmware = firmware
+}
+
+func (reg *NodeRegistry) Disconnected(node_id string) {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	node := reg.node(node_id)
+	node.Connections--
+	if node.Connections <= 0 {
+		node.Connections = 0
+		node.ConnectedSince = 0
+	}
+}
+
+// Observe is the writer observer counting the events of each node.
+func (reg *NodeRegistry) Observe(record *Record) {
+	if record.Client == nil {
+		return
+	}
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+
+	node := reg.node(record.Client.NodeID)
+	node.LastEvent = record.Received.Unix()
+	minute := node.LastEvent / 60
+	idx := minute % NODE_RATE_MINUTES
+	if node.minute_stamps[idx] != minute {
+		node.minute_stamps[idx] = minute
+		node.minutes[idx] = 0
+	}
+	node.minutes[idx]++
+}
+
+// Nodes returns the state of every node known, by node id.
+func (reg *NodeRegistry) Nodes(now time.Time) []NodeState {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+
+	minute := now.Unix() / 60
+	nodes := make([]NodeState, 0, len(reg.nodes))
+	for _, node := range reg.nodes {
+		state := *node
+		state.Online = node.Connections > 0
+		if !node.handshake {
+			state.Online = now.Unix()-node.LastEvent < int64(NODE_ONLINE_WINDOW/time.Second)
+		}
+		state.EventsMinute, state.EventsHour = 0, 0
+		for idx, stamp := range node.minute_stamps {
+			// the last full minute and the hour before now
+			if stamp == minute-1 {
+				state.EventsMinute = node.minutes[idx]
+			}
+			if stamp > minute-NODE_RATE_MINUTES && stamp <= minute {
+				state.EventsHour += node.minutes[idx]
+			}
+		}
+		nodes = append(nodes, state)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].NodeID < nodes[j].NodeID })
+	return nodes
+}
+
+// nodeQueries count the events of each node in the nodes table of the SQL
+// storages, which the nodes of the query API are read from.
+func nodeQueries(d *sqlDialect) map[string]string {
+	q := d.quote
+	return map[string]string{
+		"node_add": d.InsertSQL("nodes", []string{"nodeid", "first_seen", "last_seen"}),
+		"node_count": d.Bind(fmt.Sprintf("UPDATE %s SET %s = CASE WHEN ? > %s THEN ? ELSE %s END, %s = %s + 1 WHERE %s = ?",
+			q("nodes"), q("last_seen"), q("last_seen"), q("last_seen"), q("events"), q("events"), q("nodeid"))),
+	}
+}
+
+// countNode adds an event just stored to the totals of its node.
+func countNode(tx *sqlTx, client *Client, at time.Time) error {
+	seen := at.Unix()
+	if _, err := tx.Exec("node_add", client.NodeID, seen, seen); err != nil {
+		Log.Error("can not add node", "node", client.NodeID, "err", err)
+		return err
+	}
+	if _, err := tx.Exec("node_count", seen, seen, client.NodeID); err != nil {
+		Log.Error("can not count node event", "node", client.NodeID, "err", err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// On PostgreSQL migration 7 partitions the events table by the day of its
+// timestamp, so retention drops the partitions of expired days instead of
+// deleting their rows. The table as it was before is kept as the partition
+// of everything up to its last event, later events go to one partition per
+// local day:
+//
+//	clients_before     up to the migration
+//	clients_p20261018  2026-10-18 00:00 to 2026-10-19 00:00
+//	clients_default    anything without a day partition
+//
+// The server creates the partitions of today and the next PARTITION_AHEAD
+// days at startup and every PARTITION_INTERVAL. Events of a day without a
+// partition go to the default partition. Those of a day partitioned later
+// are moved when its partition is created, those of past days stay and a
+// prune deletes them in batches.
+//
+// A unique key of a partitioned table has to include the timestamp, so
+// duplicates are dropped by (nodeid, seq, timestamp). That holds for events
+// stored at their capture time, a retransmit carries the same one. Events
+// without a capture time are stored at the time received, which differs for
+// a retransmit; for them a duplicate of (nodeid, seq) is looked up within
+// PARTITION_DEDUP_WINDOW before the insert, an older one is stored twice.
+const (
+	PARTITION_AHEAD        = 3
+	PARTITION_INTERVAL     = time.Hour
+	PARTITION_DEDUP_WINDOW = 7 * 24 * time.Hour
+)
+
+// eventPartition is a partition of the events table with its range of
+// timestamps, the default partition has none.
+type eventPartition struct {
+	name    string
+	bounded bool
+	from    int64 // math.MinInt64 for MINVALUE
+	to      int64
+}
+
+var partition_bound_re = regexp.MustCompile(`FROM \((.+?)\) TO \((.+?)\)`)
+
+func parsePartitionBound(value string) (int64, error) {
+	value = strings.Trim(value, "'")
+	if value == "MINVALUE" {
+		return math.MinInt64, nil
+	}
+	if value == "MAXVALUE" {
+		return math.MaxInt64, nil
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+// EventsPartitioned reports whether the events table is partitioned.
+func (s *SQLStorage) EventsPartitioned() (bool, error) {
+	if s.dialect != dialect_postgres {
+		return false, nil
+	}
+	var partitioned bool
+	err := s.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM pg_partitioned_table p
+		JOIN pg_class c ON c.oid = p.partrelid
+		WHERE c.relname = $1 AND c.relnamespace = current_schema()::regnamespace)`,
+		expandTables("{clients}")).Scan(&partitioned)
+	return partitioned, err
+}
+
+// eventPartitions returns the partitions of the events table.
+func (s *SQLStorage) eventPartitions() ([]eventPartition, error) {
+	rows, err := s.db.Query(`SELECT c.relname, pg_get_expr(c.relpartbound, c.oid) FROM pg_inherits i
+		JOIN pg_class c ON c.oid = i.inhrelid
+		JOIN pg_class p ON p.oid = i.inhparent
+		WHERE p.relname = $1 AND p.relnamespace = current_schema()::regnamespace`,
+		expandTables("{clients}"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var partitions []eventPartition
+	for rows.Next() {
+		var part eventPartition
+		var bound string
+		if err := rows.Scan(&part.name, &bound); err != nil {
+			return nil, err
+		}
+		if match := partition_bound_re.FindStringSubmatch(bound); match != nil {
+			if part.from, err = parsePartitionBound(match[1]); err != nil {
+				return nil, fmt.Errorf("partition %s bound %q: %s", part.name, bound, err)
+			}
+			if part.to, err = parsePartitionBound(match[2]); err != nil {
+				return nil, fmt.Errorf("partition %s bound %q: %s", part.name, bound, err)
+			}
+			part.bounded = true
+		}
+		partitions = append(partitions, part)
+	}
+	return partitions, rows.Err()
+}
+
+// EnsurePartitions creates the day partitions of today and the next
+// PARTITION_AHEAD days which are missing. A day partition starts at the end
+// of the last one if that is later than midnight, e.g. on the day of the
+// migration.
+//
+// The default partition must not hold rows of a partition attached to the
+// table, so a day partition is created detached, the rows of its day moved
+// from the default partition into it and then attached, in one transaction.
+func (s *SQLStorage) EnsurePartitions(now time.Time) error {
+	partitions, err := s.eventPartitions()
+	if err != nil {
+		return err
+	}
+	table := expandTables("{clients}")
+	upper := int64(math.MinInt64)
+	for _, part := range partitions {
+		if part.bounded && part.to > upper {
+			upper = part.to
+		}
+	}
+
+	day := time.Unix(periodStart(ROLLUP_DAY, now), 0)
+	for idx := 0; idx <= PARTITION_AHEAD; idx++ {
+		start, end := day.AddDate(0, 0, idx), day.AddDate(0, 0, idx+1)
+		from := start.Unix()
+		if upper > from {
+			from = upper
+		}
+		if from >= end.Unix() {
+			continue
+		}
+		name := table + "_p" + start.Format("20060102")
+		moved, err := s.createPartition(table, name, from, end.Unix())
+		if err != nil {
+			return fmt.Errorf("create partition %s: %s", name, err)
+		}
+		Log.Info("created event partition", "partition", name, "moved", moved)
+		upper = end.Unix()
+	}
+	return nil
+}
+
+// createPartition adds the partition name of table for timestamps from from
+// up to to and returns the number of rows moved into it from the default
+// partition.
+func (s *SQLStorage) createPartition(table, name string, from, to int64) (int64, error) {
+	q := s.dialect.quote
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(fmt.Sprintf("CREATE TABLE %s (LIKE %s INCLUDING DEFAULTS)", q(name), q(table))); err != nil {
+		return 0, err
+	}
+	result, err := tx.Exec(fmt.Sprintf("WITH moved AS (DELETE FROM %s WHERE %s >= %d AND %s < %d RETURNING *) "+
+		"INSERT INTO %s SELECT * FROM moved", q(table+"_default"), q("timestamp"), from, q("timestamp"), to, q(name)))
+	if err != nil {
+		return 0, err
+	}
+	moved, _ := result.RowsAffected()
+	if _, err := tx.Exec(fmt.Sprintf("ALTER TABLE %s ATTACH PARTITION %s FOR VALUES FROM (%d) TO (%d)",
+		q(table), q(name), from, to)); err != nil {
+		return 0, err
+	}
+	return moved, tx.Commit()
+}
+
+func PartitionLoop(s *SQLStorage) {
+	for {
+		partitioned, err := s.EventsPartitioned()
+		if err == nil && partitioned {
+			err = s.EnsurePartitions(time.Now())
+		}
+		if err != nil {
+			Log.Warn("can not create event partitions", "err", err)
+		}
+		time.Sleep(PARTITION_INTERVAL)
+	}
+}
+
+// dropPartitions drops the partitions of the events table which end before
+// before, archiving their rows first if archive is set, and returns the
+// number of rows dropped.
+func (s *SQLStorage) dropPartitions(class *retentionClass, before time.Time, archive *jsonlFile) (int64, error) {
+	partitions, err := s.eventPartitions()
+	if err != nil {
+		return 0, err
+	}
+	var dropped int64
+	for _, part := range partitions {
+		if !part.bounded || part.to > before.Unix() {
+			continue
+		}
+		name := s.dialect.quote(part.name)
+		var rows int64
+		if archive != nil {
+			rows, err = s.pruneBatches(name, class, before, archive)
+		} else {
+			err = s.db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s", name)).Scan(&rows)
+		}
+		if err != nil {
+			return dropped, err
+		}
+		if _, err := s.db.Exec(fmt.Sprintf("DROP TABLE %s", name)); err != nil {
+			return dropped, fmt.Errorf("drop partition %s: %s", part.name, err)
+		}
+		Log.Info("dropped event partition", "partition", part.name, "rows", rows)
+		dropped += rows
+	}
+	return dropped, nil
+}
+
+// clientSeen reports whether the partitioned events table has an event of
+// the node and seq of client within PARTITION_DEDUP_WINDOW before at.
+func clientSeen(tx *sqlTx, client *Client, at time.Time) (bool, error) {
+	var seen int
+	err := tx.QueryRow("client_seen", client.NodeID, client.Seq,
+		at.Add(-PARTITION_DEDUP_WINDOW).Unix()).Scan(&seen)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Retention keeps each class of data for its own time, 0 keeps it forever:
+//
+//	-retain_events          events of the clients table or clients-*.jsonl
+//	-retain_summaries       summaries
+//	-retain_sessions        closed sessions, by their end
+//	-retain_hourly_rollups  hourly rollups
+//	-retain_daily_rollups   daily rollups
+//
+// The server prunes every -prune_interval. SQL storages delete at most
+// -prune_batch rows per statement, pausing -prune_pause in between so the
+// writer is not held up. With -archive_dir the rows are first appended to
+// JSON lines files of the day of the row in that directory, in the format
+// of the jsonl storage; a crash between archiving and deleting may archive
+// a batch twice.
+//
+// The jsonl storage is partitioned by day already, it deletes or archives
+// the files of days entirely before the retention. On PostgreSQL the events
+// table is partitioned by day too (see wifi_probe_server_partitions.go), a
+// prune drops the partitions of expired days whole and deletes the rest in
+// batches. SQLite has no partitions, and partitioning MySQL would rebuild
+// the table with the timestamp in every unique key, so both delete in
+// batches on the timestamp indexes of migration 6.
+//
+// The prune command reports what would be removed or prunes once:
+//
+//	wifi_probe_server ... -retain_events 2160h prune dry-run
+//	wifi_probe_server ... -retain_events 2160h prune now
+var (
+	retain_events         time.Duration
+	retain_summaries      time.Duration
+	retain_sessions       time.Duration
+	retain_hourly_rollups time.Duration
+	retain_daily_rollups  time.Duration
+
+	prune_interval time.Duration
+	prune_batch    int
+	prune_pause    time.Duration
+	archive_dir    string
+)
+
+func init() {
+	flag.DurationVar(&retain_events, "retain_events", 0, "keep events this long, 0 keeps them forever")
+	flag.DurationVar(&retain_summaries, "retain_summaries", 0, "keep summaries this long, 0 keeps them forever")
+	flag.DurationVar(&retain_sessions, "retain_sessions", 0, "keep closed sessions this long, 0 keeps them forever")
+	flag.DurationVar(&retain_hourly_rollups, "retain_hourly_rollups", 0, "keep hourly rollups this long, 0 keeps them forever")
+	flag.DurationVar(&retain_daily_rollups, "retain_daily_rollups", 0, "keep daily rollups this long, 0 keeps them forever")
+	flag.DurationVar(&prune_interval, "prune_interval", time.Hour, "time between prunes of expired data")
+	flag.IntVar(&prune_batch, "prune_batch", 5000, "rows deleted per statement when pruning")
+	flag.DurationVar(&prune_pause, "prune_pause", 100*time.Millisecond, "pause between the batches of a prune")
+	flag.StringVar(&archive_dir, "archive_dir", "", "append pruned rows to JSON lines files in this directory instead of dropping them")
+}
+
+// retentionClass is one class of data with its own retention.
+type retentionClass struct {
+	name   string
+	retain *time.Duration
+	table  string // table with {clients} and {summaries} of the SQL storages
+	column string // unix time the retention counts from
+	period string // rollup period, "" for other tables
+	kind   string // file kind of the jsonl storage, "" if it has none
+}
+
+var retention_classes = []*retentionClass{
+	{name: "events", retain: &retain_events, table: "{clients}", column: "timestamp", kind: "clients"},
+	{name: "summaries", retain: &retain_summaries, table: "{summaries}", column: "timestamp", kind: "summaries"},
+	{name: "sessions", retain: &retain_sessions, table: "sessions", column: "end", kind: "sessions"},
+	{name: "hourly_rollups", retain: &retain_hourly_rollups, table: "rollups", column: "start", period: ROLLUP_HOUR},
+	{name: "daily_rollups", retain: &retain_daily_rollups, table: "rollups", column: "start", period: ROLLUP_DAY},
+}
+
+// PruneReport is what a prune of one class removed or, dry, would remove.
+type PruneReport struct {
+	Rows   int64
+	Files  int       // jsonl storage only
+	Oldest time.Time // zero if nothing is expired
+}
+
+// PruneStorage is implemented by storages which can drop old data.
+type PruneStorage interface {
+	Prune(class *retentionClass, before time.Time, dry bool) (PruneReport, error)
+}
+
+// PruneAll prunes every class with a retention.
+func PruneAll(storage PruneStorage, now time.Time, dry bool) (map[string]PruneReport, error) {
+	reports := make(map[string]PruneReport)
+	for _, class := range retention_classes {
+		if *class.retain <= 0 {
+			continue
+		}
+		report, err := storage.Prune(class, now.Add(-*class.retain), dry)
+		reports[class.name] = report
+		if err != nil {
+			return reports, fmt.Errorf("prune %s: %s", class.name, err)
+		}
+	}
+	return reports, nil
+}
+
+func PruneLoop(storage PruneStorage) {
+	enabled := false
+	for _, class := range retention_classes {
+		enabled = enabled || *class.retain > 0
+	}
+	if !enabled {
+		return
+	}
+	for {
+		reports, err := PruneAll(storage, time.Now(), false)
+		if err != nil {
+			Log.Warn("prune failed", "err", err)
+		}
+		for name, report := range reports {
+			if report.Rows > 0 || report.Files > 0 {
+				Log.Info("pruned expired data", "class", name, "rows", report.Rows, "files", report.Files)
+			}
+		}
+		time.Sleep(prune_interval)
+	}
+}
+
+// pruneWhere returns the condition selecting the expired rows of class.
+func (s *SQLStorage) pruneWhere(class *retentionClass) string {
+	q := s.dialect.quote
+	where := fmt.Sprintf("%s < ?", q(class.column))
+	if class.period != "" {
+		where += fmt.Sprintf(" AND %s = '%s'", q("period"), class.period)
+	}
+	return where
+}
+
+func (s *SQLStorage) Prune(class *retentionClass, before time.Time, dry bool) (PruneReport, error) {
+	var report PruneReport
+	q := s.dialect.quote
+	table := q(expandTables(class.table))
+	where := s.pruneWhere(class)
+
+	if dry {
+		var oldest *int64
+		err := s.db.QueryRow(s.dialect.Bind(fmt.Sprintf("SELECT COUNT(*), MIN(%s) FROM %s WHERE %s",
+			q(class.column), table, where)), before.Unix()).Scan(&report.Rows, &oldest)
+		if err == nil && oldest != nil {
+			report.Oldest = time.Unix(*oldest, 0)
+		}
+		return report, err
+	}
+
+	var archive *jsonlFile
+	if archive_dir != "" {
+		if err := os.MkdirAll(archive_dir, 0755); err != nil {
+			return report, err
+		}
+		archive = &jsonlFile{kind: expandTables(class.table), seen: make(map[string]*seqWindow)}
+		defer archive.close()
+	}
+
+	if class.table == "{clients}" {
+		partitioned, err := s.EventsPartitioned()
+		if err != nil {
+			return report, err
+		}
+		if partitioned {
+			dropped, err := s.dropPartitions(class, before, archive)
+			report.Rows += dropped
+			if err != nil {
+				return report, err
+			}
+		}
+	}
+	pruned, err := s.pruneBatches(table, class, before, archive)
+	report.Rows += pruned
+	return report, err
+}
+
+// pruneBatches deletes the expired rows of class from table in batches of
+// prune_batch and returns the number of rows deleted.
+func (s *SQLStorage) pruneBatches(table string, class *retentionClass, before time.Time, archive *jsonlFile) (int64, error) {
+	q := s.dialect.quote
+	where := s.pruneWhere(class)
+	var pruned int64
+	for {
+		columns := q("id")
+		if archive != nil {
+			columns = "*"
+		}
+		rows, err := s.db.Query(s.dialect.Bind(fmt.Sprintf("SELECT %s FROM %s WHERE %s ORDER BY %s LIMIT %d",
+			columns, table, where, q("id"), prune_batch)), before.Unix())
+		if err != nil {
+			return pruned, err
+		}
+		ids, err := s.scanPruned(rows, class, archive)
+		if err != nil {
+			return pruned, err
+		}
+		if len(ids) == 0 {
+			return pruned, nil
+		}
+
+		params := strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ")
+		result, err := s.db.Exec(s.dialect.Bind(fmt.Sprintf("DELETE FROM %s WHERE %s IN (%s)",
+			table, q("id"), params)), ids...)
+		if err != nil {
+			return pruned, err
+		}
+		deleted, _ := result.RowsAffected()
+		pruned += deleted
+		if len(ids) < prune_batch {
+			return pruned, nil
+		}
+		time.Sleep(prune_pause)
+	}
+}
+
+// scanPruned returns the ids of rows, appending the rows to archive if set.
+func (s *SQLStorage) scanPruned(rows *sql.Rows, class *retentionClass, archive *jsonlFile) ([]interface{}, error) {
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []interface{}
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for idx := range values {
+			pointers[idx] = &values[idx]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, err
+		}
+
+		record := make(map[string]interface{}, len(columns))
+		var at int64
+		for idx, column := range columns {
+			value := values[idx]
+			if b, ok := value.([]byte); ok {
+				value = string(b)
+			}
+			record[column] = value
+			if column == class.column {
+				at = toInt64(value)
+			}
+		}
+		ids = append(ids, record["id"])
+
+		if archive != nil {
+			if _, err := archive.append(archive_dir, time.Unix(at, 0), "", 0, record); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return ids, rows.Err()
+}
+
+// toInt64 converts an integer column of any driver.
+func toInt64(value interface{}) int64 {
+	switch v := value.(type) {
+	case int64:
+		return v
+	case int32:
+		return int64(v)
+	case uint64:
+		return int64(v)
+	case string:
+		var n int64
+		fmt.Sscan(v, &n)
+		return n
+	}
+	return 0
+}
+
+func (f *jsonlFile) close() {
+	if f.fp != nil {
+		f.fp.Close()
+		f.fp = nil
+	}
+}
+
+// Prune removes the daily files of class which end before before.
+func (s *JSONLStorage) Prune(class *retentionClass, before time.Time, dry bool) (PruneReport, error) {
+	var report PruneReport
+	if class.kind == "" {
+		return report, nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	filenames, err := filepath.Glob(filepath.Join(s.dir, class.kind+"-*.jsonl"))
+	if err != nil {
+		return report, err
+	}
+	for _, filename := range filenames {
+		day, err := time.ParseInLocation("20060102",
+			strings.TrimSuffix(strings.TrimPrefix(filepath.Base(filename), class.kind+"-"), ".jsonl"), time.Local)
+		if err != nil || day.AddDate(0, 0, 1).After(before) {
+			continue
+		}
+
+		lines, err := countLines(filename)
+		if err != nil {
+			return report, err
+		}
+		if report.Oldest.IsZero() || day.Before(report.Oldest) {
+			report.Oldest = day
+		}
+		if !dry {
+			for _, f := range []*jsonlFile{s.clients, s.summaries, s.sessions} {
+				if f.kind == class.kind && f.day == day.Format("20060102") {
+					f.close()
+				}
+			}
+			if archive_dir != "" {
+				if err := os.MkdirAll(archive_dir, 0755); err != nil {
+					return report, err
+				}
+				err = os.Rename(filename, filepath.Join(archive_dir, filepath.Base(filename)))
+			} else {
+				err = os.Remove(filename)
+			}
+			if err != nil {
+				return report, err
+			}
+		}
+		report.Rows += lines
+		report.Files++
+	}
+	return report, nil
+}
+
+func countLines(filename string) (int64, error) {
+	fp, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer fp.Close()
+
+	var lines int64
+	reader := bufio.NewReader(fp)
+	for {
+		_, err := reader.ReadSlice('\n')
+		if err == nil {
+			lines++
+		} else if err != bufio.ErrBufferFull {
+			break
+		}
+	}
+	return lines, nil
+}
+
+// PruneCommand runs "prune dry-run|now" and exits.
+func PruneCommand(args []string) {
+	usage := commandUsage("prune dry-run|now")
+	if len(args) < 1 || args[0] != "dry-run" && args[0] != "now" {
+		usage()
+	}
+	dry := args[0] == "dry-run"
+
+	// a dry run changes nothing, not even the schema
+	RunCommand("", !dry, func(storage Storage) error {
+		if s, ok := storage.(*SQLStorage); ok && dry {
+			if err := s.CheckSchema(); err != nil {
+				return err
+			}
+		}
+		now := time.Now()
+		reports, err := PruneAll(storage.(PruneStorage), now, dry)
+		for _, class := range retention_classes {
+			report, ok := reports[class.name]
+			if !ok {
+				fmt.Printf("%-16s kept forever\n", class.name)
+				continue
+			}
+			verb := "removed"
+			if dry {
+				verb = "would remove"
+			}
+			line := fmt.Sprintf("%-16s before %s %s %d rows", class.name,
+				now.Add(-*class.retain).Format("2006-01-02 15:04:05"), verb, report.Rows)
+			if report.Files > 0 {
+				line += fmt.Sprintf(" in %d files", report.Files)
+			}
+			if !report.Oldest.IsZero() {
+				line += ", oldest " + report.Oldest.Format("2006-01-02 15:04:05")
+			}
+			fmt.Println(line)
+		}
+		return err
+	})
+}
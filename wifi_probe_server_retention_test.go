@@ -0,0 +1,93 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testRetention keeps events for a day and prunes in batches of 2.
+func testRetention(t *testing.T) {
+	events, batch, pause := retain_events, prune_batch, prune_pause
+	t.Cleanup(func() { retain_events, prune_batch, prune_pause = events, batch, pause })
+	retain_events = 24 * time.Hour
+	prune_batch = 2
+	prune_pause = 0
+}
+
+// testPruneRecords are 5 events of the first day and 1 two days later.
+func testPruneRecords() []*Record {
+	records := []*Record{testEvent("aa:05", 1, 60, 6, 2*86400)}
+	for idx := 0; idx < 5; idx++ {
+		records = append(records, testEvent("aa:00", 1, 60, uint64(idx+1), int64(idx*60)))
+	}
+	return records
+}
+
+func TestSQLPrune(t *testing.T) {
+	testRetention(t)
+	s := testSQLStorage(t)
+	writeRecords(t, s, testPruneRecords()...)
+	now := time.Unix(test_start+2*86400+3600, 0)
+
+	reports, err := PruneAll(s, now, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := reports["events"]
+	if report.Rows != 5 || report.Oldest.Unix() != test_start {
+		t.Errorf("dry run %+v, want 5 rows from %d", report, test_start)
+	}
+	if rows := countRows(t, s, "clients"); rows != 6 {
+		t.Errorf("dry run left %d events, want 6", rows)
+	}
+	if _, ok := reports["summaries"]; ok {
+		t.Error("summaries kept forever were pruned")
+	}
+
+	reports, err = PruneAll(s, now, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report := reports["events"]; report.Rows != 5 {
+		t.Errorf("pruned %d rows, want 5", report.Rows)
+	}
+	if rows := countRows(t, s, "clients"); rows != 1 {
+		t.Errorf("%d events left, want 1", rows)
+	}
+}
+
+func TestJSONLPrune(t *testing.T) {
+	testRetention(t)
+	dir := t.TempDir()
+	s := testJSONLStorage(t, dir)
+	writeRecords(t, s, testPruneRecords()...)
+	now := time.Unix(test_start+2*86400+3600, 0)
+	expired := filepath.Join(dir, "clients-20150601.jsonl")
+
+	reports, err := PruneAll(s, now, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report := reports["events"]; report.Rows != 5 || report.Files != 1 {
+		t.Errorf("dry run %+v, want 5 rows in 1 file", report)
+	}
+	if _, err := os.Stat(expired); err != nil {
+		t.Errorf("dry run removed the file: %s", err)
+	}
+
+	reports, err = PruneAll(s, now, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report := reports["events"]; report.Rows != 5 || report.Files != 1 {
+		t.Errorf("pruned %+v, want 5 rows in 1 file", report)
+	}
+	if _, err := os.Stat(expired); !os.IsNotExist(err) {
+		t.Errorf("expired file still there: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "clients-20150603.jsonl")); err != nil {
+		t.Errorf("file of the kept event: %s", err)
+	}
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"time"
+)
+
+// Rollups count the visitors of each node per hour and per day of the
+// server's time zone for the dashboards. The SQL storages maintain them while
+// writing events:
+//
+//	rollups          nodeid, period ("hour" or "day"), start, visitors,
+//	                 new_visitors, returning_visitors, sessions, dwell_total,
+//	                 dwell_p50, dwell_p90, dwell_p99, dwell_hist
+//	visitors         first time each device was seen at each node
+//	rollup_visitors  devices already counted in a period, kept for
+//	                 ROLLUP_VISITORS_KEEP
+//
+// A visitor is a device sending any event in the period. It is new if the
+// node saw it first within the period and returning otherwise. Dwell is the
+// duration of the sessions closed by a leave, counted in the period the
+// session started; sessions closed by -session_timeout are left out as their
+// real length is unknown. The percentiles are estimated from dwell_hist, the
+// number of sessions per DWELL_BUCKETS bucket.
+//
+// The rollup command rebuilds the rollups from the stored events, e.g. after
+// enabling them on a database with history. Stop the server meanwhile, its
+// events would be missed or counted twice:
+//
+//	wifi_probe_server ... rollup backfill             from all events
+//	wifi_probe_server ... rollup backfill 2015-06-01  from this day on
+const (
+	ROLLUP_HOUR = "hour"
+	ROLLUP_DAY  = "day"
+
+	ROLLUP_VISITORS_KEEP  = 48 * time.Hour
+	ROLLUP_PRUNE_INTERVAL = time.Hour
+)
+
+var (
+	rollup_periods = []string{ROLLUP_HOUR, ROLLUP_DAY}
+
+	// upper bounds in seconds, the last bucket counts longer sessions
+	DWELL_BUCKETS = []int64{10, 30, 60, 120, 300, 600, 900, 1800, 2700, 3600, 7200, 14400, 28800, 86400}
+)
+
+var rollups_enabled bool
+
+func init() {
+	flag.BoolVar(&rollups_enabled, "rollups", true, "maintain hourly and daily visitor rollups in the SQL storages")
+}
+
+// periodStart returns the unix time the period containing t starts.
+func periodStart(period string, t time.Time) int64 {
+	t = t.Local()
+	hour := 0
+	if period == ROLLUP_HOUR {
+		hour = t.Hour()
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), hour, 0, 0, 0, time.Local).Unix()
+}
+
+// DwellHistogram counts sessions per DWELL_BUCKETS bucket.
+type DwellHistogram []int64
+
+func (h DwellHistogram) Add(duration int64) DwellHistogram {
+	for len(h) <= len(DWELL_BUCKETS) {
+		h = append(h, 0)
+	}
+	idx := 0
+	for idx < len(DWELL_BUCKETS) && duration > DWELL_BUCKETS[idx] {
+		idx++
+	}
+	h[idx]++
+	return h
+}
+
+// Percentile interpolates the duration below which p of the sessions are,
+// durations beyond the last bucket are reported as its lower bound.
+func (h DwellHistogram) Percentile(p float64) int64 {
+	var total int64
+	for _, count := range h {
+		total += count
+	}
+	if total == 0 {
+		return 0
+	}
+
+	rank := p * float64(total)
+	var seen int64
+	for idx, count := range h {
+		if count == 0 || float64(seen+count) < rank {
+			seen += count
+			continue
+		}
+		var low int64
+		if idx > 0 {
+			low = DWELL_BUCKETS[idx-1]
+		}
+		if idx >= len(DWELL_BUCKETS) {
+			return low
+		}
+		return low + int64(float64(DWELL_BUCKETS[idx]-low)*(rank-float64(seen))/float64(count))
+	}
+	return 0
+}
+
+func rollupQueries(d *sqlDialect) map[string]string {
+	q := d.quote
+	key := fmt.Sprintf("%s = ? AND %s = ? AND %s = ?", q("nodeid"), q("period"), q("start"))
+	return map[string]string{
+		"visitor_add": d.InsertSQL("visitors", []string{"nodeid", "addr", "first_seen"}),
+		"visitor_first": d.Bind(fmt.Sprintf("SELECT %s FROM %s WHERE %s = ? AND %s = ?",
+			q("first_seen"), q("visitors"), q("nodeid"), q("addr"))),
+		"rollup_visitor_add": d.InsertSQL("rollup_visitors", []string{"nodeid", "period", "start", "addr"}),
+		"rollup_create":      d.InsertSQL("rollups", []string{"nodeid", "period", "start", "dwell_hist"}),
+		"rollup_count": d.Bind(fmt.Sprintf("UPDATE %s SET %s = %s + 1, %s = %s + ?, %s = %s + ? WHERE %s",
+			q("rollups"), q("visitors"), q("visitors"), q("new_visitors"), q("new_visitors"),
+			q("returning_visitors"), q("returning_visitors"), key)),
+		"rollup_dwell_get": d.Bind(fmt.Sprintf("SELECT %s FROM %s WHERE %s",
+			q("dwell_hist"), q("rollups"), key)),
+		"rollup_dwell_set": d.Bind(fmt.Sprintf("UPDATE %s SET %s = %s + 1, %s = %s + ?, %s = ?, %s = ?, %s = ?, %s = ? WHERE %s",
+			q("rollups"), q("sessions"), q("sessions"), q("dwell_total"), q("dwell_total"),
+			q("dwell_hist"), q("dwell_p50"), q("dwell_p90"), q("dwell_p99"), key)),
+	}
+}
+
+// updateRollups counts the device of an event just stored and the session
+// its leave closed, if any.
+func updateRollups(tx *sqlTx, client *Client, at time.Time, closed *Session) error {
+	first_seen := at.Unix()
+	if _, err := tx.Exec("visitor_add", client.NodeID, client.Addr, first_seen); err != nil {
+		Log.Error("can not add visitor", "node", client.NodeID, "addr", client.Addr, "err", err)
+		return err
+	}
+	if err := tx.QueryRow("visitor_first", client.NodeID, client.Addr).Scan(&first_seen); err != nil {
+		Log.Error("can not read visitor", "node", client.NodeID, "addr", client.Addr, "err", err)
+		return err
+	}
+
+	for _, period := range rollup_periods {
+		start := periodStart(period, at)
+		result, err := tx.Exec("rollup_visitor_add", client.NodeID, period, start, client.Addr)
+		if err != nil {
+			Log.Error("can not add rollup visitor", "node", client.NodeID, "period", period, "err", err)
+			return err
+		}
+		if rows, err := result.RowsAffected(); err == nil && rows == 0 {
+			continue // counted already
+		}
+
+		new_visitors, returning_visitors := 0, 1
+		if first_seen >= start {
+			new_visitors, returning_visitors = 1, 0
+		}
+		if _, err := tx.Exec("rollup_create", client.NodeID, period, start, "[]"); err != nil {
+			Log.Error("can not create rollup", "node", client.NodeID, "period", period, "err", err)
+			return err
+		}
+		if _, err := tx.Exec("rollup_count", new_visitors, returning_visitors, client.NodeID, period, start); err != nil {
+			Log.Error("can not count visitor", "node", client.NodeID, "period", period, "err", err)
+			return err
+		}
+	}
+
+	if closed != nil {
+		return addDwell(tx, closed)
+	}
+	return nil
+}
+
+func addDwell(tx *sqlTx, session *Session) error {
+	for _, period := range rollup_periods {
+		start := periodStart(period, time.Unix(session.Start, 0))
+		if _, err := tx.Exec("rollup_create", session.NodeID, period, start, "[]"); err != nil {
+			Log.Error("can not create rollup", "node", session.NodeID, "period", period, "err", err)
+			return err
+		}
+
+		var text string
+		var hist DwellHistogram
+		err := tx.QueryRow("rollup_dwell_get", session.NodeID, period, start).Scan(&text)
+		if err == nil {
+			err = json.Unmarshal([]byte(text), &hist)
+		}
+		if err != nil {
+			Log.Error("can not read dwell histogram", "node", session.NodeID, "period", period, "err", err)
+			return err
+		}
+		hist = hist.Add(session.Duration)
+		encoded, err := json.Marshal(hist)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("rollup_dwell_set", session.Duration, string(encoded),
+			hist.Percentile(0.5), hist.Percentile(0.9), hist.Percentile(0.99),
+			session.NodeID, period, start)
+		if err != nil {
+			Log.Error("can not add dwell", "node", session.NodeID, "period", period, "err", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// PruneRollupVisitors deletes the devices counted in periods started before
+// before, they are only needed while events of the period arrive.
+func (s *SQLStorage) PruneRollupVisitors(before time.Time) (int64, error) {
+	q := s.dialect.quote
+	result, err := s.db.Exec(s.dialect.Bind(fmt.Sprintf("DELETE FROM %s WHERE %s < ?",
+		q("rollup_visitors"), q("start"))), before.Unix())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func PruneRollupsLoop(s *SQLStorage) {
+	if !rollups_enabled {
+		return
+	}
+	for {
+		pruned, err := s.PruneRollupVisitors(time.Now().Add(-ROLLUP_VISITORS_KEEP))
+		if err != nil {
+			Log.Warn("prune rollup visitors failed", "err", err)
+		} else if pruned > 0 {
+			Log.Debug("pruned rollup visitors", "rows", pruned)
+		}
+		time.Sleep(ROLLUP_PRUNE_INTERVAL)
+	}
+}
+
+type rollupKey struct {
+	node   string
+	period string
+	start  int64
+}
+
+type rollupRow struct {
+	visitors           int64
+	new_visitors       int64
+	returning_visitors int64
+	sessions           int64
+	dwell_total        int64
+	dwell_hist         DwellHistogram
+}
+
+type rollupVisitor struct {
+	key  rollupKey
+	addr string
+}
+
+// periodVisitors are the devices counted in the current period of a node.
+type periodVisitors struct {
+	start int64
+	addrs map[string]struct{}
+}
+
+// BackfillRollups rebuilds the rollups of the periods from since on from
+// the events stored. The events are read first and the rollups written in
+// one transaction.
+func (s *SQLStorage) BackfillRollups(since time.Time) error {
+	q := s.dialect.quote
+	since_unix := since.Unix()
+	if since.IsZero() {
+		since_unix = 0
+	}
+
+	// first seen of every device, including events before since
+	first_seen := make(map[string]int64)
+	rows, err := s.db.Query(fmt.Sprintf("SELECT %s, %s, MIN(%s) FROM %s GROUP BY %s, %s",
+		q("nodeid"), q("addr"), q("timestamp"), q(mysql_table), q("nodeid"), q("addr")))
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var node, addr string
+		var seen int64
+		if err := rows.Scan(&node, &addr, &seen); err != nil {
+			rows.Close()
+			return err
+		}
+		first_seen[node+" "+addr] = seen
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rollups := make(map[rollupKey]*rollupRow)
+	row := func(key rollupKey) *rollupRow {
+		r := rollups[key]
+		if r == nil {
+			r = new(rollupRow)
+			rollups[key] = r
+		}
+		return r
+	}
+	current := make(map[string]*periodVisitors) // period + " " + node
+	open := make(map[string]int64)              // node + " " + addr -> session start
+	var recent []rollupVisitor                  // rows of rollup_visitors to keep
+	keep_since := time.Now().Add(-ROLLUP_VISITORS_KEEP).Unix()
+
+	rows, err = s.db.Query(s.dialect.Bind(fmt.Sprintf("SELECT %s, %s, %s, %s FROM %s WHERE %s >= ? ORDER BY %s, %s",
+		q("nodeid"), q("addr"), q("action"), q("timestamp"), q(mysql_table), q("timestamp"),
+		q("timestamp"), q("id"))), since_unix)
+	if err != nil {
+		return err
+	}
+	events := 0
+	for rows.Next() {
+		var node, addr string
+		var action sql.NullInt64
+		var timestamp int64
+		if err := rows.Scan(&node, &addr, &action, &timestamp); err != nil {
+			rows.Close()
+			return err
+		}
+		events++
+		if events%100000 == 0 {
+			Log.Info("backfilling rollups", "events", events)
+		}
+		received := time.Unix(timestamp, 0)
+
+		for _, period := range rollup_periods {
+			start := periodStart(period, received)
+			visitors := current[period+" "+node]
+			if visitors == nil || visitors.start != start {
+				visitors = &periodVisitors{start: start, addrs: make(map[string]struct{})}
+				current[period+" "+node] = visitors
+			}
+			if _, ok := visitors.addrs[addr]; ok {
+				continue
+			}
+			visitors.addrs[addr] = struct{}{}
+
+			key := rollupKey{node, period, start}
+			r := row(key)
+			r.visitors++
+			if first_seen[node+" "+addr] >= start {
+				r.new_visitors++
+			} else {
+				r.returning_visitors++
+			}
+			if start >= keep_since {
+				recent = append(recent, rollupVisitor{key, addr})
+			}
+		}
+
+		if !sessions_enabled {
+			continue
+		}
+		switch action.Int64 {
+		case 1:
+			if _, ok := open[node+" "+addr]; !ok {
+				open[node+" "+addr] = timestamp
+			}
+		case 2:
+			start, ok := open[node+" "+addr]
+			if !ok {
+				continue
+			}
+			delete(open, node+" "+addr)
+			duration := timestamp - start
+			if session_timeout > 0 && duration > int64(session_timeout/time.Second) {
+				continue // expired before the leave
+			}
+			for _, period := range rollup_periods {
+				r := row(rollupKey{node, period, periodStart(period, time.Unix(start, 0))})
+				r.sessions++
+				r.dwell_total += duration
+				r.dwell_hist = r.dwell_hist.Add(duration)
+			}
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	Log.Info("writing rollups", "events", events, "rollups", len(rollups))
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	statements := []string{
+		fmt.Sprintf("DELETE FROM %s WHERE %s >= ?", q("rollups"), q("start")),
+		fmt.Sprintf("DELETE FROM %s WHERE %s >= ?", q("rollup_visitors"), q("start")),
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(s.dialect.Bind(statement), since_unix); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	_, err = tx.Exec(fmt.Sprintf("DELETE FROM %s", q("visitors")))
+	if err == nil {
+		_, err = tx.Exec(fmt.Sprintf("INSERT INTO %s (%s, %s, %s) SELECT %s, %s, MIN(%s) FROM %s GROUP BY %s, %s",
+			q("visitors"), q("nodeid"), q("addr"), q("first_seen"),
+			q("nodeid"), q("addr"), q("timestamp"), q(mysql_table), q("nodeid"), q("addr")))
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	rollup_stmt, err := tx.Prepare(s.dialect.InsertSQL("rollups", []string{"nodeid", "period", "start",
+		"visitors", "new_visitors", "returning_visitors", "sessions", "dwell_total",
+		"dwell_p50", "dwell_p90", "dwell_p99", "dwell_hist"}))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for key, r := range rollups {
+		if r.dwell_hist == nil {
+			r.dwell_hist = DwellHistogram{}
+		}
+		encoded, err := json.Marshal(r.dwell_hist)
+		if err == nil {
+			_, err = rollup_stmt.Exec(key.node, key.period, key.start,
+				r.visitors, r.new_visitors, r.returning_visitors, r.sessions, r.dwell_total,
+				r.dwell_hist.Percentile(0.5), r.dwell_hist.Percentile(0.9), r.dwell_hist.Percentile(0.99),
+				string(encoded))
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	visitor_stmt, err := tx.Prepare(s.dialect.InsertSQL("rollup_visitors", []string{"nodeid", "period", "start", "addr"}))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, v := range recent {
+		if _, err := visitor_stmt.Exec(v.key.node, v.key.period, v.key.start, v.addr); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// RollupCommand runs "rollup backfill [day]" and exits.
+func RollupCommand(args []string) {
+	usage := commandUsage("rollup backfill [2006-01-02]")
+	if len(args) < 1 || args[0] != "backfill" {
+		usage()
+	}
+	var since time.Time
+	if len(args) > 1 {
+		var err error
+		if since, err = time.ParseInLocation("2006-01-02", args[1], time.Local); err != nil {
+			usage()
+		}
+	}
+
+	RunCommand("rollups", true, func(storage Storage) error {
+		return storage.(*SQLStorage).BackfillRollups(since)
+	})
+}
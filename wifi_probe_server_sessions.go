@@ -0,0 +1,187 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"time"
+)
+
+// A session is the presence of one device at one node, from its join
+// (Action 1) to the following leave (Action 2). The storages maintain them
+// while writing events, in the sessions table of the SQL storages or the
+// sessions-YYYYMMDD.jsonl files of the jsonl storage:
+//
+//	nodeid, addr  node and device
+//	source        From of the join, e.g. "probe" or "sta"
+//	start, end    unix times of the join and leave, end is NULL while the
+//	              session is open
+//	duration      end - start in seconds
+//	peak_rssi     strongest RSSI of the join and leave
+//	expired       1 if the session was closed by -session_timeout
+//
+// A join for a device with an open session at the node, e.g. after the node
+// restarted without sending leaves, continues that session. Sessions open
+// longer than -session_timeout are closed at the time they expire, so a node
+// which disappears does not leave its devices present forever. Duplicate
+// events are not counted twice, events without seq of old nodes can not be
+// recognized as duplicates.
+const (
+	SESSION_EXPIRE_INTERVAL = 10 * time.Minute
+)
+
+var (
+	sessions_enabled bool
+	session_timeout  time.Duration
+)
+
+func init() {
+	flag.BoolVar(&sessions_enabled, "sessions", true, "maintain the sessions table from join and leave events")
+	flag.DurationVar(&session_timeout, "session_timeout", 24*time.Hour, "close sessions open this long, 0 keeps them open")
+}
+
+// Session is one session, End and Duration are 0 while it is open.
+type Session struct {
+	NodeID   string `json:"node_id"`
+	Addr     string `json:"addr"`
+	Source   string `json:"source"`
+	Start    int64  `json:"start"`
+	End      int64  `json:"end"`
+	Duration int64  `json:"duration"`
+	PeakRSSI int    `json:"peak_rssi"`
+	Expired  bool   `json:"expired,omitempty"`
+}
+
+// SessionStorage is implemented by storages keeping sessions.
+type SessionStorage interface {
+	// ExpireSessions closes the sessions started before before at now.
+	ExpireSessions(now, before time.Time) (int64, error)
+	// OpenSessions returns the sessions still open.
+	OpenSessions() ([]*Session, error)
+}
+
+// strongerRSSI is the SQL expression of the stronger of the peak_rssi column
+// and the ? parameter. The RSSI is stored as positive magnitude, see
+// NormalizeRSSI, 0 means unknown.
+const strongerRSSI = `CASE WHEN ? <> 0 AND (peak_rssi = 0 OR ? < peak_rssi) THEN ? ELSE peak_rssi END`
+
+func sessionQueries(d *sqlDialect) map[string]string {
+	q := d.quote
+	open := fmt.Sprintf("%s = ? AND %s = ? AND %s IS NULL", q("nodeid"), q("addr"), q("end"))
+	return map[string]string{
+		"session_join": d.Bind(fmt.Sprintf("UPDATE %s SET %s = %s WHERE %s",
+			q("sessions"), q("peak_rssi"), strongerRSSI, open)),
+		"session_start": d.Bind(fmt.Sprintf("INSERT INTO %s (%s, %s, %s, %s, %s) VALUES (?, ?, ?, ?, ?)",
+			q("sessions"), q("nodeid"), q("addr"), q("source"), q("start"), q("peak_rssi"))),
+		"session_get": d.Bind(fmt.Sprintf("SELECT %s, %s, %s FROM %s WHERE %s",
+			q("source"), q("start"), q("peak_rssi"), q("sessions"), open)),
+		"session_leave": d.Bind(fmt.Sprintf("UPDATE %s SET %s = ?, %s = ? - %s, %s = %s WHERE %s",
+			q("sessions"), q("end"), q("duration"), q("start"), q("peak_rssi"), strongerRSSI, open)),
+	}
+}
+
+// updateSession opens or closes the session of an event just stored, it
+// returns the session a leave closed.
+func updateSession(tx *sqlTx, client *Client, at time.Time) (*Session, error) {
+	now := at.Unix()
+	rssi := client.RSSI
+
+	switch client.Action {
+	case 1:
+		// decided by the open row rather than by rows affected, MySQL
+		// counts an UPDATE which changes nothing as no row
+		var open Session
+		err := tx.QueryRow("session_get", client.NodeID, client.Addr).Scan(&open.Source, &open.Start, &open.PeakRSSI)
+		if err == nil {
+			if _, err = tx.Exec("session_join", rssi, rssi, rssi, client.NodeID, client.Addr); err != nil {
+				Log.Error("can not update session", "node", client.NodeID, "addr", client.Addr, "err", err)
+			}
+			return nil, err
+		}
+		if err != sql.ErrNoRows {
+			Log.Error("can not read session", "node", client.NodeID, "addr", client.Addr, "err", err)
+			return nil, err
+		}
+		_, err = tx.Exec("session_start", client.NodeID, client.Addr, client.From, now, rssi)
+		if err != nil {
+			Log.Error("can not start session", "node", client.NodeID, "addr", client.Addr, "err", err)
+		}
+		return nil, err
+	case 2:
+		session := &Session{NodeID: client.NodeID, Addr: client.Addr, End: now}
+		err := tx.QueryRow("session_get", client.NodeID, client.Addr).Scan(&session.Source, &session.Start, &session.PeakRSSI)
+		if err == sql.ErrNoRows {
+			Log.Debug("leave without open session", "node", client.NodeID, "addr", client.Addr)
+			return nil, nil
+		}
+		if err == nil {
+			_, err = tx.Exec("session_leave", now, now, rssi, rssi, rssi, client.NodeID, client.Addr)
+		}
+		if err != nil {
+			Log.Error("can not end session", "node", client.NodeID, "addr", client.Addr, "err", err)
+			return nil, err
+		}
+		session.Duration = session.End - session.Start
+		session.peak(rssi)
+		return session, nil
+	}
+	return nil, nil
+}
+
+// peak keeps the stronger RSSI, see strongerRSSI.
+func (session *Session) peak(rssi int) {
+	if rssi == 0 {
+		return
+	}
+	if session.PeakRSSI == 0 || rssi < session.PeakRSSI {
+		session.PeakRSSI = rssi
+	}
+}
+
+func (s *SQLStorage) ExpireSessions(now, before time.Time) (int64, error) {
+	q := s.dialect.quote
+	result, err := s.db.Exec(s.dialect.Bind(fmt.Sprintf("UPDATE %s SET %s = ?, %s = ? - %s, %s = 1 WHERE %s IS NULL AND %s < ?",
+		q("sessions"), q("end"), q("duration"), q("start"), q("expired"), q("end"), q("start"))),
+		now.Unix(), now.Unix(), before.Unix())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (s *SQLStorage) OpenSessions() ([]*Session, error) {
+	q := s.dialect.quote
+	rows, err := s.db.Query(fmt.Sprintf("SELECT %s, %s, %s, %s, %s FROM %s WHERE %s IS NULL",
+		q("nodeid"), q("addr"), q("source"), q("start"), q("peak_rssi"), q("sessions"), q("end")))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []*Session
+	for rows.Next() {
+		session := new(Session)
+		if err := rows.Scan(&session.NodeID, &session.Addr, &session.Source, &session.Start, &session.PeakRSSI); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// ExpireSessionsLoop closes sessions open longer than -session_timeout.
+func ExpireSessionsLoop(storage SessionStorage) {
+	if !sessions_enabled || session_timeout <= 0 {
+		return
+	}
+	for {
+		now := time.Now()
+		expired, err := storage.ExpireSessions(now, now.Add(-session_timeout))
+		if err != nil {
+			Log.Warn("expire sessions failed", "err", err)
+		} else if expired > 0 {
+			Log.Info("expired open sessions", "sessions", expired, "timeout", session_timeout)
+		}
+		time.Sleep(SESSION_EXPIRE_INTERVAL)
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+	"strings"
+	"time"
+)
+
+// sqlDialect holds what differs between the SQL databases: driver, quoting,
+// placeholders and how a duplicate (nodeid, seq) is ignored. The schema is
+// in wifi_probe_server_migrate.go.
+type sqlDialect struct {
+	name   string
+	driver string
+	quote  func(name string) string
+	param  func(n int) string // placeholder of the n-th argument, from 1
+	insert string             // INSERT verb
+	ignore string             // appended to ignore duplicates
+
+	column_sql string // counts the columns named $2 of table $1
+}
+
+var dialect_mysql = &sqlDialect{
+	name:   STORAGE_MYSQL,
+	driver: "mysql",
+	quote:  func(name string) string { return "`" + name + "`" },
+	param:  func(n int) string { return "?" },
+	insert: "INSERT INTO",
+	ignore: " ON DUPLICATE KEY UPDATE `id` = `id`",
+	column_sql: "SELECT COUNT(*) FROM information_schema.columns " +
+		"WHERE table_schema = DATABASE() AND table_name = ? AND column_name = ?",
+}
+
+var dialect_postgres = &sqlDialect{
+	name:   STORAGE_POSTGRES,
+	driver: "postgres",
+	quote:  func(name string) string { return `"` + name + `"` },
+	param:  func(n int) string { return fmt.Sprintf("$%d", n) },
+	insert: "INSERT INTO",
+	ignore: " ON CONFLICT DO NOTHING",
+	column_sql: "SELECT COUNT(*) FROM information_schema.columns " +
+		"WHERE table_schema = current_schema() AND table_name = $1 AND column_name = $2",
+}
+
+var dialect_sqlite = &sqlDialect{
+	name:       STORAGE_SQLITE,
+	driver:     "sqlite",
+	quote:      func(name string) string { return `"` + name + `"` },
+	param:      func(n int) string { return "?" },
+	insert:     "INSERT OR IGNORE INTO",
+	column_sql: "SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?",
+}
+
+var (
+	client_columns  = []string{"nodeid", "addr", "from", "model", "rssi", "ssid", "action", "timestamp", "time", "seq"}
+	summary_columns = []string{"nodeid", "start", "interval", "devices", "joins", "leaves",
+		"rssi_hist", "ssid_hist", "timestamp", "time", "seq"}
+)
+
+// InsertSQL returns the statement inserting one row into table, ignoring a
+// row with the same unique key, e.g. (nodeid, seq). The table needs an id
+// column for MySQL.
+func (d *sqlDialect) InsertSQL(table string, columns []string) string {
+	quoted := make([]string, len(columns))
+	params := make([]string, len(columns))
+	for idx, column := range columns {
+		quoted[idx] = d.quote(column)
+		params[idx] = d.param(idx + 1)
+	}
+	return fmt.Sprintf("%s %s (%s) VALUES (%s)%s", d.insert, d.quote(table),
+		strings.Join(quoted, ", "), strings.Join(params, ", "), d.ignore)
+}
+
+// Bind turns the ? placeholders of query into those of the dialect.
+func (d *sqlDialect) Bind(query string) string {
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString(d.param(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+type SQLStorage struct {
+	db      *sql.DB
+	dialect *sqlDialect
+
+	// used by the writer goroutine only
+	migrated    bool
+	partitioned bool              // events table partitioned by day
+	queries     map[string]string // name -> statement, prepared by ready
+	stmts       map[string]*sql.Stmt
+}
+
+// sqlTx is a transaction of one write using the prepared statements.
+type sqlTx struct {
+	*sql.Tx
+	s     *SQLStorage
+	stmts map[string]*sql.Stmt
+}
+
+// Exec runs the prepared statement name within the transaction.
+func (tx *sqlTx) Exec(name string, args ...interface{}) (sql.Result, error) {
+	return tx.stmt(name).Exec(args...)
+}
+
+// QueryRow runs the prepared query name within the transaction.
+func (tx *sqlTx) QueryRow(name string, args ...interface{}) *sql.Row {
+	return tx.stmt(name).QueryRow(args...)
+}
+
+func (tx *sqlTx) stmt(name string) *sql.Stmt {
+	stmt := tx.stmts[name]
+	if stmt == nil {
+		stmt = tx.Tx.Stmt(tx.s.stmts[name])
+		tx.stmts[name] = stmt
+	}
+	return stmt
+}
+
+// NewSQLStorage opens the database, the schema is migrated on the first
+// write. A database which can not be reached yet is only logged, inserts fail
+// until it is up.
+func NewSQLStorage(dialect *sqlDialect, dsn string) (*SQLStorage, error) {
+	if dsn == "" {
+		return nil, fmt.Errorf("%s storage needs -storage_dsn", dialect.name)
+	}
+	db, err := sql.Open(dialect.driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if dialect == dialect_sqlite {
+		// one writer at a time, concurrent writes only fail with SQLITE_BUSY
+		db.SetMaxOpenConns(1)
+	}
+
+	s := &SQLStorage{
+		db:      db,
+		dialect: dialect,
+		queries: map[string]string{
+			"client":  dialect.InsertSQL(mysql_table, client_columns),
+			"summary": dialect.InsertSQL(mysql_summary_table, summary_columns),
+		},
+	}
+	for _, queries := range []map[string]string{sessionQueries(dialect), rollupQueries(dialect), nodeQueries(dialect)} {
+		for name, query := range queries {
+			s.queries[name] = query
+		}
+	}
+	if err := db.Ping(); err != nil {
+		Log.Error("failed ping database", "storage", dialect.name, "err", err)
+	}
+	return s, nil
+}
+
+// nullSeq stores seq 0 of old nodes as NULL, which the unique key on
+// (nodeid, seq) does not deduplicate.
+func nullSeq(seq uint64) interface{} {
+	if seq == 0 {
+		return nil
+	}
+	return seq
+}
+
+// ready migrates the schema and prepares the inserts once, a database that
+// was down at startup is tried again on the next write.
+func (s *SQLStorage) ready() error {
+	if s.stmts != nil {
+		return nil
+	}
+	if !s.migrated {
+		var err error
+		if auto_migrate {
+			err = s.Migrate()
+		} else {
+			err = s.CheckSchema()
+		}
+		if err != nil {
+			return err
+		}
+		s.migrated = true
+
+		partitioned, err := s.EventsPartitioned()
+		if err != nil {
+			return err
+		}
+		if partitioned {
+			if err := s.EnsurePartitions(time.Now()); err != nil {
+				return err
+			}
+			q := s.dialect.quote
+			s.queries["client_seen"] = s.dialect.Bind(fmt.Sprintf("SELECT 1 FROM %s WHERE %s = ? AND %s = ? AND %s >= ? LIMIT 1",
+				q(mysql_table), q("nodeid"), q("seq"), q("timestamp")))
+		}
+		s.partitioned = partitioned
+	}
+
+	stmts := make(map[string]*sql.Stmt)
+	for name, query := range s.queries {
+		stmt, err := s.db.Prepare(query)
+		if err != nil {
+			for _, stmt := range stmts {
+				stmt.Close()
+			}
+			return fmt.Errorf("prepare %s: %s", name, err)
+		}
+		stmts[name] = stmt
+	}
+	s.stmts = stmts
+	return nil
+}
+
+// Write inserts records in one transaction, rows with the same node and seq
+// as an existing one are kept as they are.
+func (s *SQLStorage) Write(records []*Record) error {
+	if err := s.ready(); err != nil {
+		Log.Error("database not ready", "storage", s.dialect.name, "err", err)
+		return err
+	}
+
+	db_tx, err := s.db.Begin()
+	if err != nil {
+		Log.Error("can not begin transaction", "storage", s.dialect.name, "err", err)
+		return err
+	}
+	tx := &sqlTx{db_tx, s, make(map[string]*sql.Stmt)}
+	for _, record := range records {
+		if record.Client != nil {
+			var inserted bool
+			var closed *Session
+			inserted, err = insertClient(tx, record.Client, record.Time())
+			record.Duplicate = !inserted
+			if err == nil && inserted {
+				err = countNode(tx, record.Client, record.Time())
+			}
+			if err == nil && inserted && sessions_enabled {
+				closed, err = updateSession(tx, record.Client, record.Time())
+			}
+			if err == nil && inserted && rollups_enabled {
+				err = updateRollups(tx, record.Client, record.Time(), closed)
+			}
+		}
+		if err == nil && record.Summary != nil {
+			err = insertSummary(tx, record.Summary, record.Time())
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		Log.Error("can not commit", "storage", s.dialect.name, "err", err)
+		return err
+	}
+	return nil
+}
+
+// insertClient returns false for a duplicate event.
+func insertClient(tx *sqlTx, client *Client, at time.Time) (bool, error) {
+	if tx.s.partitioned && client.Seq != 0 && at.Unix() != client.Time {
+		// the unique key of a partitioned table includes the timestamp,
+		// which only a capture time keeps the same for a retransmit
+		if seen, err := clientSeen(tx, client, at); err != nil || seen {
+			if err != nil {
+				Log.Error("can not look up event", "node", client.NodeID, "seq", client.Seq, "err", err)
+			} else {
+				Log.Debug("skip duplicate event", "node", client.NodeID, "seq", client.Seq)
+			}
+			return false, err
+		}
+	}
+	result, err := tx.Exec("client", client.NodeID, client.Addr, client.From, client.Model,
+		client.RSSI, client.SSID, client.Action, at.Unix(), at.Format("2006-01-02 15:04:05"),
+		nullSeq(client.Seq))
+	if err != nil {
+		Log.Error("can not insert event", "node", client.NodeID, "seq", client.Seq, "err", err)
+		return false, err
+	}
+	if rows, err := result.RowsAffected(); err == nil && rows == 0 {
+		Log.Debug("skip duplicate event", "node", client.NodeID, "seq", client.Seq)
+		return false, nil
+	}
+	return true, nil
+}
+
+func insertSummary(tx *sqlTx, summary *Summary, at time.Time) error {
+	rssi_hist, err := json.Marshal(summary.RSSI)
+	if err != nil {
+		Log.Error("can not encode rssi histogram", "err", err)
+		return err
+	}
+	ssid_hist, err := json.Marshal(summary.SSID)
+	if err != nil {
+		Log.Error("can not encode ssid histogram", "err", err)
+		return err
+	}
+
+	_, err = tx.Exec("summary", summary.NodeID, summary.Start, summary.Interval, summary.Devices,
+		summary.Joins, summary.Leaves, string(rssi_hist), string(ssid_hist),
+		at.Unix(), at.Format("2006-01-02 15:04:05"), nullSeq(summary.Seq))
+	if err != nil {
+		Log.Error("can not insert summary", "node", summary.NodeID, "seq", summary.Seq, "err", err)
+		return err
+	}
+	return nil
+}
+
+func (s *SQLStorage) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// The storage tests run on SQLite in a temporary directory, the statements
+// of MySQL and PostgreSQL are not covered:
+//
+//	make test
+
+const TEST_NODE_ID = "00:1b:63:84:45:e6"
+
+// test_start is a fixed hour, the records are captured relative to it.
+var test_start = time.Date(2015, 6, 1, 10, 0, 0, 0, time.Local).Unix()
+
+func testSQLStorage(t *testing.T) *SQLStorage {
+	s, err := NewSQLStorage(dialect_sqlite, filepath.Join(t.TempDir(), "probe.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	if err := s.ready(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// testEvent is an event captured offset seconds after test_start and
+// received a second later.
+func testEvent(addr string, action int, rssi int, seq uint64, offset int64) *Record {
+	at := test_start + offset
+	return &Record{
+		Client: &Client{Seq: seq, NodeID: TEST_NODE_ID, Addr: addr, From: "probe",
+			RSSI: rssi, Action: action, Time: at},
+		Received: time.Unix(at+1, 0),
+	}
+}
+
+func writeRecords(t *testing.T, storage Storage, records ...*Record) {
+	t.Helper()
+	if err := storage.Write(records); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func countRows(t *testing.T, s *SQLStorage, table string) int {
+	t.Helper()
+	var rows int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM " + s.dialect.quote(table)).Scan(&rows); err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+// sqlSessions returns the sessions of the table, oldest first.
+func sqlSessions(t *testing.T, s *SQLStorage) []Session {
+	t.Helper()
+	rows, err := s.db.Query(`SELECT "nodeid", "addr", "source", "start", COALESCE("end", 0), ` +
+		`COALESCE("duration", 0), "peak_rssi", "expired" FROM "sessions" ORDER BY "id"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var sessions []Session
+	for rows.Next() {
+		var session Session
+		if err := rows.Scan(&session.NodeID, &session.Addr, &session.Source, &session.Start,
+			&session.End, &session.Duration, &session.PeakRSSI, &session.Expired); err != nil {
+			t.Fatal(err)
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
+func TestSQLWriteDedup(t *testing.T) {
+	s := testSQLStorage(t)
+
+	writeRecords(t, s, testEvent("aa:00", 1, 60, 1, 0), testEvent("aa:01", 1, 60, 2, 0))
+	// a retransmit after a reconnect, seq 2 again, and old node events
+	// without seq which can not be told apart
+	records := []*Record{testEvent("aa:01", 1, 60, 2, 0), testEvent("aa:02", 1, 60, 0, 5), testEvent("aa:02", 1, 60, 0, 5)}
+	writeRecords(t, s, records...)
+
+	for idx, duplicate := range []bool{true, false, false} {
+		if records[idx].Duplicate != duplicate {
+			t.Errorf("record %d: Duplicate = %v, want %v", idx, records[idx].Duplicate, duplicate)
+		}
+	}
+	if rows := countRows(t, s, "clients"); rows != 4 {
+		t.Errorf("%d events stored, want 4", rows)
+	}
+	var events int
+	if err := s.db.QueryRow(`SELECT "events" FROM "nodes" WHERE "nodeid" = ?`, TEST_NODE_ID).Scan(&events); err != nil {
+		t.Fatal(err)
+	}
+	if events != 4 {
+		t.Errorf("node counted %d events, want 4", events)
+	}
+}
+
+func TestSQLMigrateUpDown(t *testing.T) {
+	s, err := NewSQLStorage(dialect_sqlite, filepath.Join(t.TempDir(), "probe.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := s.CheckSchema(); err == nil {
+		t.Error("CheckSchema of an empty database passed")
+	}
+	if err := s.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	latest := migrations[len(migrations)-1].version
+	if version, err := s.LatestMigration(); err != nil || version != latest {
+		t.Fatalf("LatestMigration() = %d, %v, want %d", version, err, latest)
+	}
+	if err := s.CheckSchema(); err != nil {
+		t.Error(err)
+	}
+
+	if err := s.Rollback(1); err != nil {
+		t.Fatal(err)
+	}
+	if version, _ := s.LatestMigration(); version != 1 {
+		t.Errorf("rolled back to %d, want 1", version)
+	}
+	if has, err := s.HasColumn("clients", "seq"); err != nil || has {
+		t.Errorf("clients has seq after rolling back migration 2: %v, %v", has, err)
+	}
+
+	if err := s.Rollback(0); err != nil {
+		t.Fatal(err)
+	}
+	var tables int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' ` +
+		`AND name NOT IN ('schema_migrations', 'sqlite_sequence')`).Scan(&tables); err != nil {
+		t.Fatal(err)
+	}
+	if tables != 0 {
+		t.Errorf("%d tables left after rolling back every migration", tables)
+	}
+
+	// and up again from nothing
+	if err := s.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ready(); err != nil {
+		t.Fatal(err)
+	}
+	writeRecords(t, s, testEvent("aa:00", 1, 60, 1, 0))
+}
+
+func TestSQLSessions(t *testing.T) {
+	s := testSQLStorage(t)
+
+	writeRecords(t, s,
+		testEvent("aa:00", 1, 70, 1, 0),
+		// a second join continues the session, the stronger rssi is kept
+		testEvent("aa:00", 1, 55, 2, 60),
+		testEvent("aa:00", 2, 65, 3, 300),
+		// a leave without a join opens nothing
+		testEvent("aa:01", 2, 60, 4, 310),
+		testEvent("aa:02", 1, 60, 5, 400),
+	)
+	sessions := sqlSessions(t, s)
+	want := []Session{
+		{NodeID: TEST_NODE_ID, Addr: "aa:00", Source: "probe", Start: test_start, End: test_start + 300,
+			Duration: 300, PeakRSSI: 55},
+		{NodeID: TEST_NODE_ID, Addr: "aa:02", Source: "probe", Start: test_start + 400, PeakRSSI: 60},
+	}
+	if !reflect.DeepEqual(sessions, want) {
+		t.Errorf("sessions\n%+v\nwant\n%+v", sessions, want)
+	}
+
+	open, err := s.OpenSessions()
+	if err != nil || len(open) != 1 || open[0].Addr != "aa:02" {
+		t.Errorf("OpenSessions() = %+v, %v", open, err)
+	}
+
+	// only sessions started before the timeout expire
+	now := time.Unix(test_start+3600, 0)
+	if expired, err := s.ExpireSessions(now, time.Unix(test_start+400, 0)); err != nil || expired != 0 {
+		t.Errorf("ExpireSessions before the start = %d, %v", expired, err)
+	}
+	if expired, err := s.ExpireSessions(now, time.Unix(test_start+401, 0)); err != nil || expired != 1 {
+		t.Errorf("ExpireSessions = %d, %v, want 1", expired, err)
+	}
+	last := sqlSessions(t, s)[1]
+	if !last.Expired || last.End != now.Unix() || last.Duration != 3200 {
+		t.Errorf("expired session %+v", last)
+	}
+	if open, _ := s.OpenSessions(); len(open) != 0 {
+		t.Errorf("sessions still open: %+v", open)
+	}
+}
+
+type testRollup struct {
+	NodeID                                   string
+	Period                                   string
+	Start                                    int64
+	Visitors, NewVisitors, ReturningVisitors int
+	Sessions                                 int
+	DwellTotal, DwellP50, DwellP90, DwellP99 int64
+	DwellHist                                string
+}
+
+func sqlRollups(t *testing.T, s *SQLStorage) []testRollup {
+	t.Helper()
+	rows, err := s.db.Query(`SELECT "nodeid", "period", "start", "visitors", "new_visitors", "returning_visitors", ` +
+		`"sessions", "dwell_total", "dwell_p50", "dwell_p90", "dwell_p99", "dwell_hist" FROM "rollups" ` +
+		`ORDER BY "nodeid", "period", "start"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var rollups []testRollup
+	for rows.Next() {
+		var r testRollup
+		if err := rows.Scan(&r.NodeID, &r.Period, &r.Start, &r.Visitors, &r.NewVisitors, &r.ReturningVisitors,
+			&r.Sessions, &r.DwellTotal, &r.DwellP50, &r.DwellP90, &r.DwellP99, &r.DwellHist); err != nil {
+			t.Fatal(err)
+		}
+		rollups = append(rollups, r)
+	}
+	return rollups
+}
+
+func TestSQLRollupBackfill(t *testing.T) {
+	s := testSQLStorage(t)
+
+	writeRecords(t, s,
+		testEvent("aa:00", 1, 60, 1, 0),
+		testEvent("aa:01", 1, 60, 2, 100),
+		testEvent("aa:00", 2, 60, 3, 700),
+		// aa:00 returns in the next hour, aa:02 is new
+		testEvent("aa:00", 1, 60, 4, 3700),
+		testEvent("aa:02", 1, 60, 5, 3800),
+		testEvent("aa:02", 2, 60, 6, 3900),
+		testEvent("aa:00", 2, 60, 7, 5500),
+	)
+	incremental := sqlRollups(t, s)
+	if len(incremental) != 3 {
+		t.Fatalf("%d rollups, want 2 hours and 1 day: %+v", len(incremental), incremental)
+	}
+	day := incremental[0]
+	if day.Period != ROLLUP_DAY || day.Visitors != 3 || day.NewVisitors != 3 || day.Sessions != 3 ||
+		day.DwellTotal != 700+100+1800 {
+		t.Errorf("day rollup %+v", day)
+	}
+	second := incremental[2]
+	if second.Visitors != 2 || second.NewVisitors != 1 || second.ReturningVisitors != 1 || second.Sessions != 2 {
+		t.Errorf("second hour rollup %+v", second)
+	}
+
+	if err := s.BackfillRollups(time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if backfilled := sqlRollups(t, s); !reflect.DeepEqual(backfilled, incremental) {
+		t.Errorf("backfilled rollups\n%+v\ndiffer from incremental\n%+v", backfilled, incremental)
+	}
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+)
+
+// The time series output turns the stored events and the rollups into
+// series for Grafana, written every -timeseries_interval:
+//
+//	wifi_probe_presence,node=<id> devices=12i
+//	wifi_probe_events,node=<id> joins=4i,leaves=3i
+//	wifi_probe_rollup,node=<id>,period=hour visitors=40i,new_visitors=8i,returning_visitors=32i,
+//	                  sessions=35i,dwell_p50=420i,dwell_p90=1800i,dwell_p99=5400i
+//
+// devices are the devices present at the node, joined and not left since,
+// initialized from the open sessions at startup. joins and leaves count the
+// events stored in the interval, joins per minute with the default interval;
+// events a node replays after an outage count in the interval they arrive. The
+// rollup series are the hour and day in progress of the SQL storages.
+//
+// -influx_url takes InfluxDB line protocol:
+//
+//	http://influxdb:8086/api/v2/write?org=ops&bucket=wifi_probe  with -influx_token
+//	http://influxdb:8086/write?db=wifi_probe                     InfluxDB 1.x
+//	udp://telegraf:8089
+//	file:///var/lib/wifi_probe/series.lp                         appended
+//
+// -prom_remote_write sends the same series to a Prometheus remote write
+// endpoint, named <measurement>_<field> with the tags as labels, e.g.
+// wifi_probe_presence_devices{node="..."}. Points which can not be written
+// are dropped, the next interval sends current values again.
+const (
+	INFLUX_UDP_PAYLOAD = 1400
+	TIMESERIES_TIMEOUT = 10 * time.Second
+)
+
+var (
+	timeseries_interval time.Duration
+	influx_url          string
+	influx_token        string
+	prom_remote_write   string
+)
+
+func init() {
+	flag.DurationVar(&timeseries_interval, "timeseries_interval", time.Minute, "interval of the time series output")
+	flag.StringVar(&influx_url, "influx_url", "", "write time series as InfluxDB line protocol to this http, udp or file url")
+	flag.StringVar(&influx_token, "influx_token", "", "token of the InfluxDB http api")
+	flag.StringVar(&prom_remote_write, "prom_remote_write", "", "write time series to this Prometheus remote write url")
+}
+
+// Point is one point of a series.
+type Point struct {
+	Measurement string
+	Tags        map[string]string
+	Fields      map[string]int64
+	Time        time.Time
+}
+
+type PointWriter interface {
+	WritePoints(points []*Point) error
+}
+
+// TimeSeries follows the presence and events of every node.
+type TimeSeries struct {
+	lock    *sync.Mutex
+	present map[string]map[string]time.Time // node -> addr -> last event
+	joins   map[string]int64
+	leaves  map[string]int64
+	outputs []PointWriter
+}
+
+func NewTimeSeries(outputs []PointWriter) *TimeSeries {
+	return &TimeSeries{
+		lock:    new(sync.Mutex),
+		present: make(map[string]map[string]time.Time),
+		joins:   make(map[string]int64),
+		leaves:  make(map[string]int64),
+		outputs: outputs,
+	}
+}
+
+// OpenTimeSeries returns nil if no output is configured.
+func OpenTimeSeries() (*TimeSeries, error) {
+	var outputs []PointWriter
+	if influx_url != "" {
+		output, err := NewInfluxWriter(influx_url)
+		if err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, output)
+	}
+	if prom_remote_write != "" {
+		outputs = append(outputs, &PromWriter{url: prom_remote_write})
+	}
+	if len(outputs) == 0 {
+		return nil, nil
+	}
+	return NewTimeSeries(outputs), nil
+}
+
+func (t *TimeSeries) devices(node_id string) map[string]time.Time {
+	devices := t.present[node_id]
+	if devices == nil {
+		devices = make(map[string]time.Time)
+		t.present[node_id] = devices
+	}
+	return devices
+}
+
+// Load starts from the sessions open in storage.
+func (t *TimeSeries) Load(sessions []*Session) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, session := range sessions {
+		t.devices(session.NodeID)[session.Addr] = time.Unix(session.Start, 0)
+	}
+}
+
+// Observe is the writer observer.
+func (t *TimeSeries) Observe(record *Record) {
+	client := record.Client
+	if client == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	devices := t.devices(client.NodeID)
+	switch client.Action {
+	case 1:
+		devices[client.Addr] = record.Time()
+		t.joins[client.NodeID]++
+	case 2:
+		delete(devices, client.Addr)
+		t.leaves[client.NodeID]++
+	default:
+		if _, ok := devices[client.Addr]; ok {
+			devices[client.Addr] = record.Time()
+		}
+	}
+}
+
+// Collect returns the points of now and starts the next interval. Devices
+// without events for -session_timeout are no longer counted as present.
+func (t *TimeSeries) Collect(now time.Time) []*Point {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	var points []*Point
+	for node_id, devices := range t.present {
+		if session_timeout > 0 {
+			for addr, seen := range devices {
+				if now.Sub(seen) > session_timeout {
+					delete(devices, addr)
+				}
+			}
+		}
+		tags := map[string]string{"node": node_id}
+		points = append(points, &Point{
+			Measurement: "wifi_probe_presence",
+			Tags:        tags,
+			Fields:      map[string]int64{"devices": int64(len(devices))},
+			Time:        now,
+		}, &Point{
+			Measurement: "wifi_probe_events",
+			Tags:        tags,
+			Fields:      map[string]int64{"joins": t.joins[node_id], "leaves": t.leaves[node_id]},
+			Time:        now,
+		})
+	}
+	t.joins = make(map[string]int64)
+	t.leaves = make(map[string]int64)
+	return points
+}
+
+func (t *TimeSeries) Run(storage Storage) {
+	ticker := time.NewTicker(timeseries_interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		points := t.Collect(now)
+		if s, ok := storage.(*SQLStorage); ok && rollups_enabled {
+			rollups, err := s.RollupPoints(now)
+			if err != nil {
+				Log.Warn("can not read rollups for time series", "err", err)
+			}
+			points = append(points, rollups...)
+		}
+		if len(points) == 0 {
+			continue
+		}
+		for _, output := range t.outputs {
+			if err := output.WritePoints(points); err != nil {
+				Log.Warn("write time series failed", "output", fmt.Sprintf("%T", output), "points", len(points), "err", err)
+			}
+		}
+	}
+}
+
+// RollupPoints returns the rollups of the hour and day containing now.
+func (s *SQLStorage) RollupPoints(now time.Time) ([]*Point, error) {
+	q := s.dialect.quote
+	fields := []string{"visitors", "new_visitors", "returning_visitors", "sessions", "dwell_p50", "dwell_p90", "dwell_p99"}
+	quoted := make([]string, len(fields))
+	for idx, field := range fields {
+		quoted[idx] = q(field)
+	}
+	rows, err := s.db.Query(s.dialect.Bind(fmt.Sprintf(
+		"SELECT %s, %s, %s FROM %s WHERE (%s = ? AND %s = ?) OR (%s = ? AND %s = ?)",
+		q("nodeid"), q("period"), strings.Join(quoted, ", "), q("rollups"),
+		q("period"), q("start"), q("period"), q("start"))),
+		ROLLUP_HOUR, periodStart(ROLLUP_HOUR, now), ROLLUP_DAY, periodStart(ROLLUP_DAY, now))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var points []*Point
+	for rows.Next() {
+		var node_id, period string
+		values := make([]int64, len(fields))
+		dest := []interface{}{&node_id, &period}
+		for idx := range values {
+			dest = append(dest, &values[idx])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		point := &Point{
+			Measurement: "wifi_probe_rollup",
+			Tags:        map[string]string{"node": node_id, "period": period},
+			Fields:      make(map[string]int64, len(fields)),
+			Time:        now,
+		}
+		for idx, field := range fields {
+			point.Fields[field] = values[idx]
+		}
+		points = append(points, point)
+	}
+	return points, rows.Err()
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch m := m.(type) {
+	case map[string]string:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	case map[string]int64:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var (
+	influx_measurement_escaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	influx_tag_escaper         = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+)
+
+// Line returns the point in InfluxDB line protocol, without newline.
+func (p *Point) Line() string {
+	var b strings.Builder
+	b.WriteString(influx_measurement_escaper.Replace(p.Measurement))
+	for _, key := range sortedKeys(p.Tags) {
+		if p.Tags[key] == "" {
+			continue
+		}
+		fmt.Fprintf(&b, ",%s=%s", influx_tag_escaper.Replace(key), influx_tag_escaper.Replace(p.Tags[key]))
+	}
+	for idx, key := range sortedKeys(p.Fields) {
+		sep := ","
+		if idx == 0 {
+			sep = " "
+		}
+		fmt.Fprintf(&b, "%s%s=%di", sep, influx_tag_escaper.Replace(key), p.Fields[key])
+	}
+	fmt.Fprintf(&b, " %d", p.Time.UnixNano())
+	return b.String()
+}
+
+// InfluxWriter writes line protocol to an http, udp or file url.
+type InfluxWriter struct {
+	url    *url.URL
+	client *http.Client
+	conn   net.Conn
+	fp     *os.File
+}
+
+func NewInfluxWriter(raw string) (*InfluxWriter, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	w := &InfluxWriter{url: u}
+	switch u.Scheme {
+	case "http", "https":
+		w.client = &http.Client{Timeout: TIMESERIES_TIMEOUT}
+	case "udp":
+		if w.conn, err = net.Dial("udp", u.Host); err != nil {
+			return nil, err
+		}
+	case "file":
+		if w.fp, err = os.OpenFile(u.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown scheme of -influx_url %q", raw)
+	}
+	return w, nil
+}
+
+func (w *InfluxWriter) WritePoints(points []*Point) error {
+	lines := make([]string, len(points))
+	for idx, point := range points {
+		lines[idx] = point.Line() + "\n"
+	}
+
+	switch {
+	case w.conn != nil:
+		// one datagram per INFLUX_UDP_PAYLOAD, lines are never split
+		var payload []byte
+		for _, line := range lines {
+			if len(payload) > 0 && len(payload)+len(line) > INFLUX_UDP_PAYLOAD {
+				if _, err := w.conn.Write(payload); err != nil {
+					return err
+				}
+				payload = payload[:0]
+			}
+			payload = append(payload, line...)
+		}
+		_, err := w.conn.Write(payload)
+		return err
+	case w.fp != nil:
+		_, err := w.fp.WriteString(strings.Join(lines, ""))
+		return err
+	}
+
+	request, err := http.NewRequest("POST", w.url.String(), strings.NewReader(strings.Join(lines, "")))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if influx_token != "" {
+		request.Header.Set("Authorization", "Token "+influx_token)
+	}
+	return doRequest(w.client, request)
+}
+
+func doRequest(client *http.Client, request *http.Request) error {
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(response.Body, 512))
+		return fmt.Errorf("%s: %s", response.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// PromWriter sends points with the Prometheus remote write protocol, a
+// snappy compressed protobuf WriteRequest.
+type PromWriter struct {
+	url    string
+	client *http.Client
+}
+
+func (w *PromWriter) WritePoints(points []*Point) error {
+	if w.client == nil {
+		w.client = &http.Client{Timeout: TIMESERIES_TIMEOUT}
+	}
+	request, err := http.NewRequest("POST", w.url, bytes.NewReader(snappy.Encode(nil, promWriteRequest(points))))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Encoding", "snappy")
+	request.Header.Set("Content-Type", "application/x-protobuf")
+	request.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	return doRequest(w.client, request)
+}
+
+// promWriteRequest encodes
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+func promWriteRequest(points []*Point) []byte {
+	var request []byte
+	for _, point := range points {
+		for _, field := range sortedKeys(point.Fields) {
+			labels := map[string]string{"__name__": point.Measurement + "_" + field}
+			for key, value := range point.Tags {
+				labels[key] = value
+			}
+
+			var series []byte
+			for _, name := range sortedKeys(labels) {
+				var label []byte
+				label = protoBytes(label, 1, []byte(name))
+				label = protoBytes(label, 2, []byte(labels[name]))
+				series = protoBytes(series, 1, label)
+			}
+			sample := protoVarint(nil, 1<<3|1) // fixed64
+			var value [8]byte
+			binary.LittleEndian.PutUint64(value[:], math.Float64bits(float64(point.Fields[field])))
+			sample = append(sample, value[:]...)
+			sample = protoVarint(sample, 2<<3|0)
+			sample = protoVarint(sample, uint64(point.Time.UnixNano()/int64(time.Millisecond)))
+			series = protoBytes(series, 2, sample)
+
+			request = protoBytes(request, 1, series)
+		}
+	}
+	return request
+}
+
+func protoVarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+// protoBytes appends a length delimited field.
+func protoBytes(b []byte, field int, data []byte) []byte {
+	b = protoVarint(b, uint64(field)<<3|2)
+	b = protoVarint(b, uint64(len(data)))
+	return append(b, data...)
+}
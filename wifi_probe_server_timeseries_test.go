@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestPointLine(t *testing.T) {
+	point := &Point{
+		Measurement: "wifi probe,x",
+		Tags:        map[string]string{"node": "a b,c=d", "empty": ""},
+		Fields:      map[string]int64{"joins": 4, "devices": 12},
+		Time:        time.Unix(1433160000, 0),
+	}
+	want := `wifi\ probe\,x,node=a\ b\,c\=d devices=12i,joins=4i 1433160000000000000`
+	if line := point.Line(); line != want {
+		t.Errorf("Line() = %s\nwant        %s", line, want)
+	}
+}
+
+func TestPromWriteRequest(t *testing.T) {
+	point := &Point{
+		Measurement: "m",
+		Tags:        map[string]string{"node": "n1"},
+		Fields:      map[string]int64{"v": 2},
+		Time:        time.Unix(1, 0),
+	}
+	// labels sorted by name, the sample is the double 2 and 1000 ms
+	want := []byte("\x0a\x2b" +
+		"\x0a\x0f" + "\x0a\x08__name__" + "\x12\x03m_v" +
+		"\x0a\x0a" + "\x0a\x04node" + "\x12\x02n1" +
+		"\x12\x0c" + "\x09\x00\x00\x00\x00\x00\x00\x00\x40" + "\x10\xe8\x07")
+	if request := promWriteRequest([]*Point{point}); !bytes.Equal(request, want) {
+		t.Errorf("promWriteRequest() = % x\nwant                % x", request, want)
+	}
+
+	// one series per field
+	point.Fields["w"] = 3
+	if request := promWriteRequest([]*Point{point}); len(request) != 2*len(want) {
+		t.Errorf("two fields encoded to %d bytes, want %d", len(request), 2*len(want))
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// With -tls_cert and -tls_key the server speaks TLS on listen_addr and every
+// node must present a certificate issued by a CA of -tls_client_ca. The
+// common name of the certificate is the node id, ids sent in the payload are
+// ignored. Certificates listed in -tls_crl are refused; the CRL file is
+// re-read when it changes, so revoking a node needs no restart.
+//
+// -plain_listen_addr keeps a plaintext listener for nodes not yet migrated.
+var (
+	tls_cert          string
+	tls_key           string
+	tls_client_ca     string
+	tls_crl           string
+	plain_listen_addr string
+
+	crl_lock  *sync.Mutex
+	crl_mtime time.Time
+	crl_lists []*x509.RevocationList
+)
+
+func init() {
+	flag.StringVar(&tls_cert, "tls_cert", "", "server certificate file (PEM), enables TLS on listen_addr")
+	flag.StringVar(&tls_key, "tls_key", "", "private key file of tls_cert (PEM)")
+	flag.StringVar(&tls_client_ca, "tls_client_ca", "", "CA bundle node certificates must be issued by")
+	flag.StringVar(&tls_crl, "tls_crl", "", "certificate revocation list file (PEM or DER), reloaded on change")
+	flag.StringVar(&plain_listen_addr, "plain_listen_addr", "", "additional plaintext listen address for nodes without TLS")
+
+	crl_lock = new(sync.Mutex)
+}
+
+func TLSEnabled() bool {
+	return tls_cert != ""
+}
+
+func ServerTLSConfig() (*tls.Config, error) {
+	if tls_key == "" || tls_client_ca == "" {
+		return nil, fmt.Errorf("tls_cert needs tls_key and tls_client_ca")
+	}
+
+	cert, err := tls.LoadX509KeyPair(tls_cert, tls_key)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := LoadCertPool(tls_client_ca)
+	if err != nil {
+		return nil, err
+	}
+	if tls_crl != "" {
+		if _, err := LoadCRL(); err != nil {
+			return nil, err
+		}
+	}
+
+	return &tls.Config{
+		MinVersion:            tls.VersionTLS12,
+		Certificates:          []tls.Certificate{cert},
+		ClientAuth:            tls.RequireAndVerifyClientCert,
+		ClientCAs:             pool,
+		VerifyPeerCertificate: CheckRevoked,
+	}, nil
+}
+
+// LoadCRL returns the revocation lists of tls_crl, parsing the file again if
+// it was modified since the last call.
+func LoadCRL() ([]*x509.RevocationList, error) {
+	crl_lock.Lock()
+	defer crl_lock.Unlock()
+
+	info, err := os.Stat(tls_crl)
+	if err != nil {
+		return nil, err
+	}
+	if info.ModTime().Equal(crl_mtime) {
+		return crl_lists, nil
+	}
+
+	data, err := ioutil.ReadFile(tls_crl)
+	if err != nil {
+		return nil, err
+	}
+
+	var lists []*x509.RevocationList
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----")) {
+		for {
+			var block *pem.Block
+			block, data = pem.Decode(data)
+			if block == nil {
+				break
+			}
+			if block.Type != "X509 CRL" {
+				continue
+			}
+			list, err := x509.ParseRevocationList(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", tls_crl, err)
+			}
+			lists = append(lists, list)
+		}
+	} else {
+		list, err := x509.ParseRevocationList(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", tls_crl, err)
+		}
+		lists = append(lists, list)
+	}
+	if len(lists) == 0 {
+		return nil, fmt.Errorf("%s: no revocation list found", tls_crl)
+	}
+
+	revoked := 0
+	for _, list := range lists {
+		revoked += len(list.RevokedCertificateEntries)
+		if !list.NextUpdate.IsZero() && list.NextUpdate.Before(time.Now()) {
+			Log.Warn("revocation list is out of date", "file", tls_crl, "issuer", list.Issuer,
+				"next_update", list.NextUpdate.Format("2006-01-02 15:04:05"))
+		}
+	}
+	Log.Info("revocation list loaded", "file", tls_crl, "lists", len(lists), "revoked", revoked)
+
+	crl_mtime = info.ModTime()
+	crl_lists = lists
+	return lists, nil
+}
+
+// CheckRevoked refuses a node whose certificate, or an intermediate of its
+// chain, is listed in a revocation list signed by the issuer.
+func CheckRevoked(raw_certs [][]byte, chains [][]*x509.Certificate) error {
+	if tls_crl == "" {
+		return nil
+	}
+
+	lists, err := LoadCRL()
+	if err != nil {
+		// keep the last good lists rather than locking every node out
+		Log.Error("reload revocation list failed", "file", tls_crl, "err", err)
+		crl_lock.Lock()
+		lists = crl_lists
+		crl_lock.Unlock()
+	}
+
+	for _, chain := range chains {
+		for idx := 0; idx+1 < len(chain); idx++ {
+			cert, issuer := chain[idx], chain[idx+1]
+			for _, list := range lists {
+				if !bytes.Equal(list.RawIssuer, issuer.RawSubject) {
+					continue
+				}
+				if err := list.CheckSignatureFrom(issuer); err != nil {
+					continue
+				}
+				for _, entry := range list.RevokedCertificateEntries {
+					if entry.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+						return fmt.Errorf("certificate %q serial %s is revoked",
+							cert.Subject.CommonName, cert.SerialNumber)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// PeerNodeID returns the node id of the verified certificate of conn, or ""
+// for a plaintext connection. It completes the TLS handshake if needed.
+func PeerNodeID(conn net.Conn) (string, error) {
+	tls_conn, ok := conn.(*tls.Conn)
+	if !ok {
+		return "", nil
+	}
+
+	tls_conn.SetDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	defer tls_conn.SetDeadline(time.Time{})
+	if err := tls_conn.Handshake(); err != nil {
+		return "", err
+	}
+
+	state := tls_conn.ConnectionState()
+	if len(state.VerifiedChains) == 0 {
+		return "", fmt.Errorf("no verified node certificate")
+	}
+	node_id := state.VerifiedChains[0][0].Subject.CommonName
+	if node_id == "" {
+		return "", fmt.Errorf("node certificate has no common name")
+	}
+	return node_id, nil
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"flag"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// All records go through one writer which groups them into batches of up to
+// -write_batch records, written in one transaction at the latest
+// -write_interval after the first record of the batch arrived. A full queue
+// blocks the connections submitting to it, which slows the nodes down
+// instead of dropping their events.
+//
+// Each record carries a callback run once it is stored or failed. A failed
+// batch is written again record by record, so one bad record does not fail
+// the events of every other node in its batch. Batch sizes and write latency
+// are logged every WRITER_STATS_INTERVAL.
+//
+// Records are stored at the time the node captured them, so events spooled
+// during an outage keep their time. A capture time more than MAX_CLOCK_SKEW
+// ahead of the server is taken as a wrong clock of the node.
+const (
+	WRITER_STATS_INTERVAL = time.Minute
+	MAX_CLOCK_SKEW        = 5 * time.Minute
+)
+
+var (
+	write_batch    int
+	write_interval time.Duration
+	write_queue    int
+
+	writer *Writer
+)
+
+func init() {
+	flag.IntVar(&write_batch, "write_batch", 500, "maximum records written in one transaction")
+	flag.DurationVar(&write_interval, "write_interval", 200*time.Millisecond, "maximum time a record waits for its batch to fill")
+	flag.IntVar(&write_queue, "write_queue", 10000, "records queued for writing before connections block")
+}
+
+// Record is an event or a summary to store.
+type Record struct {
+	Client   *Client
+	Summary  *Summary
+	Received time.Time
+
+	// set by the storage if it held the event already
+	Duplicate bool
+
+	done func(err error)
+}
+
+// Time is when the node captured the record, the receive time if it did not
+// send one or its clock is ahead.
+func (r *Record) Time() time.Time {
+	var captured int64
+	if r.Client != nil {
+		captured = r.Client.Time
+	} else if r.Summary != nil {
+		captured = r.Summary.Time
+	}
+	if captured <= 0 || captured > r.Received.Add(MAX_CLOCK_SKEW).Unix() {
+		return r.Received
+	}
+	return time.Unix(captured, 0)
+}
+
+type WriterStats struct {
+	Batches    int64
+	Records    int64
+	Failed     int64
+	MaxBatch   int
+	Latency    time.Duration // total time spent writing
+	MaxLatency time.Duration
+}
+
+type Writer struct {
+	storage   Storage
+	queue     chan *Record
+	observers []func(record *Record)
+
+	stats_lock *sync.Mutex
+	stats      WriterStats
+}
+
+func NewWriter(storage Storage) *Writer {
+	return &Writer{
+		storage:    storage,
+		queue:      make(chan *Record, write_queue),
+		stats_lock: new(sync.Mutex),
+	}
+}
+
+// Observe registers fn to see every record stored, except duplicates, from
+// the writer goroutine. It has to be called before Run and must not block.
+func (w *Writer) Observe(fn func(record *Record)) {
+	w.observers = append(w.observers, fn)
+}
+
+// Submit queues record, done is called from the writer goroutine once it is
+// stored and may be nil.
+func (w *Writer) Submit(record *Record, done func(err error)) {
+	if record.Received.IsZero() {
+		record.Received = time.Now()
+	}
+	record.done = done
+	w.queue <- record
+}
+
+// Write queues records and waits until all of them are written. It returns
+// the number stored and the first error.
+func (w *Writer) Write(records []*Record) (int, error) {
+	var wait sync.WaitGroup
+	var lock sync.Mutex
+	var first error
+	stored := 0
+	wait.Add(len(records))
+	for _, record := range records {
+		w.Submit(record, func(err error) {
+			lock.Lock()
+			if err == nil {
+				stored++
+			} else if first == nil {
+				first = err
+			}
+			lock.Unlock()
+			wait.Done()
+		})
+	}
+	wait.Wait()
+	return stored, first
+}
+
+func (w *Writer) Run() {
+	batch := make([]*Record, 0, write_batch)
+	var flush <-chan time.Time
+	stats := time.NewTicker(WRITER_STATS_INTERVAL)
+	defer stats.Stop()
+
+	for {
+		select {
+		case record := <-w.queue:
+			if len(batch) == 0 {
+				flush = time.After(write_interval)
+			}
+			batch = append(batch, record)
+			if len(batch) < write_batch {
+				continue
+			}
+		case <-flush:
+		case <-stats.C:
+			w.LogStats()
+			continue
+		}
+
+		w.flush(batch)
+		for idx := range batch {
+			batch[idx] = nil
+		}
+		batch = batch[:0]
+		flush = nil
+	}
+}
+
+func (w *Writer) flush(batch []*Record) {
+	if len(batch) == 0 {
+		return
+	}
+
+	start := time.Now()
+	err := w.storage.Write(batch)
+	latency := time.Since(start)
+
+	failed := 0
+	if err != nil && len(batch) > 1 {
+		Log.Warn("batch write failed, writing records one by one", "records", len(batch), "err", err)
+		for _, record := range batch {
+			err := w.storage.Write([]*Record{record})
+			if err != nil {
+				failed++
+			}
+			w.finish(record, err)
+		}
+	} else {
+		for _, record := range batch {
+			if err != nil {
+				failed++
+			}
+			w.finish(record, err)
+		}
+	}
+
+	w.stats_lock.Lock()
+	w.stats.Batches++
+	w.stats.Records += int64(len(batch))
+	w.stats.Failed += int64(failed)
+	if len(batch) > w.stats.MaxBatch {
+		w.stats.MaxBatch = len(batch)
+	}
+	w.stats.Latency += latency
+	if latency > w.stats.MaxLatency {
+		w.stats.MaxLatency = latency
+	}
+	w.stats_lock.Unlock()
+}
+
+func (w *Writer) finish(record *Record, err error) {
+	if err == nil && !record.Duplicate {
+		for _, fn := range w.observers {
+			fn(record)
+		}
+	}
+	if record.done != nil {
+		record.done(err)
+	}
+}
+
+// TakeStats returns and resets the statistics.
+func (w *Writer) TakeStats() WriterStats {
+	w.stats_lock.Lock()
+	defer w.stats_lock.Unlock()
+	stats := w.stats
+	w.stats = WriterStats{}
+	return stats
+}
+
+func (w *Writer) LogStats() {
+	stats := w.TakeStats()
+	if stats.Batches == 0 {
+		return
+	}
+	Log.Info("writer stats", "batches", stats.Batches, "records", stats.Records, "failed", stats.Failed,
+		"avg_batch", stats.Records/stats.Batches, "max_batch", stats.MaxBatch,
+		"avg_latency", (stats.Latency / time.Duration(stats.Batches)).Round(time.Microsecond),
+		"max_latency", stats.MaxLatency.Round(time.Microsecond), "queued", len(w.queue))
+}
+
+// Acker sends the acks of one node connection as the writer stores its
+// records. Records of a connection are stored in the order submitted, so the
+// last stored seq is a valid cumulative ack. After a failed record nothing
+// is acked anymore and the connection is closed, the node sends the unacked
+// messages again after reconnecting.
+type Acker struct {
+	last uint64 // accessed atomically, first for 64 bit alignment
+
+	conn  net.Conn
+	proto *ProtoConn
+	log   *Logger
+	send  bool
+
+	write_lock *sync.Mutex // writes of the ack goroutine and the handler
+	failed     int32
+	signal     chan struct{}
+	stop       chan struct{}
+}
+
+func NewAcker(conn net.Conn, proto *ProtoConn, log *Logger, send bool) *Acker {
+	a := &Acker{
+		conn:       conn,
+		proto:      proto,
+		log:        log,
+		send:       send,
+		write_lock: new(sync.Mutex),
+		signal:     make(chan struct{}, 1),
+		stop:       make(chan struct{}),
+	}
+	if send {
+		go a.run()
+	}
+	return a
+}
+
+// Stored returns the callback of a record carrying seq.
+func (a *Acker) Stored(seq uint64) func(err error) {
+	return func(err error) {
+		if err != nil {
+			if atomic.CompareAndSwapInt32(&a.failed, 0, 1) {
+				a.log.Warn("storing failed, closing connection", "seq", seq, "err", err)
+				a.conn.Close()
+			}
+			return
+		}
+		if seq == 0 || !a.send || atomic.LoadInt32(&a.failed) != 0 {
+			return
+		}
+		atomic.StoreUint64(&a.last, seq)
+		select {
+		case a.signal <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// WriteRaw writes a message on the connection shared with the acks.
+func (a *Acker) WriteRaw(msg_type MsgType, payload []byte) error {
+	a.write_lock.Lock()
+	defer a.write_lock.Unlock()
+	return a.proto.WriteRaw(msg_type, payload)
+}
+
+func (a *Acker) run() {
+	var acked uint64
+	for {
+		select {
+		case <-a.signal:
+		case <-a.stop:
+			return
+		}
+		seq := atomic.LoadUint64(&a.last)
+		if seq == acked || atomic.LoadInt32(&a.failed) != 0 {
+			continue
+		}
+
+		payload, err := EncodePayload(&Ack{Seq: seq})
+		if err == nil {
+			err = a.WriteRaw(MsgAck, payload)
+		}
+		if err != nil {
+			a.log.Warn("send ack failed", "err", err)
+			a.conn.Close()
+			return
+		}
+		acked = seq
+	}
+}
+
+func (a *Acker) Stop() {
+	close(a.stop)
+}